@@ -0,0 +1,88 @@
+package access
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Engine holds the current Policy and reloads it when its file
+// changes.
+type Engine struct {
+	path string
+
+	mu      sync.RWMutex
+	policy  *Policy
+	modTime time.Time
+	size    int64
+}
+
+// NewEngine loads the policy file at path.
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{path: path}
+	if _, err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Decide checks a request against the current policy.
+func (e *Engine) Decide(req *Request) Decision {
+	e.mu.RLock()
+	p := e.policy
+	e.mu.RUnlock()
+	return p.Decide(req)
+}
+
+// reload reads the policy file if it changed since it was last loaded. An
+// invalid file leaves the current policy in place.
+func (e *Engine) reload() (bool, error) {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return false, err
+	}
+	e.mu.RLock()
+	unchanged := e.policy != nil && info.ModTime().Equal(e.modTime) && info.Size() == e.size
+	e.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return false, err
+	}
+	p, err := ParsePolicy(data)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Remember the file either way so a bad edit is reported once
+	e.modTime, e.size = info.ModTime(), info.Size()
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", e.path, err)
+	}
+	e.policy = p
+	return true, nil
+}
+
+// Watch checks the policy file for changes every interval until stop is
+// closed.
+func (e *Engine) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := e.reload()
+			if err != nil {
+				log.Printf("Error reloading policy: %v", err)
+			} else if reloaded {
+				log.Printf("Reloaded policy from %s", e.path)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,394 @@
+// Package access decides requests against an access policy loaded from
+// YAML, by role, method and path, with conditions on the caller and
+// request.
+package access
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"audit"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is the access policy loaded from YAML. Rules are checked from the
+// highest priority down; among matching rules of equal priority a deny wins
+// over an allow. If no rule matches, Default applies.
+type Policy struct {
+	Default string `yaml:"default"` // "allow" or "deny"; deny if empty
+	Rules   []Rule `yaml:"rules"`
+}
+
+// Rule allows or denies roles access to paths. A rule only matches if
+// all of its conditions hold as well.
+type Rule struct {
+	Name       string     `yaml:"name"`
+	Effect     string     `yaml:"effect"`   // "allow" or "deny"
+	Priority   int        `yaml:"priority"` // Higher is checked first
+	Roles      []string   `yaml:"roles"`    // Required; "*" matches any role, including none
+	Methods    []string   `yaml:"methods"`  // Empty or "*" matches any method
+	Paths      []string   `yaml:"paths"`    // "*" matches one segment, "**" any number, "{name}" captures one
+	Conditions Conditions `yaml:"conditions"`
+}
+
+// Conditions are attribute checks on the caller and request.
+type Conditions struct {
+	// Owner names a path parameter that must equal the caller's ID.
+	Owner string `yaml:"owner"`
+	// SourceCIDRs lists the networks the client address must be in.
+	SourceCIDRs []string `yaml:"source_cidrs"`
+	// TimeWindow limits the days and hours of access.
+	TimeWindow *TimeWindow `yaml:"time_window"`
+	// AuthMethods lists how the caller may have authenticated, such as
+	// "jwt" or "api_key"; any way if empty.
+	AuthMethods []string `yaml:"auth_methods"`
+	// Claims lists required token claims. A claim holding a list matches if
+	// any element does; "*" only requires the claim to be present.
+	Claims map[string]string `yaml:"claims"`
+
+	networks []*net.IPNet
+}
+
+// TimeWindow is a daily window such as 09:00 to 17:00 on weekdays. A window
+// whose end is before its start runs past midnight.
+type TimeWindow struct {
+	Days     []string `yaml:"days"`     // "mon" to "sun"; every day if empty
+	Start    string   `yaml:"start"`    // "15:04"
+	End      string   `yaml:"end"`      // "15:04", exclusive
+	Timezone string   `yaml:"timezone"` // IANA name; UTC if empty
+
+	days       map[time.Weekday]bool
+	start, end time.Duration
+	loc        *time.Location
+}
+
+// Request is what a policy decides on.
+type Request struct {
+	Method    string
+	Path      string
+	Principal *audit.Principal
+	RemoteIP  string
+	Time      time.Time
+}
+
+// Decision is the result of checking a request against a Policy.
+type Decision struct {
+	Allowed bool
+	Rule    string // Name of the deciding rule; empty if the default applied
+}
+
+const (
+	effectAllow = "allow"
+	effectDeny  = "deny"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParsePolicy parses and validates a YAML policy.
+func ParsePolicy(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if p.Default == "" {
+		p.Default = effectDeny
+	}
+	if p.Default != effectAllow && p.Default != effectDeny {
+		return nil, fmt.Errorf("invalid default %q", p.Default)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if rule.Effect != effectAllow && rule.Effect != effectDeny {
+			return nil, fmt.Errorf("rule %s: invalid effect %q", rule.Name, rule.Effect)
+		}
+		if len(rule.Paths) == 0 {
+			return nil, fmt.Errorf("rule %s: no paths", rule.Name)
+		}
+		// A rule for no roles would match nobody; "*" is every role
+		if len(rule.Roles) == 0 {
+			return nil, fmt.Errorf("rule %s: no roles", rule.Name)
+		}
+		// Count the paths capturing each parameter
+		params := make(map[string]int)
+		for _, pattern := range rule.Paths {
+			if err := ValidatePattern(pattern); err != nil {
+				return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+			captured := make(map[string]bool)
+			for _, segment := range splitPath(pattern) {
+				if name, ok := paramName(segment); ok && !captured[name] {
+					captured[name] = true
+					params[name]++
+				}
+			}
+		}
+		for j, m := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(m)
+		}
+		if n := params[rule.Conditions.Owner]; rule.Conditions.Owner != "" && n != len(rule.Paths) {
+			return nil, fmt.Errorf("rule %s: owner parameter {%s} is not in every path", rule.Name, rule.Conditions.Owner)
+		}
+		if err := rule.Conditions.parse(); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+	}
+
+	// Order by priority, then denies first, keeping file order otherwise
+	sort.SliceStable(p.Rules, func(i, j int) bool {
+		if p.Rules[i].Priority != p.Rules[j].Priority {
+			return p.Rules[i].Priority > p.Rules[j].Priority
+		}
+		return p.Rules[i].Effect == effectDeny && p.Rules[j].Effect != effectDeny
+	})
+	return p, nil
+}
+
+// parse validates the conditions of a rule.
+func (c *Conditions) parse() error {
+	for _, s := range c.SourceCIDRs {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid source CIDR %q", s)
+		}
+		c.networks = append(c.networks, network)
+	}
+	if c.TimeWindow != nil {
+		return c.TimeWindow.parse()
+	}
+	return nil
+}
+
+func (w *TimeWindow) parse() error {
+	w.days = make(map[time.Weekday]bool)
+	for _, d := range w.Days {
+		day, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return fmt.Errorf("invalid day %q", d)
+		}
+		w.days[day] = true
+	}
+	for _, f := range []struct {
+		s string
+		d *time.Duration
+	}{{w.Start, &w.start}, {w.End, &w.end}} {
+		t, err := time.Parse("15:04", f.s)
+		if err != nil {
+			return fmt.Errorf("invalid time %q", f.s)
+		}
+		*f.d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone %q", w.Timezone)
+	}
+	w.loc = loc
+	return nil
+}
+
+// contains reports whether t falls in the window. The day of a window
+// running past midnight is the day it started.
+func (w *TimeWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.loc)
+	day, offset := t.Weekday(), t.Sub(midnight)
+	if w.end <= w.start && offset < w.end {
+		day, offset = (day+6)%7, offset+24*time.Hour
+	}
+	end := w.end
+	if end <= w.start {
+		end += 24 * time.Hour
+	}
+	if len(w.days) > 0 && !w.days[day] {
+		return false
+	}
+	return offset >= w.start && offset < end
+}
+
+// Decide checks whether req is allowed.
+func (p *Policy) Decide(req *Request) Decision {
+	for _, rule := range p.Rules {
+		if rule.matches(req) {
+			return Decision{Allowed: rule.Effect == effectAllow, Rule: rule.Name}
+		}
+	}
+	return Decision{Allowed: p.Default == effectAllow}
+}
+
+func (r *Rule) matches(req *Request) bool {
+	var roles []string
+	if req.Principal != nil {
+		roles = req.Principal.Roles
+	}
+	if !matchMethod(r.Methods, req.Method) || !matchRoles(r.Roles, roles) {
+		return false
+	}
+	params, ok := MatchPaths(r.Paths, req.Path)
+	return ok && r.Conditions.hold(req, params)
+}
+
+// hold reports whether every condition holds for req, whose path captured
+// params.
+func (c *Conditions) hold(req *Request, params map[string]string) bool {
+	if c.Owner != "" && (req.Principal == nil || params[c.Owner] != req.Principal.ID) {
+		return false
+	}
+	if len(c.networks) > 0 && !inNetworks(c.networks, req.RemoteIP) {
+		return false
+	}
+	if c.TimeWindow != nil && !c.TimeWindow.contains(req.Time) {
+		return false
+	}
+	if len(c.AuthMethods) > 0 && (req.Principal == nil || !contains(c.AuthMethods, req.Principal.AuthMethod)) {
+		return false
+	}
+	for name, want := range c.Claims {
+		if req.Principal == nil || !matchClaim(req.Principal.Claims[name], want) {
+			return false
+		}
+	}
+	return true
+}
+
+func inNetworks(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchClaim reports whether a claim decoded from JSON has the wanted value.
+func matchClaim(claim interface{}, want string) bool {
+	switch claim := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, v := range claim {
+			if matchClaim(v, want) {
+				return true
+			}
+		}
+		return false
+	case string:
+		return want == "*" || claim == want
+	default:
+		return want == "*" || fmt.Sprint(claim) == want
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMethod(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if m == "*" || m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRoles(ruleRoles, roles []string) bool {
+	for _, want := range ruleRoles {
+		if want == "*" {
+			return true
+		}
+		for _, have := range roles {
+			if want == have {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchPaths matches urlPath against patterns and returns the parameters
+// captured by the first that matches.
+func MatchPaths(patterns []string, urlPath string) (map[string]string, bool) {
+	segments := splitPath(path.Clean("/" + urlPath))
+	for _, pattern := range patterns {
+		params := make(map[string]string)
+		if matchSegments(splitPath(pattern), segments, params) {
+			return params, true
+		}
+	}
+	return nil, false
+}
+
+// ValidatePattern checks that a path pattern, as used in rules, is valid.
+func ValidatePattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("path %q must start with /", pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid path %q", pattern)
+	}
+	return nil
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// paramName returns the name of a "{name}" pattern segment.
+func paramName(segment string) (string, bool) {
+	if len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+// matchSegments matches path segments against pattern segments, where "**"
+// matches zero or more segments, "{name}" captures one into params and other
+// segments use path.Match syntax.
+func matchSegments(pattern, segments []string, params map[string]string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(segments); i >= 0; i-- {
+				if matchSegments(pattern[1:], segments[i:], params) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if name, ok := paramName(pattern[0]); ok {
+			params[name] = segments[0]
+		} else if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
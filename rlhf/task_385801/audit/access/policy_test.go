@@ -0,0 +1,221 @@
+package access
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"audit"
+)
+
+const testPolicy = `
+default: deny
+rules:
+  - name: admin-area
+    effect: allow
+    priority: 20
+    roles: [admin]
+    paths: ["/admin/**"]
+    conditions:
+      auth_methods: [jwt]
+      claims: {amr: mfa}
+  - name: admin-automation
+    effect: allow
+    priority: 20
+    roles: [admin]
+    paths: ["/admin/**"]
+    conditions:
+      auth_methods: [client_cert]
+  - name: own-profile
+    effect: allow
+    priority: 10
+    roles: ["*"]
+    paths: ["/users/{id}", "/users/{id}/**"]
+    conditions:
+      owner: id
+  - name: other-profiles
+    effect: deny
+    priority: 5
+    roles: ["*"]
+    paths: ["/users/**"]
+  - name: office-reports
+    effect: allow
+    priority: 1
+    roles: [staff]
+    methods: [get]
+    paths: ["/reports/*.pdf"]
+    conditions:
+      source_cidrs: [10.0.0.0/8]
+      time_window: {days: [mon, tue, wed, thu, fri], start: "08:00", end: "18:00", timezone: Europe/Berlin}
+  - name: night-batch
+    effect: allow
+    roles: [batch]
+    paths: ["/batch"]
+    conditions:
+      time_window: {start: "22:00", end: "04:00"}
+  # Of equal priority, the deny wins
+  - name: reports-deny
+    effect: deny
+    roles: [staff]
+    paths: ["/reports/**"]
+  - name: reports-allow
+    effect: allow
+    roles: [staff]
+    paths: ["/reports/**"]
+`
+
+func TestDecide(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A Wednesday at 10:00 in Berlin
+	office := time.Date(2024, 5, 15, 8, 0, 0, 0, time.UTC)
+
+	admin := &audit.Principal{ID: "1", Roles: []string{"admin"}, AuthMethod: audit.AuthJWT, Claims: map[string]interface{}{"amr": []interface{}{"pwd", "mfa"}}}
+	adminPwd := &audit.Principal{ID: "1", Roles: []string{"admin"}, AuthMethod: audit.AuthJWT, Claims: map[string]interface{}{"amr": []interface{}{"pwd"}}}
+	adminCert := &audit.Principal{ID: "1", Roles: []string{"admin"}, AuthMethod: audit.AuthClientCert}
+	adminKey := &audit.Principal{ID: "1", Roles: []string{"admin"}, AuthMethod: audit.AuthAPIKey, Claims: map[string]interface{}{"amr": []interface{}{"mfa"}}}
+	staff := &audit.Principal{ID: "7", Roles: []string{"staff"}}
+	batch := &audit.Principal{ID: "9", Roles: []string{"batch"}}
+
+	tests := []struct {
+		name      string
+		req       Request
+		allowed   bool
+		wantRule  string
+		principal *audit.Principal
+	}{
+		{"claim in a list", Request{Method: "GET", Path: "/admin/users"}, true, "admin-area", admin},
+		{"claim missing", Request{Method: "GET", Path: "/admin/users"}, false, "", adminPwd},
+		{"no principal", Request{Method: "GET", Path: "/admin/users"}, false, "", nil},
+		{"auth method", Request{Method: "GET", Path: "/admin/users"}, true, "admin-automation", adminCert},
+		{"auth method not listed", Request{Method: "GET", Path: "/admin/users"}, false, "", adminKey},
+		{"owner", Request{Method: "PUT", Path: "/users/7/settings"}, true, "own-profile", staff},
+		{"not the owner", Request{Method: "GET", Path: "/users/8"}, false, "other-profiles", staff},
+		{"cleaned path", Request{Method: "GET", Path: "/users/7/../8"}, false, "other-profiles", staff},
+		{"all conditions hold", Request{Method: "GET", Path: "/reports/q1.pdf", RemoteIP: "10.1.2.3", Time: office}, true, "office-reports", staff},
+		{"method", Request{Method: "POST", Path: "/reports/q1.pdf", RemoteIP: "10.1.2.3", Time: office}, false, "reports-deny", staff},
+		{"outside the network", Request{Method: "GET", Path: "/reports/q1.pdf", RemoteIP: "192.0.2.1", Time: office}, false, "reports-deny", staff},
+		{"unparseable address", Request{Method: "GET", Path: "/reports/q1.pdf", RemoteIP: "", Time: office}, false, "reports-deny", staff},
+		{"after hours", Request{Method: "GET", Path: "/reports/q1.pdf", RemoteIP: "10.1.2.3", Time: office.Add(9 * time.Hour)}, false, "reports-deny", staff},
+		{"weekend", Request{Method: "GET", Path: "/reports/q1.pdf", RemoteIP: "10.1.2.3", Time: office.Add(72 * time.Hour)}, false, "reports-deny", staff},
+		{"window past midnight, before it", Request{Path: "/batch", Time: time.Date(2024, 5, 15, 21, 59, 0, 0, time.UTC)}, false, "", batch},
+		{"window past midnight, late", Request{Path: "/batch", Time: time.Date(2024, 5, 15, 23, 0, 0, 0, time.UTC)}, true, "night-batch", batch},
+		{"window past midnight, early", Request{Path: "/batch", Time: time.Date(2024, 5, 16, 3, 59, 0, 0, time.UTC)}, true, "night-batch", batch},
+		{"window past midnight, after it", Request{Path: "/batch", Time: time.Date(2024, 5, 16, 4, 0, 0, 0, time.UTC)}, false, "", batch},
+		{"no rule", Request{Method: "GET", Path: "/elsewhere"}, false, "", admin},
+	}
+	for _, tt := range tests {
+		tt.req.Principal = tt.principal
+		d := p.Decide(&tt.req)
+		if d.Allowed != tt.allowed || d.Rule != tt.wantRule {
+			t.Errorf("%s: got allowed %v by %q, want %v by %q", tt.name, d.Allowed, d.Rule, tt.allowed, tt.wantRule)
+		}
+	}
+}
+
+func TestParsePolicyRejectsInvalid(t *testing.T) {
+	tests := map[string]string{
+		"default":          "default: maybe",
+		"effect":           "rules: [{effect: permit, roles: ['*'], paths: [/x]}]",
+		"no paths":         "rules: [{effect: allow, roles: ['*']}]",
+		"no roles":         "rules: [{effect: allow, paths: [/x]}]",
+		"relative path":    "rules: [{effect: allow, roles: ['*'], paths: [x]}]",
+		"bad pattern":      "rules: [{effect: allow, roles: ['*'], paths: ['/[x']}]",
+		"owner not in all": "rules: [{effect: allow, roles: ['*'], paths: ['/u/{id}', /v], conditions: {owner: id}}]",
+		"CIDR":             "rules: [{effect: allow, roles: ['*'], paths: [/x], conditions: {source_cidrs: [10.0.0.0/33]}}]",
+		"day":              "rules: [{effect: allow, roles: ['*'], paths: [/x], conditions: {time_window: {days: [someday], start: '08:00', end: '09:00'}}}]",
+		"time":             "rules: [{effect: allow, roles: ['*'], paths: [/x], conditions: {time_window: {start: '8am', end: '09:00'}}}]",
+		"timezone":         "rules: [{effect: allow, roles: ['*'], paths: [/x], conditions: {time_window: {start: '08:00', end: '09:00', timezone: Mars/Olympus}}}]",
+		"YAML":             "rules: {",
+	}
+	for name, data := range tests {
+		if _, err := ParsePolicy([]byte(data)); err == nil {
+			t.Errorf("%s: ParsePolicy succeeded, want an error", name)
+		}
+	}
+}
+
+func TestMatchPaths(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		ok       bool
+		params   map[string]string
+	}{
+		{[]string{"/a/*"}, "/a/b", true, map[string]string{}},
+		{[]string{"/a/*"}, "/a/b/c", false, nil},
+		{[]string{"/a/**"}, "/a", true, map[string]string{}},
+		{[]string{"/a/**/z"}, "/a/b/c/z", true, map[string]string{}},
+		{[]string{"/x", "/u/{id}/{part}"}, "/u/42/keys", true, map[string]string{"id": "42", "part": "keys"}},
+		{[]string{"/u/{id}"}, "/u/", false, nil},
+		{[]string{"/"}, "", true, map[string]string{}},
+	}
+	for _, tt := range tests {
+		params, ok := MatchPaths(tt.patterns, tt.path)
+		if ok != tt.ok || len(params) != len(tt.params) {
+			t.Errorf("MatchPaths(%v, %q) = %v, %v; want %v, %v", tt.patterns, tt.path, params, ok, tt.params, tt.ok)
+			continue
+		}
+		for k, v := range tt.params {
+			if params[k] != v {
+				t.Errorf("MatchPaths(%v, %q): got %s=%s, want %s", tt.patterns, tt.path, k, params[k], v)
+			}
+		}
+	}
+
+	for pattern, valid := range map[string]bool{"/a/**": true, "/u/{id}": true, "a/b": false, "/[": false, "": false} {
+		if err := ValidatePattern(pattern); (err == nil) != valid {
+			t.Errorf("ValidatePattern(%q) = %v, want valid %v", pattern, err, valid)
+		}
+	}
+}
+
+func TestEngineReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	write := func(data string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+	req := &Request{Method: "GET", Path: "/x"}
+	start := time.Now().Add(-time.Hour)
+
+	write("default: deny", start)
+	e, err := NewEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Decide(req).Allowed {
+		t.Fatal("allowed by a deny-all policy")
+	}
+
+	write("default: allow", start.Add(time.Minute))
+	if reloaded, err := e.reload(); !reloaded || err != nil {
+		t.Fatalf("reload = %v, %v", reloaded, err)
+	}
+	if !e.Decide(req).Allowed {
+		t.Error("change was not applied")
+	}
+
+	// A bad edit is reported once and leaves the policy in place
+	write("default: nope", start.Add(2*time.Minute))
+	if _, err := e.reload(); err == nil {
+		t.Error("invalid policy was accepted")
+	}
+	if reloaded, err := e.reload(); reloaded || err != nil {
+		t.Errorf("unchanged file: reload = %v, %v", reloaded, err)
+	}
+	if !e.Decide(req).Allowed {
+		t.Error("invalid policy replaced the current one")
+	}
+
+	os.Remove(path)
+	if _, err := NewEngine(path); err == nil {
+		t.Error("NewEngine succeeded without a file")
+	}
+}
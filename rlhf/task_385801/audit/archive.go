@@ -0,0 +1,473 @@
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// RetentionOptions controls rotation of audit files and how long audit
+// entries are kept where they were written.
+type RetentionOptions struct {
+	MaxBytes int64 // Rotate the file once it reaches this size; 0 for no limit
+	Daily    bool  // Rotate the file when an entry from a later UTC day arrives
+	Compress bool  // Gzip rotated and archived files
+
+	// MaxAge is how long entries are kept; 0 keeps them forever. Expired
+	// entries are moved to ArchiveDir if it is set, otherwise deleted.
+	// Files expire as a whole, once their newest entry is older than MaxAge.
+	MaxAge     time.Duration
+	ArchiveDir string
+}
+
+// RetentionFlags registers the audit rotation and retention flags on fs. The
+// returned function reads them once fs has been parsed.
+func RetentionFlags(fs *flag.FlagSet) func() RetentionOptions {
+	sizeMB := fs.Int64("audit-rotate-size", 0, "Rotate the audit file when it reaches this many megabytes; 0 disables")
+	daily := fs.Bool("audit-rotate-daily", false, "Rotate the audit file daily")
+	compress := fs.Bool("audit-compress", false, "Gzip rotated and archived audit files")
+	days := fs.Int("audit-retention-days", 0, "Remove audit entries older than this many days; 0 keeps them forever")
+	archiveDir := fs.String("audit-archive-dir", "", "Move expired audit entries to this directory instead of deleting them")
+	return func() RetentionOptions {
+		return RetentionOptions{
+			MaxBytes:   *sizeMB << 20,
+			Daily:      *daily,
+			Compress:   *compress,
+			MaxAge:     time.Duration(*days) * 24 * time.Hour,
+			ArchiveDir: *archiveDir,
+		}
+	}
+}
+
+// ArchiveFile describes one file of archived audit entries.
+type ArchiveFile struct {
+	File     string    `json:"file"` // Relative to the index's directory unless absolute
+	From     time.Time `json:"from"` // Oldest entry
+	To       time.Time `json:"to"`   // Newest entry
+	FirstSeq uint64    `json:"first_seq"`
+	LastSeq  uint64    `json:"last_seq"`
+	PrevHash string    `json:"prev_hash"` // Hash the first entry links to
+	LastHash string    `json:"last_hash"`
+	Entries  int       `json:"entries"`
+}
+
+// add extends the description with an entry appended to the file.
+func (a *ArchiveFile) add(e *Event) {
+	if a.Entries == 0 {
+		a.From, a.To = e.Timestamp, e.Timestamp
+		a.FirstSeq, a.PrevHash = e.Seq, e.PrevHash
+	}
+	if e.Timestamp.Before(a.From) {
+		a.From = e.Timestamp
+	}
+	if e.Timestamp.After(a.To) {
+		a.To = e.Timestamp
+	}
+	a.LastSeq, a.LastHash = e.Seq, e.Hash
+	a.Entries++
+}
+
+// overlaps reports whether the file may hold entries in [since, until).
+// Zero times are unbounded.
+func (a *ArchiveFile) overlaps(since, until time.Time) bool {
+	if !since.IsZero() && a.To.Before(since) {
+		return false
+	}
+	if !until.IsZero() && !a.From.Before(until) {
+		return false
+	}
+	return true
+}
+
+// ArchiveIndex maps the time ranges of archived entries to the files holding
+// them, in chain order. It is rewritten atomically whenever it changes.
+type ArchiveIndex struct {
+	Archives []ArchiveFile `json:"archives"`
+
+	path string
+}
+
+// indexPathFor returns the index of the files rotated out of the audit file
+// at path.
+func indexPathFor(path string) string {
+	return path + ".index.json"
+}
+
+// ArchiveIndexPath returns the index of the entries archived from a database
+// into dir.
+func ArchiveIndexPath(dir string) string {
+	return filepath.Join(dir, "index.json")
+}
+
+// LoadArchiveIndex reads the index at path. A missing index is empty.
+func LoadArchiveIndex(path string) (*ArchiveIndex, error) {
+	idx := &ArchiveIndex{path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, idx); err != nil {
+		return nil, fmt.Errorf("invalid archive index %s: %v", path, err)
+	}
+	return idx, nil
+}
+
+func (idx *ArchiveIndex) save() error {
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.path)
+}
+
+// add records an archive, keeping the index in chain order.
+func (idx *ArchiveIndex) add(a ArchiveFile) {
+	idx.Archives = append(idx.Archives, a)
+	sort.SliceStable(idx.Archives, func(i, j int) bool {
+		return idx.Archives[i].FirstSeq < idx.Archives[j].FirstSeq
+	})
+}
+
+// head returns the chain head at the end of the newest archive.
+func (idx *ArchiveIndex) head() chainHead {
+	if len(idx.Archives) == 0 {
+		return chainHead{}
+	}
+	last := idx.Archives[len(idx.Archives)-1]
+	return chainHead{Seq: last.LastSeq, Hash: last.LastHash}
+}
+
+// resolve returns the path of an archive file.
+func (idx *ArchiveIndex) resolve(a ArchiveFile) string {
+	if filepath.IsAbs(a.File) {
+		return a.File
+	}
+	return filepath.Join(filepath.Dir(idx.path), a.File)
+}
+
+// relative returns how path is recorded in the index.
+func (idx *ArchiveIndex) relative(path string) string {
+	rel, err := filepath.Rel(filepath.Dir(idx.path), path)
+	if err != nil {
+		if abs, err := filepath.Abs(path); err == nil {
+			return abs
+		}
+		return path
+	}
+	return rel
+}
+
+// openArchive opens an archive file, decompressing it if its name ends in
+// .gz. A compressed archive whose compression did not finish is read from
+// the uncompressed file.
+func openArchive(path string) (io.ReadCloser, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return os.Open(path)
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.Open(strings.TrimSuffix(path, ".gz"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// readArchive returns the entries in an archive file in chain order.
+func readArchive(path string) ([]Event, error) {
+	r, err := openArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var entries []Event
+	err = eachLine(r, func(n int, line []byte) error {
+		var entry Event
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("%s line %d: %v", path, n, err)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// createArchive writes a new archive file at path with write, gzipping it if
+// the name ends in .gz. It writes through a temporary file so a partial
+// archive never appears under its final name.
+func createArchive(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		buf := bufio.NewWriter(f)
+		if !strings.HasSuffix(path, ".gz") {
+			if err := write(buf); err != nil {
+				return err
+			}
+			return buf.Flush()
+		}
+		zw := gzip.NewWriter(buf)
+		if err := write(zw); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		return buf.Flush()
+	}()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// compressFile gzips the file at path into path.gz and removes the original.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	err = createArchive(path+".gz", func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// moveFile renames src to dst, copying it if they are on different file
+// systems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// uniquePath returns path, or path with a counter before its extensions if
+// it already exists.
+func uniquePath(path string) string {
+	dir, base := filepath.Split(path)
+	name, ext := base, ""
+	if i := strings.Index(base, "."); i > 0 {
+		name, ext = base[:i], base[i:]
+	}
+	for n := 1; ; n++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			if _, err := os.Stat(strings.TrimSuffix(path, ".gz")); errors.Is(err, os.ErrNotExist) {
+				return path
+			}
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", name, n, ext))
+	}
+}
+
+// archiveTimeFormat names archive files after their oldest entry.
+const archiveTimeFormat = "20060102T150405Z"
+
+// PruneEvents removes the entries in db older than opts.MaxAge, first
+// writing them to a new file in opts.ArchiveDir if it is set. The newest
+// entry is always kept so the chain can be continued after a restart. It
+// returns the number of entries removed.
+func PruneEvents(db *gorm.DB, opts RetentionOptions, now time.Time) (int, error) {
+	if opts.MaxAge <= 0 {
+		return 0, nil
+	}
+	var newest Event
+	if err := db.Order("seq desc").First(&newest).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	expired := db.Model(&Event{}).Where("timestamp < ? AND seq < ?", now.Add(-opts.MaxAge).UTC(), newest.Seq)
+
+	if opts.ArchiveDir != "" {
+		// Archive a fixed set of entries, so that no entry is deleted
+		// without having been archived
+		var lastSeq sql.NullInt64
+		if err := expired.Select("max(seq)").Row().Scan(&lastSeq); err != nil || !lastSeq.Valid {
+			return 0, err
+		}
+		expired = expired.Where("seq <= ?", lastSeq.Int64)
+		if err := archiveEvents(expired, opts); err != nil {
+			return 0, err
+		}
+	}
+	// A crash between archiving and deleting leaves the entries in both
+	result := expired.Delete(&Event{})
+	return int(result.RowsAffected), result.Error
+}
+
+// archiveEvents writes the entries selected by expired to a new archive file
+// and records it in the index.
+func archiveEvents(expired *gorm.DB, opts RetentionOptions) error {
+	if err := os.MkdirAll(opts.ArchiveDir, 0700); err != nil {
+		return err
+	}
+	idx, err := LoadArchiveIndex(ArchiveIndexPath(opts.ArchiveDir))
+	if err != nil {
+		return err
+	}
+
+	var oldest Event
+	if err := expired.Order("timestamp").First(&oldest).Error; err != nil {
+		return err
+	}
+	name := "audit_logs-" + oldest.Timestamp.UTC().Format(archiveTimeFormat) + ".jsonl"
+	if opts.Compress {
+		name += ".gz"
+	}
+	path := uniquePath(filepath.Join(opts.ArchiveDir, name))
+
+	var a ArchiveFile
+	err = createArchive(path, func(w io.Writer) error {
+		rows, err := expired.Order("seq").Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		enc := json.NewEncoder(w)
+		for rows.Next() {
+			var entry Event
+			if err := expired.ScanRows(rows, &entry); err != nil {
+				return err
+			}
+			if err := enc.Encode(&entry); err != nil {
+				return err
+			}
+			a.add(&entry)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+	a.File = idx.relative(path)
+	idx.add(a)
+	return idx.save()
+}
+
+// StartRetention prunes db with PruneEvents now and then every interval
+// until the returned function is called.
+func StartRetention(db *gorm.DB, opts RetentionOptions, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			n, err := PruneEvents(db, opts, time.Now())
+			if err != nil {
+				log.Printf("Error pruning audit entries: %v", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d audit entries older than %v", n, opts.MaxAge)
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// search returns up to limit archived entries matching q, newest first,
+// starting below q.ArchiveSeq if it is set. more reports whether there are
+// further matches.
+func (idx *ArchiveIndex) search(q *Query, limit int) (entries []Event, more bool, err error) {
+	for i := len(idx.Archives) - 1; i >= 0; i-- {
+		a := idx.Archives[i]
+		if q.ArchiveSeq != 0 && a.FirstSeq >= q.ArchiveSeq {
+			continue
+		}
+		if !a.overlaps(q.Since, q.Until) {
+			continue
+		}
+		archived, err := readArchive(idx.resolve(a))
+		if err != nil {
+			return nil, false, err
+		}
+		for j := len(archived) - 1; j >= 0; j-- {
+			e := archived[j]
+			if q.ArchiveSeq != 0 && e.Seq >= q.ArchiveSeq {
+				continue
+			}
+			if !q.matches(&e) {
+				continue
+			}
+			if len(entries) == limit {
+				return entries, true, nil
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, false, nil
+}
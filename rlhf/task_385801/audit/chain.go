@@ -0,0 +1,324 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// genesisHash is the PrevHash of the first entry in a chain.
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// chainHead identifies the most recent entry in a hash chain.
+type chainHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// hashChain assigns sequence numbers and links each entry to the one before
+// it. It is not safe for concurrent use; the batching sink calls it from its
+// single writer goroutine.
+type hashChain struct {
+	head chainHead
+}
+
+func newHashChain(head chainHead) *hashChain {
+	if head.Hash == "" {
+		head.Hash = genesisHash
+	}
+	return &hashChain{head: head}
+}
+
+// link stamps entry with the next sequence number, the previous entry's hash
+// and its own hash.
+func (c *hashChain) link(entry *Event) error {
+	// Normalize the timestamp so the hash survives a JSON round trip
+	entry.Timestamp = entry.Timestamp.UTC()
+	entry.Seq = c.head.Seq + 1
+	entry.PrevHash = c.head.Hash
+
+	hash, err := hashEntry(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	c.head = chainHead{Seq: entry.Seq, Hash: hash}
+	return nil
+}
+
+// hashEntry returns the SHA-256 of entry's JSON encoding with Hash left empty.
+// PrevHash is part of the encoding, which is what chains the entries.
+func hashEntry(entry *Event) (string, error) {
+	unsigned := *entry
+	unsigned.Hash = ""
+	b, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// headPath returns the sidecar file recording the chain head of an audit file.
+func headPath(path string) string {
+	return path + ".head"
+}
+
+// writeChainHead atomically replaces the head file for the audit file at path.
+func writeChainHead(path string, head chainHead) error {
+	return saveHead(headPath(path), head)
+}
+
+// saveHead atomically replaces the head file at file.
+func saveHead(file string, head chainHead) error {
+	b, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// readHeadFile returns the recorded head for the audit file at path, or nil
+// if no head file exists.
+func readHeadFile(path string) (*chainHead, error) {
+	return loadHead(headPath(path))
+}
+
+// loadHead returns the head recorded in file, or nil if it does not exist.
+func loadHead(file string) (*chainHead, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var head chainHead
+	if err := json.Unmarshal(b, &head); err != nil {
+		return nil, fmt.Errorf("invalid head file: %v", err)
+	}
+	return &head, nil
+}
+
+// readChainHead returns the head to resume appending to the audit file at
+// path. The head file is preferred; without one the last entry is used.
+func readChainHead(path string) (chainHead, error) {
+	head, err := readHeadFile(path)
+	if err != nil {
+		return chainHead{}, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return chainHead{}, nil
+	}
+	if err != nil {
+		return chainHead{}, err
+	}
+	defer f.Close()
+
+	var last chainHead
+	err = eachLine(f, func(_ int, line []byte) error {
+		var entry Event
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil
+		}
+		last = chainHead{Seq: entry.Seq, Hash: entry.Hash}
+		return nil
+	})
+	if err != nil {
+		return chainHead{}, err
+	}
+
+	// The file may be ahead of the head file if we stopped between the two writes
+	if head != nil && head.Seq > last.Seq {
+		return *head, nil
+	}
+	return last, nil
+}
+
+// eachLine calls fn with every non-empty line of r and its 1-based number.
+func eachLine(r io.Reader, fn func(n int, line []byte) error) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if ferr := fn(n, trimmed); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ChainVerification is the result of verifying an audit file.
+type ChainVerification struct {
+	Entries     int    // Entries verified before the first broken link
+	LastSeq     uint64 // Sequence number of the last valid entry
+	Archives    int    // Rotated files verified before the active file
+	File        string // File containing the first broken link
+	BrokenLine  int    // Line of the first broken link, or 0 if the chain is intact
+	Reason      string // Why the chain is broken or truncated
+	Truncated   bool   // The file ends before the recorded head
+	HeadMissing bool   // No head file, so truncation of the tail cannot be detected
+}
+
+// OK reports whether the chain is intact and complete.
+func (v *ChainVerification) OK() bool {
+	return v.BrokenLine == 0 && !v.Truncated
+}
+
+// VerifyFile walks the audit file at path, checking that sequence
+// numbers are contiguous from 1, that each entry links to the previous one and
+// that every hash matches its entry. It stops at the first broken link.
+//
+// If the file has been rotated, the archives in its index are walked first
+// as part of the same chain. Once older archives have expired, the chain
+// starts from the entry the oldest remaining archive links to.
+func VerifyFile(path string) (*ChainVerification, error) {
+	idx, err := LoadArchiveIndex(indexPathFor(path))
+	if err != nil {
+		return nil, err
+	}
+	result := &ChainVerification{}
+	prev := chainHead{Hash: genesisHash}
+	for i, a := range idx.Archives {
+		if i == 0 {
+			prev = chainHead{Seq: a.FirstSeq - 1, Hash: a.PrevHash}
+		}
+		file := idx.resolve(a)
+		r, err := openArchive(file)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := verifyEntries(r, file, &prev, result)
+		r.Close()
+		if err != nil || !ok {
+			return result, err
+		}
+		if prev.Seq != a.LastSeq || prev.Hash != a.LastHash {
+			result.File = file
+			result.Truncated = true
+			result.Reason = fmt.Sprintf("archive ends at seq %d but the index records seq %d", prev.Seq, a.LastSeq)
+			return result, nil
+		}
+		result.Archives++
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if ok, err := verifyEntries(f, path, &prev, result); err != nil || !ok {
+		return result, err
+	}
+
+	head, err := readHeadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case head == nil:
+		result.HeadMissing = true
+	case head.Seq > prev.Seq:
+		result.Truncated = true
+		result.Reason = fmt.Sprintf("file ends at seq %d but head records seq %d", prev.Seq, head.Seq)
+	case head.Seq == prev.Seq && head.Hash != prev.Hash:
+		result.Truncated = true
+		result.Reason = fmt.Sprintf("seq %d does not match the recorded head", prev.Seq)
+	}
+	return result, nil
+}
+
+// verifyEntries checks the entries read from r, which must continue the
+// chain from prev, and advances prev past them. It reports false if it found
+// a broken link, which is recorded in result.
+func verifyEntries(r io.Reader, file string, prev *chainHead, result *ChainVerification) (bool, error) {
+	errBroken := errors.New("broken")
+	err := eachLine(r, func(n int, line []byte) error {
+		broken := func(format string, args ...interface{}) error {
+			result.File = file
+			result.BrokenLine = n
+			result.Reason = fmt.Sprintf(format, args...)
+			return errBroken
+		}
+
+		var entry Event
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return broken("invalid JSON: %v", err)
+		}
+		if entry.Seq != prev.Seq+1 {
+			return broken("expected seq %d, found %d", prev.Seq+1, entry.Seq)
+		}
+		if entry.PrevHash != prev.Hash {
+			return broken("seq %d does not link to the previous entry", entry.Seq)
+		}
+		hash, err := hashEntry(&entry)
+		if err != nil {
+			return err
+		}
+		if hash != entry.Hash {
+			return broken("seq %d has been modified", entry.Seq)
+		}
+
+		result.Entries++
+		result.LastSeq = entry.Seq
+		*prev = chainHead{Seq: entry.Seq, Hash: entry.Hash}
+		return nil
+	})
+	if err == errBroken {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RunVerify implements the "verify" subcommand.
+func RunVerify(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: verify <audit-file>")
+		return 2
+	}
+
+	result, err := VerifyFile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying audit file: %v\n", err)
+		return 2
+	}
+
+	switch {
+	case result.BrokenLine != 0:
+		fmt.Printf("BROKEN at %s line %d after %d valid entries: %s\n", result.File, result.BrokenLine, result.Entries, result.Reason)
+	case result.Truncated:
+		fmt.Printf("TRUNCATED after %d entries: %s\n", result.Entries, result.Reason)
+	default:
+		fmt.Printf("OK: %d entries, last seq %d\n", result.Entries, result.LastSeq)
+		if result.Archives > 0 {
+			fmt.Printf("including %d rotated files\n", result.Archives)
+		}
+		if result.HeadMissing {
+			fmt.Println("warning: no head file, truncation of the tail cannot be detected")
+		}
+	}
+
+	if !result.OK() {
+		return 1
+	}
+	return 0
+}
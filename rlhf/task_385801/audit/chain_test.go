@@ -0,0 +1,263 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeAuditFile writes n entries to a file sink at path and returns the
+// lines of the file.
+func writeAuditFile(t *testing.T, path string, rot RetentionOptions, n int) [][]byte {
+	t.Helper()
+	s, err := NewRotatingFileSink(path, rot, BatchOptions{BatchSize: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewRotatingFileSink: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		if err := s.Write(&Event{Method: "GET", Path: "/items", Status: 200, Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return readLines(t, path)
+}
+
+func readLines(t *testing.T, path string) [][]byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.SplitAfter(bytes.TrimSuffix(b, []byte("\n")), []byte("\n"))
+}
+
+func writeLines(t *testing.T, path string, lines [][]byte) {
+	t.Helper()
+	if err := os.WriteFile(path, bytes.Join(lines, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyFileDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name       string
+		tamper     func(path string, lines [][]byte) [][]byte
+		brokenLine int
+		truncated  bool
+		reason     string
+	}{
+		{
+			name:   "intact",
+			tamper: func(_ string, lines [][]byte) [][]byte { return lines },
+		},
+		{
+			name: "modified entry",
+			tamper: func(_ string, lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`"status":200`), []byte(`"status":404`), 1)
+				return lines
+			},
+			brokenLine: 2,
+			reason:     "seq 2 has been modified",
+		},
+		{
+			name: "deleted entry",
+			tamper: func(_ string, lines [][]byte) [][]byte {
+				return append(lines[:1], lines[2:]...)
+			},
+			brokenLine: 2,
+			reason:     "expected seq 2, found 3",
+		},
+		{
+			name: "reordered entries",
+			tamper: func(_ string, lines [][]byte) [][]byte {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			brokenLine: 2,
+			reason:     "expected seq 2, found 3",
+		},
+		{
+			name: "invalid JSON",
+			tamper: func(_ string, lines [][]byte) [][]byte {
+				lines[0] = []byte("{\n")
+				return lines
+			},
+			brokenLine: 1,
+			reason:     "invalid JSON",
+		},
+		{
+			name: "truncated tail",
+			tamper: func(_ string, lines [][]byte) [][]byte {
+				return lines[:len(lines)-1]
+			},
+			truncated: true,
+			reason:    "file ends at seq 3 but head records seq 4",
+		},
+		{
+			name: "replaced tail",
+			tamper: func(path string, lines [][]byte) [][]byte {
+				writeChainHead(path, chainHead{Seq: 4, Hash: genesisHash})
+				return lines
+			},
+			truncated: true,
+			reason:    "seq 4 does not match the recorded head",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			lines := writeAuditFile(t, path, RetentionOptions{}, 4)
+			writeLines(t, path, tt.tamper(path, lines))
+
+			result, err := VerifyFile(path)
+			if err != nil {
+				t.Fatalf("VerifyFile: %v", err)
+			}
+			if result.BrokenLine != tt.brokenLine || result.Truncated != tt.truncated {
+				t.Fatalf("got broken line %d, truncated %v (%s); want %d, %v",
+					result.BrokenLine, result.Truncated, result.Reason, tt.brokenLine, tt.truncated)
+			}
+			if !strings.HasPrefix(result.Reason, tt.reason) {
+				t.Errorf("reason %q, want %q", result.Reason, tt.reason)
+			}
+			if ok := tt.brokenLine == 0 && !tt.truncated; result.OK() != ok {
+				t.Errorf("OK() = %v, want %v", result.OK(), ok)
+			}
+		})
+	}
+}
+
+func TestVerifyFileWithoutHead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditFile(t, path, RetentionOptions{}, 3)
+	if err := os.Remove(headPath(path)); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := VerifyFile(path)
+	if err != nil {
+		t.Fatalf("VerifyFile: %v", err)
+	}
+	if !result.OK() || !result.HeadMissing || result.Entries != 3 {
+		t.Errorf("got %+v, want 3 entries with the head missing", result)
+	}
+}
+
+func TestFileSinkResumesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditFile(t, path, RetentionOptions{}, 2)
+	writeAuditFile(t, path, RetentionOptions{}, 2)
+
+	result, err := VerifyFile(path)
+	if err != nil {
+		t.Fatalf("VerifyFile: %v", err)
+	}
+	if !result.OK() || result.Entries != 4 || result.LastSeq != 4 {
+		t.Errorf("got %+v, want 4 valid entries", result)
+	}
+}
+
+func TestVerifyFileAcrossArchives(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		// Every entry is larger than this, so each one gets a file of its own
+		writeAuditFile(t, path, RetentionOptions{MaxBytes: 1, Compress: compress}, 4)
+
+		result, err := VerifyFile(path)
+		if err != nil {
+			t.Fatalf("compress %v: VerifyFile: %v", compress, err)
+		}
+		if !result.OK() || result.Archives != 3 || result.Entries != 4 {
+			t.Errorf("compress %v: got %+v, want 4 entries over 3 archives", compress, result)
+		}
+	}
+}
+
+func TestVerifyFileDetectsTamperedArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditFile(t, path, RetentionOptions{MaxBytes: 1}, 3)
+	idx, err := LoadArchiveIndex(indexPathFor(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := idx.resolve(idx.Archives[1])
+	lines := readLines(t, archive)
+	lines[0] = bytes.Replace(lines[0], []byte(`"/items"`), []byte(`"/other"`), 1)
+	writeLines(t, archive, lines)
+
+	result, err := VerifyFile(path)
+	if err != nil {
+		t.Fatalf("VerifyFile: %v", err)
+	}
+	if result.File != archive || result.BrokenLine != 1 || result.Archives != 1 {
+		t.Errorf("got %+v, want line 1 of %s broken after 1 archive", result, archive)
+	}
+}
+
+func TestVerifyFileAfterArchivesExpire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditFile(t, path, RetentionOptions{MaxBytes: 1}, 4)
+
+	// Drop the oldest archive as expiry does; the chain starts after it
+	idx, err := LoadArchiveIndex(indexPathFor(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(idx.resolve(idx.Archives[0]))
+	idx.Archives = idx.Archives[1:]
+	if err := idx.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := VerifyFile(path)
+	if err != nil {
+		t.Fatalf("VerifyFile: %v", err)
+	}
+	if !result.OK() || result.Entries != 3 || result.LastSeq != 4 {
+		t.Errorf("got %+v, want seq 2 to 4 valid", result)
+	}
+
+	// An archive cut short no longer reaches the seq the index records
+	archive := idx.resolve(idx.Archives[0])
+	writeLines(t, archive, nil)
+	if result, err = VerifyFile(path); err != nil {
+		t.Fatalf("VerifyFile: %v", err)
+	}
+	if !result.Truncated || result.File != archive {
+		t.Errorf("got %+v, want %s truncated", result, archive)
+	}
+}
+
+func TestRunVerifyExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.log")
+	writeAuditFile(t, good, RetentionOptions{}, 2)
+	bad := filepath.Join(dir, "bad.log")
+	lines := writeAuditFile(t, bad, RetentionOptions{}, 2)
+	writeLines(t, bad, lines[1:])
+
+	// RunVerify reports on stdout, which is not needed here
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	for _, tt := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{good}, 0},
+		{[]string{bad}, 1},
+		{[]string{filepath.Join(dir, "missing.log")}, 2},
+		{nil, 2},
+	} {
+		if got := RunVerify(tt.args); got != tt.want {
+			t.Errorf("RunVerify(%q) = %d, want %d", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Change is a field of a resource changed by a request. Before is empty
+// for created fields and After for removed ones; both are empty for values
+// that must not be logged, such as passwords.
+type Change struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Changes lists the fields a request changed. It is stored as JSON in the
+// database.
+type Changes []Change
+
+// Value implements driver.Valuer.
+func (c Changes) Value() (driver.Value, error) {
+	if len(c) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(c)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner.
+func (c *Changes) Scan(src interface{}) error {
+	var b []byte
+	switch src := src.(type) {
+	case nil:
+	case string:
+		b = []byte(src)
+	case []byte:
+		b = src
+	default:
+		return fmt.Errorf("cannot scan %T into Changes", src)
+	}
+	*c = nil
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, c)
+}
+
+// Diff returns the top-level JSON fields that differ between before and
+// after, sorted by name. A nil before is a creation and a nil after a
+// deletion. Fields left out of the JSON encoding are not compared.
+func Diff(before, after interface{}) (Changes, error) {
+	b, err := jsonFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := jsonFields(after)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for name := range b {
+		names[name] = true
+	}
+	for name := range a {
+		names[name] = true
+	}
+	var changes Changes
+	for name := range names {
+		if !bytes.Equal(b[name], a[name]) {
+			changes = append(changes, Change{Field: name, Before: b[name], After: a[name]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+// jsonFields returns the compacted JSON of each field of v.
+func jsonFields(v interface{}) (map[string]json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// RecordChanges records that the request in flight changed target, a
+// resource such as "user:42", and how.
+func RecordChanges(ctx context.Context, target string, changes Changes) {
+	if e, ok := ctx.Value(eventKey{}).(*Event); ok {
+		e.Target, e.Changes = target, append(e.Changes, changes...)
+	}
+}
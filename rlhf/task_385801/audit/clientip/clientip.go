@@ -0,0 +1,187 @@
+// Package clientip resolves the address of the client that sent a request,
+// following X-Forwarded-For, X-Real-IP and RFC 7239 Forwarded headers only
+// through proxies that are explicitly trusted.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver determines client IPs. The zero value trusts no proxies and
+// always returns the peer address of the connection.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver returns a Resolver that trusts forwarding headers added by
+// proxies in the given CIDRs. Bare IP addresses are accepted as single hosts.
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, s := range trustedProxies {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", s, err)
+		}
+		r.trusted = append(r.trusted, ipNet)
+	}
+	return r, nil
+}
+
+// ParseList splits a comma-separated list of CIDRs, as taken from a flag,
+// and returns a Resolver for them.
+func ParseList(list string) (*Resolver, error) {
+	return NewResolver(strings.Split(list, ","))
+}
+
+// isTrusted reports whether ip belongs to a trusted proxy.
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the client address of req.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	return r.Resolve(req.RemoteAddr, req.Header)
+}
+
+// Resolve returns the client address for a request received from remoteAddr
+// with the given headers. Forwarding headers are walked from the nearest hop
+// outwards, and the first address that is not a trusted proxy is the client.
+// If every hop is trusted the outermost one is returned.
+func (r *Resolver) Resolve(remoteAddr string, h http.Header) string {
+	peer := parseHost(remoteAddr)
+	if peer == nil {
+		return remoteAddr
+	}
+	if !r.isTrusted(peer) {
+		return peer.String()
+	}
+
+	// Forwarded supersedes the de facto headers when both are present
+	hops, ok := forwardedHops(h)
+	if !ok {
+		hops, ok = xForwardedForHops(h)
+	}
+	if !ok {
+		if ip := parseHost(h.Get("X-Real-IP")); ip != nil {
+			return ip.String()
+		}
+		return peer.String()
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHost(hops[i])
+		if ip == nil {
+			// Obfuscated or malformed hop; nothing beyond it can be trusted
+			break
+		}
+		client = ip
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// xForwardedForHops returns the addresses listed in X-Forwarded-For, client
+// first.
+func xForwardedForHops(h http.Header) ([]string, bool) {
+	values := h.Values("X-Forwarded-For")
+	if len(values) == 0 {
+		return nil, false
+	}
+	var hops []string
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops, true
+}
+
+// forwardedHops returns the for= parameters of the RFC 7239 Forwarded
+// header, client first.
+func forwardedHops(h http.Header) ([]string, bool) {
+	values := h.Values("Forwarded")
+	if len(values) == 0 {
+		return nil, false
+	}
+	var hops []string
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			hop := ""
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					hop = strings.Trim(value, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops, true
+}
+
+// splitQuoted splits s at sep, ignoring separators inside double quotes.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseHost parses an IP address with an optional port, accepting the
+// "[v6]:port" and bare "[v6]" forms used by RemoteAddr and Forwarded.
+func parseHost(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	// Drop any IPv6 zone, which net.ParseIP rejects
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,140 @@
+package clientip
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewResolverRejectsInvalidProxies(t *testing.T) {
+	for _, list := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1,bogus/8"} {
+		if _, err := ParseList(list); err == nil {
+			t.Errorf("ParseList(%q) succeeded, want an error", list)
+		}
+	}
+	if _, err := ParseList(""); err != nil {
+		t.Errorf("ParseList(\"\"): %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	r, err := ParseList("10.0.0.0/8, 192.0.2.10, 2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		want       string
+	}{
+		{
+			name:       "untrusted peer ignores headers",
+			remoteAddr: "203.0.113.5:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.1.2.3:4000",
+			want:       "10.1.2.3",
+		},
+		{
+			name:       "X-Forwarded-For through one proxy",
+			remoteAddr: "10.1.2.3:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "spoofed hop before the first untrusted one",
+			remoteAddr: "10.1.2.3:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1, 10.9.9.9"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "X-Forwarded-For over several headers",
+			remoteAddr: "192.0.2.10:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1", "10.0.0.7"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "every hop trusted",
+			remoteAddr: "10.1.2.3:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.0.0.1, 10.0.0.2"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "malformed hop stops the walk",
+			remoteAddr: "10.1.2.3:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1, garbage, 10.0.0.2"}},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "X-Real-IP",
+			remoteAddr: "10.1.2.3:4000",
+			headers:    map[string][]string{"X-Real-Ip": {"198.51.100.9"}},
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "Forwarded wins over X-Forwarded-For",
+			remoteAddr: "10.1.2.3:4000",
+			headers: map[string][]string{
+				"Forwarded":       {`for=198.51.100.1;proto=https, for="10.0.0.5:8080"`},
+				"X-Forwarded-For": {"203.0.113.77"},
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:       "Forwarded with quoted IPv6 and port",
+			remoteAddr: "[2001:db8::1]:443",
+			headers:    map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}},
+			want:       "2001:db8:cafe::17",
+		},
+		{
+			name:       "Forwarded obfuscated identifier",
+			remoteAddr: "10.1.2.3:4000",
+			headers:    map[string][]string{"Forwarded": {"for=198.51.100.1, for=_hidden"}},
+			want:       "10.1.2.3",
+		},
+		{
+			name:       "Forwarded separators inside quotes",
+			remoteAddr: "10.1.2.3:4000",
+			headers:    map[string][]string{"Forwarded": {`for=198.51.100.3;by="a,b;c"`}},
+			want:       "198.51.100.3",
+		},
+		{
+			name:       "IPv4-mapped peer",
+			remoteAddr: "[::ffff:10.1.2.3]:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "IPv6 zone",
+			remoteAddr: "[fe80::1%eth0]:4000",
+			want:       "fe80::1",
+		},
+		{
+			name:       "unparseable remote address",
+			remoteAddr: "pipe",
+			want:       "pipe",
+		},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for k, vs := range tt.headers {
+			for _, v := range vs {
+				h.Add(k, v)
+			}
+		}
+		if got := r.Resolve(tt.remoteAddr, h); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestZeroResolverTrustsNoProxies(t *testing.T) {
+	h := http.Header{"X-Forwarded-For": {"198.51.100.1"}}
+	if got := (&Resolver{}).Resolve("127.0.0.1:80", h); got != "127.0.0.1" {
+		t.Errorf("got %s, want the peer address", got)
+	}
+}
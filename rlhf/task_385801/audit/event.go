@@ -0,0 +1,187 @@
+// Package audit records one audit event per request with the same schema
+// regardless of the server framework. The net/http middleware lives here;
+// gin, gorilla/mux and gRPC adapters are in the ginaudit, muxaudit and
+// grpcaudit subpackages.
+package audit
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"audit/clientip"
+)
+
+// Event is an audit record. Every adapter emits this schema.
+type Event struct {
+	ID        uint       `json:"-"`
+	Timestamp time.Time  `json:"timestamp"`
+	UserID    string     `json:"user_id,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	Principal *Principal `json:"principal,omitempty" gorm:"type:text"`
+	Method    string     `json:"method"`
+	Path      string     `json:"path"`
+	RemoteIP  string     `json:"remote_ip"`
+	UserAgent string     `json:"user_agent,omitempty"`
+	Status    int        `json:"status"`
+	GRPCCode  string     `json:"grpc_code,omitempty"`
+	Outcome   string     `json:"outcome,omitempty"`
+	Reason    string     `json:"reason,omitempty"` // Machine-readable reason a request was refused or failed
+	Rule      string     `json:"rule,omitempty"`   // Access policy rule that allowed or denied the request
+
+	// Target is the resource the request changed, such as "user:42", and
+	// Changes how it changed
+	Target  string  `json:"target,omitempty" gorm:"index"`
+	Changes Changes `json:"changes,omitempty" gorm:"type:text"`
+
+	DurationMs   float64 `json:"duration_ms"`
+	RequestSize  int64   `json:"request_size"`
+	ResponseSize int64   `json:"response_size"`
+	Protocol     string  `json:"protocol"`
+
+	RequestHeaders        Headers `json:"request_headers,omitempty" gorm:"type:text"`
+	ResponseHeaders       Headers `json:"response_headers,omitempty" gorm:"type:text"`
+	RequestBody           string  `json:"request_body,omitempty"`
+	RequestBodyTruncated  bool    `json:"request_body_truncated,omitempty"`
+	ResponseBody          string  `json:"response_body,omitempty"`
+	ResponseBodyTruncated bool    `json:"response_body_truncated,omitempty"`
+
+	// SampleRate is the fraction of similar requests recorded, if the
+	// route's policy samples them
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	Seq      uint64 `json:"seq" gorm:"index"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+
+	policy *RoutePolicy // How the event is recorded; all of it if nil
+}
+
+// TableName keeps events in the table the services used before the schema
+// was shared.
+func (Event) TableName() string {
+	return "audit_logs"
+}
+
+type eventKey struct{}
+
+// Begin starts an event for a request arriving now and returns a context
+// that carries it, so that WithPrincipal can attach the caller from inner
+// layers.
+func Begin(ctx context.Context) (context.Context, *Event) {
+	e := &Event{Timestamp: time.Now()}
+	if p, ok := PrincipalFrom(ctx); ok {
+		e.setPrincipal(p)
+	}
+	return context.WithValue(ctx, eventKey{}, e), e
+}
+
+// WithUser records an authenticated caller known only by ID and username.
+// See WithPrincipal.
+func WithUser(ctx context.Context, id, username string) context.Context {
+	return WithPrincipal(ctx, &Principal{ID: id, Username: username})
+}
+
+// Outcomes of a request. Events whose outcome was not set explicitly get
+// one from their status; see OutcomeFor.
+const (
+	OutcomeAllowed         = "allowed"
+	OutcomeUnauthenticated = "unauthenticated"
+	OutcomeForbidden       = "forbidden"
+	OutcomeError           = "error"
+)
+
+// OutcomeFor returns the outcome implied by an HTTP status.
+func OutcomeFor(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return OutcomeUnauthenticated
+	case status == http.StatusForbidden, status == http.StatusTooManyRequests:
+		return OutcomeForbidden
+	case status >= 500:
+		return OutcomeError
+	default:
+		return OutcomeAllowed
+	}
+}
+
+// SetReason records why the request in flight was refused or failed, as a
+// short snake_case code such as "invalid_credentials".
+func SetReason(ctx context.Context, reason string) {
+	if e, ok := ctx.Value(eventKey{}).(*Event); ok {
+		e.Reason = reason
+	}
+}
+
+// SetRule records the access policy rule that decided the request in
+// flight.
+func SetRule(ctx context.Context, rule string) {
+	if e, ok := ctx.Value(eventKey{}).(*Event); ok {
+		e.Rule = rule
+	}
+}
+
+// SetOutcome records the outcome of the request in flight and the reason
+// for it.
+func SetOutcome(ctx context.Context, outcome, reason string) {
+	if e, ok := ctx.Value(eventKey{}).(*Event); ok {
+		e.Outcome, e.Reason = outcome, reason
+	}
+}
+
+// Logger completes events and writes them to a Sink.
+type Logger struct {
+	Sink     Sink
+	Resolver *clientip.Resolver // Trusts no proxies if nil
+	Paths    []PathPolicy       // Policies by path prefix; see PolicyFor
+	Rand     func() float64     // Draws sampling decisions in [0, 1); math/rand if nil
+}
+
+// NewLogger returns a Logger writing to sink.
+func NewLogger(sink Sink, resolver *clientip.Resolver) *Logger {
+	return &Logger{Sink: sink, Resolver: resolver}
+}
+
+// ClientIP returns the client address of r.
+func (l *Logger) ClientIP(r *http.Request) string {
+	return l.ResolveIP(r.RemoteAddr, r.Header)
+}
+
+// ResolveIP returns the client address of a request received from
+// remoteAddr with the given headers.
+func (l *Logger) ResolveIP(remoteAddr string, h http.Header) string {
+	if l.Resolver == nil {
+		return (&clientip.Resolver{}).Resolve(remoteAddr, h)
+	}
+	return l.Resolver.Resolve(remoteAddr, h)
+}
+
+// DescribeRequest fills the fields of e that come from an HTTP request.
+func (l *Logger) DescribeRequest(e *Event, r *http.Request) {
+	e.Method = r.Method
+	e.Path = r.URL.Path
+	e.RemoteIP = l.ClientIP(r)
+	e.UserAgent = r.UserAgent()
+	e.Protocol = r.Proto
+}
+
+// Finish stamps the duration and outcome of e and writes it to the sink,
+// unless its policy excludes or samples it out.
+func (l *Logger) Finish(e *Event) {
+	if e.Outcome == "" {
+		e.Outcome = OutcomeFor(e.Status)
+	}
+	if p := e.policy; p != nil {
+		if p.Exclude || p.sampledOut(e, l.Rand) {
+			return
+		}
+		if p.Sample > 0 && p.Sample < 1 {
+			e.SampleRate = p.Sample
+		}
+	}
+	e.DurationMs = float64(time.Since(e.Timestamp)) / float64(time.Millisecond)
+	if err := l.Sink.Write(e); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Package ginaudit adapts the audit package to gin.
+package ginaudit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware records an audit event for every request handled by the
+// router or group it is installed on. It must come after gin.Recovery, as
+// in gin.Default, which answers panics it passes on.
+func Middleware(l *audit.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, e := audit.Begin(c.Request.Context())
+		c.Request = c.Request.WithContext(ctx)
+		applyPolicy(c, l.PolicyFor(c.Request.URL.Path))
+
+		// A panicking handler is recorded with the status already sent, or
+		// the 500 gin.Recovery answers with, and the panic passed on to it
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			describe(l, c, e)
+			if !c.Writer.Written() {
+				e.Status = http.StatusInternalServerError
+			}
+			e.Outcome, e.Reason = audit.OutcomeError, "panic"
+			l.Finish(e)
+			panic(p)
+		}()
+
+		// Process request
+		c.Next()
+
+		describe(l, c, e)
+		l.Finish(e)
+	}
+}
+
+// describe fills e from the request and response of c.
+func describe(l *audit.Logger, c *gin.Context, e *audit.Event) {
+	l.DescribeRequest(e, c.Request)
+	e.Status = c.Writer.Status()
+	if c.Request.ContentLength > 0 {
+		e.RequestSize = c.Request.ContentLength
+	}
+	if size := c.Writer.Size(); size > 0 {
+		e.ResponseSize = int64(size)
+	}
+	audit.DescribeHeaders(e, c.Request.Header, c.Writer.Header())
+
+	p := e.Policy()
+	bodies, ok := c.Get(captureKey)
+	if !ok || p.Verbosity < audit.VerbosityBodies {
+		return
+	}
+	b := bodies.(*capturedBodies)
+	redaction := p.CaptureSettings().Policy
+	e.RequestBody = redaction.Redact(b.request.buf.Bytes(), c.Request.Header.Get("Content-Type"))
+	e.RequestBodyTruncated = b.request.truncated
+	e.ResponseBody = redaction.Redact(b.response.buf.Bytes(), c.Writer.Header().Get("Content-Type"))
+	e.ResponseBodyTruncated = b.response.truncated
+}
+
+// Policy returns middleware that applies p to the requests handled by the
+// group or route it is installed on, in place of the policy chosen by path.
+// Middleware must run before it.
+func Policy(p audit.RoutePolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		applyPolicy(c, p)
+		c.Next()
+	}
+}
+
+// captureKey is the gin context key of a request's capturedBodies.
+const captureKey = "ginaudit.bodies"
+
+// applyPolicy sets the policy of the request's event and starts capturing
+// bodies if it records them.
+func applyPolicy(c *gin.Context, p audit.RoutePolicy) {
+	audit.SetPolicy(c.Request.Context(), p)
+	if p.Verbosity < audit.VerbosityBodies {
+		return
+	}
+	if _, ok := c.Get(captureKey); ok {
+		return
+	}
+	max := p.CaptureSettings().MaxBytes
+	b := &capturedBodies{request: &cappedBuffer{max: max}, response: &cappedBuffer{max: max}}
+	if c.Request.Body != nil && c.Request.Body != http.NoBody {
+		c.Request.Body = &captureReader{ReadCloser: c.Request.Body, capture: b.request}
+	}
+	c.Writer = &captureWriter{ResponseWriter: c.Writer, capture: b.response}
+	c.Set(captureKey, b)
+}
+
+// capturedBodies holds the start of a request's bodies.
+type capturedBodies struct {
+	request, response *cappedBuffer
+}
+
+// cappedBuffer keeps at most max bytes of what is written to it.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.truncated = true
+		p = p[:room]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// captureReader copies what the handler reads from the request body.
+type captureReader struct {
+	io.ReadCloser
+	capture *cappedBuffer
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.capture.Write(p[:n])
+	return n, err
+}
+
+// captureWriter copies the response body.
+type captureWriter struct {
+	gin.ResponseWriter
+	capture *cappedBuffer
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.capture.Write(p[:n])
+	return n, err
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	w.capture.Write([]byte(s[:n]))
+	return n, err
+}
+
+// SetUser records an authenticated caller known only by ID and username.
+// See SetPrincipal.
+func SetUser(c *gin.Context, id, username string) {
+	SetPrincipal(c, &audit.Principal{ID: id, Username: username})
+}
+
+// SetPrincipal records the authenticated caller for the request's audit
+// event and for later handlers, which read it with PrincipalFrom.
+func SetPrincipal(c *gin.Context, p *audit.Principal) {
+	c.Request = c.Request.WithContext(audit.WithPrincipal(c.Request.Context(), p))
+}
+
+// PrincipalFrom returns the caller recorded for the request, if any.
+func PrincipalFrom(c *gin.Context) (*audit.Principal, bool) {
+	return audit.PrincipalFrom(c.Request.Context())
+}
@@ -0,0 +1,102 @@
+package ginaudit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*audit.Event
+}
+
+func (s *recordingSink) Write(e *audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestMiddlewareRecordsPanics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		handler    gin.HandlerFunc
+		wantStatus int
+	}{
+		{"before writing", func(c *gin.Context) { panic("boom") }, http.StatusInternalServerError},
+		{"after writing", func(c *gin.Context) { c.Status(http.StatusAccepted); c.Writer.WriteHeaderNow(); panic("boom") }, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		sink := &recordingSink{}
+		router := gin.New()
+		router.Use(gin.CustomRecovery(func(c *gin.Context, err interface{}) {
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}), Middleware(audit.NewLogger(sink, nil)))
+		router.GET("/", tt.handler)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if len(sink.events) != 1 {
+			t.Fatalf("%s: got %d events, want 1", tt.name, len(sink.events))
+		}
+		e := sink.events[0]
+		if e.Status != tt.wantStatus || rec.Code != tt.wantStatus {
+			t.Errorf("%s: got recorded status %d, sent %d; want %d", tt.name, e.Status, rec.Code, tt.wantStatus)
+		}
+		if e.Outcome != audit.OutcomeError || e.Reason != "panic" {
+			t.Errorf("%s: got outcome %q, reason %q", tt.name, e.Outcome, e.Reason)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	sink := &recordingSink{}
+	l := audit.NewLogger(sink, nil)
+	l.Rand = func() float64 { return 0.99 } // Drops every sampled request
+	router := gin.New()
+	router.Use(Middleware(l))
+	echo := func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Data(http.StatusOK, "application/json", body)
+	}
+	router.GET("/healthz", Policy(audit.RoutePolicy{Exclude: true}), echo)
+	router.GET("/items", Policy(audit.RoutePolicy{Sample: 0.5}), echo)
+	router.POST("/login", Policy(audit.RoutePolicy{Verbosity: audit.VerbosityBodies}), echo)
+
+	for _, path := range []string{"/healthz", "/items"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if len(sink.events) != 0 {
+		t.Fatalf("got %d events for excluded and sampled out routes, want 0", len(sink.events))
+	}
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"alice","password":"hunter2"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if len(sink.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(sink.events))
+	}
+	e := sink.events[0]
+	if e.RequestHeaders["Authorization"][0] != audit.DefaultRedactionPolicy.Mask {
+		t.Errorf("got Authorization %v, want it masked", e.RequestHeaders["Authorization"])
+	}
+	if !strings.Contains(e.RequestBody, "alice") || !strings.Contains(e.ResponseBody, "alice") {
+		t.Errorf("got bodies %q and %q, want both recorded", e.RequestBody, e.ResponseBody)
+	}
+	if strings.Contains(e.RequestBody+e.ResponseBody, "hunter2") {
+		t.Error("the password was recorded")
+	}
+}
@@ -0,0 +1,121 @@
+// Package grpcaudit adapts the audit package to gRPC servers.
+package grpcaudit
+
+import (
+	"context"
+	"net/http"
+
+	"audit"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor records an audit event for every unary call.
+func UnaryServerInterceptor(l *audit.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, e := audit.Begin(ctx)
+		defer recoverCall(l, ctx, e, info.FullMethod)
+		resp, err := handler(ctx, req)
+		describeCall(l, ctx, e, info.FullMethod, err)
+		l.Finish(e)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records an audit event for every stream when it
+// ends.
+func StreamServerInterceptor(l *audit.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, e := audit.Begin(ss.Context())
+		defer recoverCall(l, ctx, e, info.FullMethod)
+		err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		describeCall(l, ctx, e, info.FullMethod, err)
+		l.Finish(e)
+		return err
+	}
+}
+
+// recoverCall records a panicking handler as an Internal error, which is
+// what a recovery interceptor answers with, and passes the panic on to it
+// as the HTTP and gin adapters do. It must be deferred.
+func recoverCall(l *audit.Logger, ctx context.Context, e *audit.Event, method string) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	describeCall(l, ctx, e, method, status.Error(codes.Internal, "internal error"))
+	e.Outcome, e.Reason = audit.OutcomeError, "panic"
+	l.Finish(e)
+	panic(p)
+}
+
+// serverStream gives stream handlers the context carrying the audit event.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// describeCall fills e for a call to method that returned err. A gRPC call
+// is an HTTP/2 POST to the method's path, and is recorded as one.
+func describeCall(l *audit.Logger, ctx context.Context, e *audit.Event, method string, err error) {
+	header := http.Header{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, vs := range md {
+			for _, v := range vs {
+				header.Add(k, v)
+			}
+		}
+	}
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remoteAddr = p.Addr.String()
+	}
+
+	code := status.Code(err)
+	e.Method = http.MethodPost
+	e.Path = method
+	e.RemoteIP = l.ResolveIP(remoteAddr, header)
+	e.UserAgent = header.Get("User-Agent")
+	e.Protocol = "grpc"
+	e.GRPCCode = code.String()
+	e.Status = httpStatus(code)
+}
+
+// httpStatus maps a gRPC code to the equivalent HTTP status, following the
+// mapping used by grpc-gateway.
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
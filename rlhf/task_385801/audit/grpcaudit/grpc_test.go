@@ -0,0 +1,137 @@
+package grpcaudit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"audit"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*audit.Event
+}
+
+func (s *recordingSink) Write(e *audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+// incoming returns a context for a call from 192.0.2.7 with a user agent.
+func incoming() context.Context {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 4000}})
+	return metadata.NewIncomingContext(ctx, metadata.Pairs("user-agent", "grpc-go/test"))
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantCode    string
+		wantStatus  int
+		wantOutcome string
+	}{
+		{"ok", nil, "OK", http.StatusOK, audit.OutcomeAllowed},
+		{"not found", status.Error(codes.NotFound, "no such user"), "NotFound", http.StatusNotFound, audit.OutcomeAllowed},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "no token"), "Unauthenticated", http.StatusUnauthorized, audit.OutcomeUnauthenticated},
+		{"denied", status.Error(codes.PermissionDenied, "no"), "PermissionDenied", http.StatusForbidden, audit.OutcomeForbidden},
+	}
+	for _, tt := range tests {
+		sink := &recordingSink{}
+		intercept := UnaryServerInterceptor(audit.NewLogger(sink, nil))
+		info := &grpc.UnaryServerInfo{FullMethod: "/users.Users/Get"}
+		resp, err := intercept(incoming(), "req", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			audit.WithUser(ctx, "42", "alice")
+			return "resp", tt.err
+		})
+		if resp != "resp" || err != tt.err {
+			t.Errorf("%s: got %v, %v; want the handler's result", tt.name, resp, err)
+		}
+		if len(sink.events) != 1 {
+			t.Fatalf("%s: got %d events, want 1", tt.name, len(sink.events))
+		}
+		e := sink.events[0]
+		if e.GRPCCode != tt.wantCode || e.Status != tt.wantStatus || e.Outcome != tt.wantOutcome {
+			t.Errorf("%s: got code %s, status %d, outcome %s; want %s, %d, %s", tt.name, e.GRPCCode, e.Status, e.Outcome, tt.wantCode, tt.wantStatus, tt.wantOutcome)
+		}
+		if e.Method != "POST" || e.Path != info.FullMethod || e.Protocol != "grpc" {
+			t.Errorf("%s: got %s %s over %s, want POST %s over grpc", tt.name, e.Method, e.Path, e.Protocol, info.FullMethod)
+		}
+		if e.RemoteIP != "192.0.2.7" || e.UserAgent != "grpc-go/test" || e.UserID != "42" {
+			t.Errorf("%s: got client %s, agent %q, user %q", tt.name, e.RemoteIP, e.UserAgent, e.UserID)
+		}
+	}
+}
+
+func TestUnaryServerInterceptorRecordsPanics(t *testing.T) {
+	sink := &recordingSink{}
+	intercept := UnaryServerInterceptor(audit.NewLogger(sink, nil))
+	info := &grpc.UnaryServerInfo{FullMethod: "/users.Users/Get"}
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("got panic %v, want it passed on", p)
+			}
+		}()
+		intercept(incoming(), "req", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			panic("boom")
+		})
+	}()
+	if len(sink.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(sink.events))
+	}
+	e := sink.events[0]
+	if e.GRPCCode != "Internal" || e.Status != http.StatusInternalServerError {
+		t.Errorf("got code %s, status %d; want Internal, 500", e.GRPCCode, e.Status)
+	}
+	if e.Outcome != audit.OutcomeError || e.Reason != "panic" {
+		t.Errorf("got outcome %q, reason %q", e.Outcome, e.Reason)
+	}
+}
+
+// testStream is a server stream with only a context.
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	sink := &recordingSink{}
+	intercept := StreamServerInterceptor(audit.NewLogger(sink, nil))
+	info := &grpc.StreamServerInfo{FullMethod: "/users.Users/Watch"}
+	want := status.Error(codes.Canceled, "client went away")
+
+	err := intercept(nil, &testStream{ctx: incoming()}, info, func(srv interface{}, ss grpc.ServerStream) error {
+		// The handler's stream carries the event
+		audit.WithUser(ss.Context(), "42", "alice")
+		return want
+	})
+	if err != want {
+		t.Errorf("got %v, want the handler's error", err)
+	}
+	if len(sink.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(sink.events))
+	}
+	e := sink.events[0]
+	if e.Path != info.FullMethod || e.GRPCCode != "Canceled" || e.Status != 499 || e.UserID != "42" {
+		t.Errorf("got %s with code %s, status %d, user %q", e.Path, e.GRPCCode, e.Status, e.UserID)
+	}
+}
@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+)
+
+// Handler is middleware that records an event for every request to next.
+func (l *Logger) Handler(next http.Handler) http.Handler {
+	return l.CaptureHandler(nil, next)
+}
+
+// CaptureHandler is Handler that also records redacted copies of the
+// request and response bodies. A nil capture records neither.
+func (l *Logger) CaptureHandler(capture *BodyCapture, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, e := Begin(r.Context())
+
+		// Wrap the ResponseWriter and request body to record their sizes
+		rw, ww := wrapResponseWriter(w)
+		c := &httpCapture{rw: rw}
+		if r.Body != nil && r.Body != http.NoBody {
+			c.body = &countingBody{ReadCloser: r.Body}
+			r.Body = c.body
+		}
+		r = r.WithContext(context.WithValue(ctx, captureKey{}, c))
+
+		policy := l.PolicyFor(r.URL.Path)
+		if capture != nil {
+			policy.Verbosity, policy.Capture = VerbosityBodies, capture
+		}
+		SetPolicy(r.Context(), policy)
+
+		describe := func() {
+			l.DescribeRequest(e, r)
+			e.Status = rw.StatusCode
+			e.RequestSize = requestSize(r, c.body)
+			e.ResponseSize = rw.Bytes
+			DescribeHeaders(e, r.Header, rw.Header())
+			if p := e.Policy(); p.Verbosity >= VerbosityBodies && rw.capture != nil {
+				redaction := p.CaptureSettings().Policy
+				if c.body != nil {
+					e.RequestBody = redaction.Redact(c.body.capture.buf.Bytes(), r.Header.Get("Content-Type"))
+					e.RequestBodyTruncated = c.body.capture.truncated
+				}
+				e.ResponseBody = redaction.Redact(rw.capture.buf.Bytes(), rw.Header().Get("Content-Type"))
+				e.ResponseBodyTruncated = rw.capture.truncated
+			}
+		}
+
+		// A panicking handler is answered with a 500 if nothing was written
+		// yet, and recorded with the status actually sent. The panic is then
+		// passed on so that the server logs it and drops the connection.
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if !rw.WroteHeader && !rw.Hijacked {
+				http.Error(ww, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				if f, ok := ww.(http.Flusher); ok {
+					f.Flush()
+				}
+			}
+			describe()
+			e.Outcome, e.Reason = OutcomeError, "panic"
+			l.Finish(e)
+			panic(p)
+		}()
+
+		// Handle the request
+		next.ServeHTTP(ww, r)
+		describe()
+		l.Finish(e)
+	})
+}
+
+type captureKey struct{}
+
+// httpCapture holds the wrappers of a request handled by CaptureHandler so
+// that a route's policy can turn on body capture.
+type httpCapture struct {
+	rw   *ResponseWriterWithStatus
+	body *countingBody
+}
+
+// enable starts copying up to max bytes of each body, unless it already is.
+func (c *httpCapture) enable(max int) {
+	if c.rw.capture != nil {
+		return
+	}
+	c.rw.capture = &cappedBuffer{max: max}
+	if c.body != nil {
+		c.body.capture = &cappedBuffer{max: max}
+	}
+}
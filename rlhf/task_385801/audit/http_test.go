@@ -0,0 +1,193 @@
+package audit
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingSink keeps the events written to it.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+func (s *recordingSink) Write(e *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+// only returns the single event recorded.
+func (s *recordingSink) only(t *testing.T) *Event {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(s.events))
+	}
+	return s.events[0]
+}
+
+func TestHandlerRecordsSizesAndStatus(t *testing.T) {
+	sink := &recordingSink{}
+	l := NewLogger(sink, nil)
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+		w.Write([]byte(", world"))
+	}))
+
+	req := httptest.NewRequest("POST", "/items?x=1", strings.NewReader("0123456789"))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	e := sink.only(t)
+	if e.Method != "POST" || e.Path != "/items" || e.Status != http.StatusCreated {
+		t.Errorf("got %s %s %d, want POST /items 201", e.Method, e.Path, e.Status)
+	}
+	if e.RequestSize != 10 || e.ResponseSize != 12 {
+		t.Errorf("got request size %d and response size %d, want 10 and 12", e.RequestSize, e.ResponseSize)
+	}
+	if e.RemoteIP != "192.0.2.1" || e.UserAgent != "test" || e.Protocol != "HTTP/1.1" {
+		t.Errorf("got remote IP %q, user agent %q, protocol %q", e.RemoteIP, e.UserAgent, e.Protocol)
+	}
+	if e.DurationMs < 0 || e.Outcome != OutcomeAllowed {
+		t.Errorf("got duration %v and outcome %q", e.DurationMs, e.Outcome)
+	}
+}
+
+func TestHandlerDefaultsToOK(t *testing.T) {
+	sink := &recordingSink{}
+	h := NewLogger(sink, nil).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if e := sink.only(t); e.Status != http.StatusOK || e.ResponseSize != 0 {
+		t.Errorf("got status %d and size %d, want 200 and 0", e.Status, e.ResponseSize)
+	}
+}
+
+func TestResponseWriterRecordsFinalStatusAfterInformational(t *testing.T) {
+	rw, _ := wrapResponseWriter(httptest.NewRecorder())
+	rw.WriteHeader(http.StatusEarlyHints)
+	rw.WriteHeader(http.StatusNoContent)
+	rw.WriteHeader(http.StatusInternalServerError)
+	if rw.StatusCode != http.StatusNoContent {
+		t.Errorf("got status %d, want 204", rw.StatusCode)
+	}
+}
+
+// fullWriter implements every optional interface.
+type fullWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (fullWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	server, client := net.Pipe()
+	client.Close()
+	return server, nil, nil
+}
+
+func (fullWriter) Push(string, *http.PushOptions) error { return nil }
+
+// plainWriter implements no optional interface.
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+func TestWrapResponseWriterKeepsOptionalInterfaces(t *testing.T) {
+	tests := []struct {
+		name                      string
+		w                         http.ResponseWriter
+		flusher, hijacker, pusher bool
+	}{
+		{"plain", plainWriter{httptest.NewRecorder()}, false, false, false},
+		{"flusher", httptest.NewRecorder(), true, false, false},
+		{"all", fullWriter{httptest.NewRecorder()}, true, true, true},
+	}
+	for _, tt := range tests {
+		_, ww := wrapResponseWriter(tt.w)
+		_, flusher := ww.(http.Flusher)
+		_, hijacker := ww.(http.Hijacker)
+		_, pusher := ww.(http.Pusher)
+		if flusher != tt.flusher || hijacker != tt.hijacker || pusher != tt.pusher {
+			t.Errorf("%s: got flusher %v, hijacker %v, pusher %v; want %v, %v, %v",
+				tt.name, flusher, hijacker, pusher, tt.flusher, tt.hijacker, tt.pusher)
+		}
+		if u, ok := ww.(interface{ Unwrap() http.ResponseWriter }); !ok || u.Unwrap() != tt.w {
+			t.Errorf("%s: Unwrap does not return the original writer", tt.name)
+		}
+	}
+}
+
+func TestResponseWriterHijackRecordsSwitchingProtocols(t *testing.T) {
+	rw, ww := wrapResponseWriter(fullWriter{httptest.NewRecorder()})
+	conn, _, err := ww.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !rw.Hijacked || rw.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("got hijacked %v, status %d; want true, 101", rw.Hijacked, rw.StatusCode)
+	}
+}
+
+func TestRequestSize(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader("abcdef"))
+	if got := requestSize(r, &countingBody{n: 2}); got != 6 {
+		t.Errorf("partly read body: got %d, want the declared 6", got)
+	}
+	r.ContentLength = -1
+	if got := requestSize(r, &countingBody{n: 4}); got != 4 {
+		t.Errorf("chunked body: got %d, want the 4 bytes read", got)
+	}
+	if got := requestSize(r, nil); got != 0 {
+		t.Errorf("unknown length: got %d, want 0", got)
+	}
+}
+
+func TestCaptureHandlerRecordsPanics(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    func(w http.ResponseWriter)
+		value      interface{}
+		wantStatus int
+	}{
+		{"before writing", func(w http.ResponseWriter) {}, "boom", http.StatusInternalServerError},
+		{"after writing", func(w http.ResponseWriter) { w.WriteHeader(http.StatusAccepted) }, "boom", http.StatusAccepted},
+		{"aborted", func(w http.ResponseWriter) { w.Write([]byte("partial")) }, http.ErrAbortHandler, http.StatusOK},
+	}
+	for _, tt := range tests {
+		sink := &recordingSink{}
+		h := NewLogger(sink, nil).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tt.handler(w)
+			panic(tt.value)
+		}))
+		rec := httptest.NewRecorder()
+		func() {
+			defer func() {
+				if p := recover(); p != tt.value {
+					t.Errorf("%s: got panic %v, want %v passed on", tt.name, p, tt.value)
+				}
+			}()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		}()
+
+		e := sink.only(t)
+		if e.Status != tt.wantStatus || rec.Code != tt.wantStatus {
+			t.Errorf("%s: got recorded status %d, sent %d; want %d", tt.name, e.Status, rec.Code, tt.wantStatus)
+		}
+		if e.Outcome != OutcomeError || e.Reason != "panic" {
+			t.Errorf("%s: got outcome %q, reason %q", tt.name, e.Outcome, e.Reason)
+		}
+	}
+}
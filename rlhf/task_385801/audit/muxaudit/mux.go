@@ -0,0 +1,27 @@
+// Package muxaudit adapts the audit package to gorilla/mux.
+package muxaudit
+
+import (
+	"net/http"
+
+	"audit"
+
+	"github.com/gorilla/mux"
+)
+
+// NamedRoutes returns router middleware that applies the policy listed
+// under the name of the matched route, if any. Install it with Router.Use
+// on a router wrapped by audit.Logger.Handler; requests to unnamed routes
+// keep the policy chosen by path.
+func NamedRoutes(policies map[string]audit.RoutePolicy) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil {
+				if p, ok := policies[route.GetName()]; ok {
+					audit.SetPolicy(r.Context(), p)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
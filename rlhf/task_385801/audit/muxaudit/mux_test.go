@@ -0,0 +1,79 @@
+package muxaudit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"audit"
+
+	"github.com/gorilla/mux"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*audit.Event
+}
+
+func (s *recordingSink) Write(e *audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestNamedRoutes(t *testing.T) {
+	sink := &recordingSink{}
+	l := audit.NewLogger(sink, nil)
+	l.Rand = func() float64 { return 0.99 } // Drops every sampled request
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.Copy(w, r.Body)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/healthz", echo).Name("health")
+	router.HandleFunc("/items/{id}", echo).Name("item")
+	router.HandleFunc("/login", echo).Name("login")
+	router.HandleFunc("/other", echo)
+	router.Use(NamedRoutes(map[string]audit.RoutePolicy{
+		"health": {Exclude: true},
+		"item":   {Sample: 0.5},
+		"login":  {Verbosity: audit.VerbosityBodies},
+	}))
+	h := l.Handler(router)
+
+	for _, path := range []string{"/healthz", "/items/7"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if len(sink.events) != 0 {
+		t.Fatalf("got %d events for excluded and sampled out routes, want 0", len(sink.events))
+	}
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"alice","password":"hunter2"}`))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if len(sink.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(sink.events))
+	}
+	e := sink.events[0]
+	if !strings.Contains(e.RequestBody, "alice") || !strings.Contains(e.ResponseBody, "alice") {
+		t.Errorf("got bodies %q and %q, want both recorded", e.RequestBody, e.ResponseBody)
+	}
+	if strings.Contains(e.RequestBody+e.ResponseBody, "hunter2") {
+		t.Error("the password was recorded")
+	}
+
+	// Unnamed routes keep the policy chosen by path
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/other", strings.NewReader(`{"n":1}`)))
+	if len(sink.events) != 2 {
+		t.Fatalf("got %d events, want 2", len(sink.events))
+	}
+	if e := sink.events[1]; e.Path != "/other" || e.RequestBody != "" {
+		t.Errorf("got %s with body %q, want /other without its body", e.Path, e.RequestBody)
+	}
+}
@@ -0,0 +1,197 @@
+package audit
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// Verbosity sets how much of a request is recorded.
+type Verbosity int
+
+const (
+	VerbosityMetadata Verbosity = iota // Method, path, status, sizes and timing
+	VerbosityHeaders                   // Also the request and response headers
+	VerbosityBodies                    // Also the request and response bodies
+)
+
+// ParseVerbosity parses "metadata", "headers" or "bodies".
+func ParseVerbosity(s string) (Verbosity, error) {
+	switch strings.ToLower(s) {
+	case "", "metadata":
+		return VerbosityMetadata, nil
+	case "headers":
+		return VerbosityHeaders, nil
+	case "bodies":
+		return VerbosityBodies, nil
+	}
+	return 0, fmt.Errorf("invalid audit verbosity %q", s)
+}
+
+// RoutePolicy decides whether and how requests to a route are audited. The
+// zero value records every request's metadata.
+type RoutePolicy struct {
+	Exclude bool // Record nothing, as for health checks
+
+	// Sample is the fraction of allowed requests recorded, between 0 and 1.
+	// Refused and failed requests are always recorded. 0 records every
+	// request.
+	Sample float64
+
+	Verbosity Verbosity
+	Capture   *BodyCapture // Limits and redaction of headers and bodies; DefaultBodyCapture if nil
+}
+
+// DefaultBodyCapture is used by policies that record bodies without setting
+// their own limits.
+var DefaultBodyCapture = &BodyCapture{
+	MaxBytes: 4096,
+	Policy:   DefaultRedactionPolicy,
+}
+
+// CaptureSettings returns the body capture limits and redaction of the policy.
+func (p *RoutePolicy) CaptureSettings() *BodyCapture {
+	if p.Capture != nil {
+		return p.Capture
+	}
+	return DefaultBodyCapture
+}
+
+// sampledOut reports whether e is dropped by the policy's sampling, drawing
+// from random or math/rand if it is nil.
+func (p *RoutePolicy) sampledOut(e *Event, random func() float64) bool {
+	if p.Sample <= 0 || p.Sample >= 1 || e.Outcome != OutcomeAllowed {
+		return false
+	}
+	if random == nil {
+		random = rand.Float64
+	}
+	return random() >= p.Sample
+}
+
+// PathPolicy applies a policy to the requests whose path starts with Prefix.
+type PathPolicy struct {
+	Prefix string
+	RoutePolicy
+}
+
+// PolicyFor returns the policy of the longest matching prefix in l.Paths,
+// or the zero policy if none matches.
+func (l *Logger) PolicyFor(path string) RoutePolicy {
+	var best *PathPolicy
+	for i := range l.Paths {
+		p := &l.Paths[i]
+		if strings.HasPrefix(path, p.Prefix) && (best == nil || len(p.Prefix) > len(best.Prefix)) {
+			best = p
+		}
+	}
+	if best == nil {
+		return RoutePolicy{}
+	}
+	return best.RoutePolicy
+}
+
+// SetPolicy applies p to the request in flight in place of the one chosen
+// by path. Route middleware calls it before the handler runs, so that bodies
+// can be captured.
+func SetPolicy(ctx context.Context, p RoutePolicy) {
+	if e, ok := ctx.Value(eventKey{}).(*Event); ok {
+		e.policy = &p
+	}
+	if c, ok := ctx.Value(captureKey{}).(*httpCapture); ok && p.Verbosity >= VerbosityBodies {
+		c.enable(p.CaptureSettings().MaxBytes)
+	}
+}
+
+// Policy returns net/http middleware that applies p to the requests it
+// handles. It must run inside Handler.
+func Policy(p RoutePolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			SetPolicy(r.Context(), p)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Headers is a set of redacted HTTP headers. It is stored as JSON in the
+// database.
+type Headers map[string][]string
+
+// Value implements driver.Valuer.
+func (h Headers) Value() (driver.Value, error) {
+	if len(h) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(h)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner.
+func (h *Headers) Scan(src interface{}) error {
+	var b []byte
+	switch src := src.(type) {
+	case nil:
+	case string:
+		b = []byte(src)
+	case []byte:
+		b = src
+	default:
+		return fmt.Errorf("cannot scan %T into Headers", src)
+	}
+	*h = nil
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, h)
+}
+
+// RedactHeaders returns a copy of h with the values of sensitive headers
+// masked.
+func (p *RedactionPolicy) RedactHeaders(h http.Header) Headers {
+	if len(h) == 0 {
+		return nil
+	}
+	out := make(Headers, len(h))
+	for name, values := range h {
+		if p.isSensitiveHeader(name) {
+			out[name] = []string{p.Mask}
+			continue
+		}
+		out[name] = append([]string(nil), values...)
+	}
+	return out
+}
+
+func (p *RedactionPolicy) isSensitiveHeader(name string) bool {
+	for _, h := range p.Headers {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy returns the policy e is recorded under.
+func (e *Event) Policy() RoutePolicy {
+	if e.policy == nil {
+		return RoutePolicy{}
+	}
+	return *e.policy
+}
+
+// DescribeHeaders records the redacted request and response headers in e if
+// its policy asks for them.
+func DescribeHeaders(e *Event, request, response http.Header) {
+	p := e.Policy()
+	if p.Verbosity < VerbosityHeaders {
+		return
+	}
+	redaction := p.CaptureSettings().Policy
+	e.RequestHeaders = redaction.RedactHeaders(request)
+	e.ResponseHeaders = redaction.RedactHeaders(response)
+}
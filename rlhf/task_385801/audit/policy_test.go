@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echo answers with its request body, or 403 for paths under /admin.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/admin") {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, r.Body)
+})
+
+func TestPolicyFor(t *testing.T) {
+	l := &Logger{Paths: []PathPolicy{
+		{Prefix: "/api", RoutePolicy: RoutePolicy{Verbosity: VerbosityHeaders}},
+		{Prefix: "/api/login", RoutePolicy: RoutePolicy{Verbosity: VerbosityBodies}},
+		{Prefix: "/healthz", RoutePolicy: RoutePolicy{Exclude: true}},
+	}}
+	tests := []struct {
+		path string
+		want RoutePolicy
+	}{
+		{"/api/items", RoutePolicy{Verbosity: VerbosityHeaders}},
+		{"/api/login", RoutePolicy{Verbosity: VerbosityBodies}},
+		{"/healthz", RoutePolicy{Exclude: true}},
+		{"/", RoutePolicy{}},
+	}
+	for _, tt := range tests {
+		if got := l.PolicyFor(tt.path); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestExcludedRoutesRecordNothing(t *testing.T) {
+	sink := &recordingSink{}
+	l := &Logger{Sink: sink, Paths: []PathPolicy{{Prefix: "/healthz", RoutePolicy: RoutePolicy{Exclude: true}}}}
+	h := l.Handler(echo)
+
+	for _, path := range []string{"/healthz", "/healthz/ready"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if len(sink.events) != 0 {
+		t.Fatalf("got %d events for excluded routes, want 0", len(sink.events))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items", nil))
+	if e := sink.only(t); e.Path != "/items" {
+		t.Errorf("got %s, want /items", e.Path)
+	}
+}
+
+func TestSamplingFollowsRate(t *testing.T) {
+	sink := &recordingSink{}
+	l := &Logger{
+		Sink:  sink,
+		Paths: []PathPolicy{{Prefix: "/", RoutePolicy: RoutePolicy{Sample: 0.25}}},
+		Rand:  rand.New(rand.NewSource(1)).Float64,
+	}
+	h := l.Handler(echo)
+
+	for i := 0; i < 1000; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items", nil))
+	}
+	if n := len(sink.events); n < 200 || n > 300 {
+		t.Errorf("got %d of 1000 requests recorded, want about 250", n)
+	}
+	for _, e := range sink.events {
+		if e.SampleRate != 0.25 {
+			t.Fatalf("got sample rate %v, want 0.25", e.SampleRate)
+		}
+	}
+}
+
+func TestSamplingKeepsRefusedRequests(t *testing.T) {
+	sink := &recordingSink{}
+	l := &Logger{
+		Sink:  sink,
+		Paths: []PathPolicy{{Prefix: "/", RoutePolicy: RoutePolicy{Sample: 0.5}}},
+		Rand:  func() float64 { return 0.99 }, // Drops every allowed request
+	}
+	h := l.Handler(echo)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items", nil))
+	if len(sink.events) != 0 {
+		t.Fatalf("got %d events, want the allowed request sampled out", len(sink.events))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin", nil))
+	if e := sink.only(t); e.Outcome != OutcomeForbidden {
+		t.Errorf("got outcome %q, want %q", e.Outcome, OutcomeForbidden)
+	}
+}
+
+func TestRouteVerbosity(t *testing.T) {
+	tests := []struct {
+		verbosity     Verbosity
+		headers, body bool
+	}{
+		{VerbosityMetadata, false, false},
+		{VerbosityHeaders, true, false},
+		{VerbosityBodies, true, true},
+	}
+	for _, tt := range tests {
+		sink := &recordingSink{}
+		l := &Logger{Sink: sink, Paths: []PathPolicy{{Prefix: "/login", RoutePolicy: RoutePolicy{Verbosity: tt.verbosity}}}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"alice","password":"hunter2"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		l.Handler(echo).ServeHTTP(httptest.NewRecorder(), req)
+
+		e := sink.only(t)
+		if got := e.RequestHeaders != nil; got != tt.headers {
+			t.Errorf("verbosity %d: got request headers %v, want recorded %v", tt.verbosity, e.RequestHeaders, tt.headers)
+		}
+		if tt.headers && e.RequestHeaders["Authorization"][0] != DefaultRedactionPolicy.Mask {
+			t.Errorf("verbosity %d: got Authorization %v, want it masked", tt.verbosity, e.RequestHeaders["Authorization"])
+		}
+		if got := e.RequestBody != ""; got != tt.body {
+			t.Errorf("verbosity %d: got request body %q, want recorded %v", tt.verbosity, e.RequestBody, tt.body)
+		}
+		if strings.Contains(e.RequestBody+e.ResponseBody, "hunter2") {
+			t.Errorf("verbosity %d: the password was recorded", tt.verbosity)
+		}
+	}
+}
+
+func TestPolicyMiddlewareOverridesPath(t *testing.T) {
+	sink := &recordingSink{}
+	l := &Logger{Sink: sink, Paths: []PathPolicy{{Prefix: "/", RoutePolicy: RoutePolicy{Exclude: true}}}}
+	h := l.Handler(Policy(RoutePolicy{Verbosity: VerbosityBodies})(echo))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/items", strings.NewReader(`{"n":1}`)))
+	if e := sink.only(t); e.ResponseBody != `{"n":1}` {
+		t.Errorf("got response body %q, want it recorded", e.ResponseBody)
+	}
+}
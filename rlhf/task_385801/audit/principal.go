@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Authentication methods recorded in a Principal.
+const (
+	AuthPassword     = "password"
+	AuthJWT          = "jwt"
+	AuthRefreshToken = "refresh_token"
+	AuthBearer       = "bearer" // An opaque bearer token
+	AuthClientCert   = "client_cert"
+	AuthAPIKey       = "api_key"
+	AuthTOTP         = "totp"          // A password followed by a TOTP code
+	AuthRecoveryCode = "recovery_code" // A password followed by a recovery code
+	AuthOIDC         = "oidc"          // An ID token from an OpenID provider
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	ID         string   `json:"id"`
+	Username   string   `json:"username,omitempty"`
+	Roles      []string `json:"roles,omitempty"`
+	AuthMethod string   `json:"auth_method,omitempty"`
+	TokenID    string   `json:"token_id,omitempty"` // ID of the token presented, such as a JWT's jti
+
+	// Claims holds the token's claims as decoded from JSON, so numbers are
+	// float64. Secrets must not be included; they are written to the
+	// audit log.
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+type principalKey struct{}
+
+// WithPrincipal records the authenticated caller. It updates the event in
+// flight, if any, and returns a context from which PrincipalFrom and later
+// events pick the caller up.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	if e, ok := ctx.Value(eventKey{}).(*Event); ok {
+		e.setPrincipal(p)
+	}
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the caller recorded in ctx, if any.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+func (e *Event) setPrincipal(p *Principal) {
+	e.UserID, e.Username, e.Principal = p.ID, p.Username, p
+}
+
+// HasRole reports whether the principal has role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// StringClaim returns the named claim if it is a string.
+func (p *Principal) StringClaim(name string) (string, bool) {
+	s, ok := p.Claims[name].(string)
+	return s, ok
+}
+
+// TimeClaim returns the named claim if it is a JWT NumericDate.
+func (p *Principal) TimeClaim(name string) (time.Time, bool) {
+	n, ok := p.Claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(n*float64(time.Second))), true
+}
+
+// ClaimsOf returns v, typically a JWT claims struct, decoded as JSON into a
+// map for Principal.Claims. Named fields are left out.
+func ClaimsOf(v interface{}, omit ...string) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	for _, name := range omit {
+		delete(claims, name)
+	}
+	return claims, nil
+}
+
+// Value implements driver.Valuer, storing the principal as JSON.
+func (p Principal) Value() (driver.Value, error) {
+	b, err := json.Marshal(p)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner.
+func (p *Principal) Scan(src interface{}) error {
+	var b []byte
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case string:
+		b = []byte(src)
+	case []byte:
+		b = src
+	default:
+		return fmt.Errorf("cannot scan %T into Principal", src)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, p)
+}
@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPrincipalFromEmptyContext(t *testing.T) {
+	if p, ok := PrincipalFrom(context.Background()); ok || p != nil {
+		t.Errorf("got %+v, want no principal", p)
+	}
+	ctx := context.WithValue(context.Background(), principalKey{}, (*Principal)(nil))
+	if _, ok := PrincipalFrom(ctx); ok {
+		t.Error("got a nil principal")
+	}
+
+	// An event begun without a caller stays anonymous
+	_, e := Begin(context.Background())
+	if e.UserID != "" || e.Principal != nil {
+		t.Errorf("got user %q and principal %+v, want neither", e.UserID, e.Principal)
+	}
+}
+
+func TestWithPrincipal(t *testing.T) {
+	p := &Principal{ID: "42", Username: "alice", Roles: []string{"admin"}, AuthMethod: AuthJWT}
+	ctx, e := Begin(context.Background())
+	ctx = WithPrincipal(ctx, p)
+	if e.UserID != "42" || e.Username != "alice" || e.Principal != p {
+		t.Errorf("got event user %q (%q), principal %+v", e.UserID, e.Username, e.Principal)
+	}
+	if got, ok := PrincipalFrom(ctx); !ok || got != p {
+		t.Errorf("got %+v, want the principal set", got)
+	}
+
+	// Events begun later pick the caller up from the context
+	if _, next := Begin(ctx); next.Principal != p {
+		t.Errorf("got principal %+v in a later event", next.Principal)
+	}
+}
+
+func TestClaimsOf(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	claims, err := ClaimsOf(struct {
+		Subject   string   `json:"sub"`
+		ExpiresAt int64    `json:"exp"`
+		AMR       []string `json:"amr"`
+		CSRF      string   `json:"csrf"`
+	}{"42", exp.Unix(), []string{"pwd"}, "secret"}, "csrf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"sub": "42", "exp": float64(exp.Unix()), "amr": []interface{}{"pwd"}}
+	if !reflect.DeepEqual(claims, want) {
+		t.Errorf("got %v, want %v", claims, want)
+	}
+
+	p := &Principal{Claims: claims}
+	if sub, ok := p.StringClaim("sub"); !ok || sub != "42" {
+		t.Errorf("sub: got %q, %v", sub, ok)
+	}
+	if got, ok := p.TimeClaim("exp"); !ok || !got.Equal(exp) {
+		t.Errorf("exp: got %v, %v; want %v", got, ok, exp)
+	}
+	if _, ok := p.StringClaim("exp"); ok {
+		t.Error("exp: got a string claim")
+	}
+	if _, ok := (&Principal{}).TimeClaim("exp"); ok {
+		t.Error("got a time claim from a principal without claims")
+	}
+
+	for _, v := range []interface{}{make(chan int), "not an object"} {
+		if _, err := ClaimsOf(v); err == nil {
+			t.Errorf("%T: got no error", v)
+		}
+	}
+}
+
+func TestPrincipalValue(t *testing.T) {
+	p := Principal{ID: "42", Username: "alice", Roles: []string{"admin"}, AuthMethod: AuthAPIKey, Claims: map[string]interface{}{"scope": "read"}}
+	v, err := p.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Principal
+	if err := got.Scan(v); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("got %+v, want %+v", got, p)
+	}
+	if err := got.Scan(42); err == nil {
+		t.Error("int: got no error")
+	}
+}
@@ -0,0 +1,274 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Query filters stored audit entries. Zero values match everything.
+type Query struct {
+	UserID     string
+	PathPrefix string
+	Method     string
+	StatusMin  int
+	StatusMax  int
+	RemoteIP   string
+	Outcome    string
+	Rule       string
+	Target     string
+	Since      time.Time // Inclusive
+	Until      time.Time // Exclusive
+	Cursor     uint      // Only return entries older than this one
+	Limit      int
+
+	// InArchive continues a query in the archives once the database has no
+	// more matches, from below ArchiveSeq if it is set.
+	InArchive  bool
+	ArchiveSeq uint64
+}
+
+// Page is one page of query results, newest first.
+type Page struct {
+	Entries    []Event `json:"entries"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// ParseQuery builds a Query from the request's query string.
+func ParseQuery(v url.Values) (*Query, error) {
+	q := &Query{
+		UserID:     v.Get("user_id"),
+		PathPrefix: v.Get("path_prefix"),
+		Method:     strings.ToUpper(v.Get("method")),
+		RemoteIP:   v.Get("remote_ip"),
+		Outcome:    v.Get("outcome"),
+		Rule:       v.Get("rule"),
+		Target:     v.Get("target"),
+		Limit:      defaultPageSize,
+	}
+
+	var err error
+	if q.StatusMin, err = parseIntParam(v, "status_min"); err != nil {
+		return nil, err
+	}
+	if q.StatusMax, err = parseIntParam(v, "status_max"); err != nil {
+		return nil, err
+	}
+	if q.StatusMin != 0 && q.StatusMax != 0 && q.StatusMin > q.StatusMax {
+		return nil, fmt.Errorf("status_min must not exceed status_max")
+	}
+	if q.Since, err = parseTimeParam(v, "since"); err != nil {
+		return nil, err
+	}
+	if q.Until, err = parseTimeParam(v, "until"); err != nil {
+		return nil, err
+	}
+
+	if s := v.Get("cursor"); strings.HasPrefix(s, "a") {
+		q.InArchive = true
+		if s != "a" {
+			if q.ArchiveSeq, err = strconv.ParseUint(s[1:], 10, 64); err != nil || q.ArchiveSeq == 0 {
+				return nil, fmt.Errorf("invalid cursor")
+			}
+		}
+	} else if s != "" {
+		cursor, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || cursor == 0 {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		q.Cursor = uint(cursor)
+	}
+
+	limit, err := parseIntParam(v, "limit")
+	if err != nil {
+		return nil, err
+	}
+	if limit < 0 || limit > maxPageSize {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	if limit > 0 {
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+func parseIntParam(v url.Values, name string) (int, error) {
+	s := v.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return n, nil
+}
+
+func parseTimeParam(v url.Values, name string) (time.Time, error) {
+	s := v.Get(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: expected RFC 3339 time", name)
+	}
+	return t, nil
+}
+
+// likeEscaper escapes LIKE wildcards so a path prefix matches literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// scope applies the query's filters to db.
+func (q *Query) scope(db *gorm.DB) *gorm.DB {
+	if q.UserID != "" {
+		db = db.Where("user_id = ?", q.UserID)
+	}
+	if q.PathPrefix != "" {
+		db = db.Where(`path LIKE ? ESCAPE '\'`, likeEscaper.Replace(q.PathPrefix)+"%")
+	}
+	if q.Method != "" {
+		db = db.Where("method = ?", q.Method)
+	}
+	if q.StatusMin != 0 {
+		db = db.Where("status >= ?", q.StatusMin)
+	}
+	if q.StatusMax != 0 {
+		db = db.Where("status <= ?", q.StatusMax)
+	}
+	if q.RemoteIP != "" {
+		db = db.Where("remote_ip = ?", q.RemoteIP)
+	}
+	if q.Outcome != "" {
+		db = db.Where("outcome = ?", q.Outcome)
+	}
+	if q.Rule != "" {
+		db = db.Where("rule = ?", q.Rule)
+	}
+	if q.Target != "" {
+		db = db.Where("target = ?", q.Target)
+	}
+	if !q.Since.IsZero() {
+		db = db.Where("timestamp >= ?", q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		db = db.Where("timestamp < ?", q.Until.UTC())
+	}
+	if q.Cursor != 0 {
+		db = db.Where("id < ?", q.Cursor)
+	}
+	return db
+}
+
+// matches reports whether e passes the query's filters, as scope does in the
+// database.
+func (q *Query) matches(e *Event) bool {
+	switch {
+	case q.UserID != "" && e.UserID != q.UserID,
+		q.PathPrefix != "" && !strings.HasPrefix(e.Path, q.PathPrefix),
+		q.Method != "" && e.Method != q.Method,
+		q.StatusMin != 0 && e.Status < q.StatusMin,
+		q.StatusMax != 0 && e.Status > q.StatusMax,
+		q.RemoteIP != "" && e.RemoteIP != q.RemoteIP,
+		q.Outcome != "" && e.Outcome != q.Outcome,
+		q.Rule != "" && e.Rule != q.Rule,
+		q.Target != "" && e.Target != q.Target,
+		!q.Since.IsZero() && e.Timestamp.Before(q.Since),
+		!q.Until.IsZero() && !e.Timestamp.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// QueryEvents returns the page of entries matching q, newest first.
+func QueryEvents(db *gorm.DB, q *Query) (*Page, error) {
+	// Fetch one extra row to learn whether there is another page
+	var entries []Event
+	err := q.scope(db.Model(&Event{})).Order("id desc").Limit(q.Limit + 1).Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{Entries: entries}
+	if len(entries) > q.Limit {
+		page.Entries = entries[:q.Limit]
+		page.NextCursor = strconv.FormatUint(uint64(page.Entries[q.Limit-1].ID), 10)
+	}
+	if page.Entries == nil {
+		page.Entries = []Event{}
+	}
+	return page, nil
+}
+
+// QueryArchived returns the page of entries matching q, newest first, from
+// the database and then from the archives listed in the index at indexPath.
+// Archived pages have cursors starting with "a".
+func QueryArchived(db *gorm.DB, indexPath string, q *Query) (*Page, error) {
+	page := &Page{Entries: []Event{}}
+	if !q.InArchive {
+		var err error
+		if page, err = QueryEvents(db, q); err != nil || page.NextCursor != "" {
+			return page, err
+		}
+	}
+
+	idx, err := LoadArchiveIndex(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	archived, more, err := idx.search(q, q.Limit-len(page.Entries))
+	if err != nil {
+		return nil, err
+	}
+	page.Entries = append(page.Entries, archived...)
+	if more {
+		page.NextCursor = "a"
+		if len(archived) > 0 {
+			page.NextCursor += strconv.FormatUint(archived[len(archived)-1].Seq, 10)
+		}
+	}
+	return page, nil
+}
+
+// QueryHandler serves GET /audit. If indexPath is not empty, queries go on
+// to search the archives it lists.
+func QueryHandler(db *gorm.DB, indexPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := ParseQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var page *Page
+		switch {
+		case q.InArchive && indexPath == "":
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		case indexPath != "":
+			page, err = QueryArchived(db, indexPath, q)
+		default:
+			page, err = QueryEvents(db, q)
+		}
+		if err != nil {
+			log.Printf("Error querying audit logs: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
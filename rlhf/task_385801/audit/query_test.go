@@ -0,0 +1,331 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    Query
+		wantErr bool
+	}{
+		{query: "", want: Query{Limit: defaultPageSize}},
+		{
+			query: "user_id=u1&path_prefix=/api&method=post&status_min=400&status_max=499&limit=10",
+			want:  Query{UserID: "u1", PathPrefix: "/api", Method: "POST", StatusMin: 400, StatusMax: 499, Limit: 10},
+		},
+		{query: "cursor=42", want: Query{Cursor: 42, Limit: defaultPageSize}},
+		{query: "cursor=a", want: Query{InArchive: true, Limit: defaultPageSize}},
+		{query: "cursor=a17", want: Query{InArchive: true, ArchiveSeq: 17, Limit: defaultPageSize}},
+		{query: "cursor=0", wantErr: true},
+		{query: "cursor=-1", wantErr: true},
+		{query: "cursor=abc", wantErr: true},
+		{query: "cursor=a0", wantErr: true},
+		{query: "limit=0", want: Query{Limit: defaultPageSize}},
+		{query: "limit=-1", wantErr: true},
+		{query: "limit=501", wantErr: true},
+		{query: "limit=ten", wantErr: true},
+		{query: "status_min=500&status_max=400", wantErr: true},
+		{query: "since=yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		v, _ := url.ParseQuery(tt.query)
+		q, err := ParseQuery(v)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseQuery(%q) succeeded, want an error", tt.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.query, err)
+			continue
+		}
+		if *q != tt.want {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", tt.query, *q, tt.want)
+		}
+	}
+}
+
+func TestParseQueryTimes(t *testing.T) {
+	v := url.Values{"since": {"2024-01-02T03:04:05Z"}, "until": {"2024-01-03T00:00:00+01:00"}}
+	q, err := ParseQuery(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); !q.Since.Equal(want) {
+		t.Errorf("since = %v, want %v", q.Since, want)
+	}
+	if want := time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC); !q.Until.Equal(want) {
+		t.Errorf("until = %v, want %v", q.Until, want)
+	}
+}
+
+// openTestDB returns a database holding the given entries, chained in order.
+func openTestDB(t *testing.T, entries []Event) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, err := NewGormSink(db, BatchOptions{BatchSize: len(entries) + 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		if err := s.Write(&entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testEntries returns n entries a minute apart, alternating between two
+// users, with paths /items/0 to /items/n-1.
+func testEntries(n int) []Event {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := make([]Event, n)
+	for i := range entries {
+		entries[i] = Event{
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			UserID:    []string{"alice", "bob"}[i%2],
+			Method:    "GET",
+			Path:      "/items/" + string(rune('a'+i)),
+			Status:    200,
+		}
+	}
+	return entries
+}
+
+func paths(entries []Event) []string {
+	p := make([]string, len(entries))
+	for i, e := range entries {
+		p[i] = e.Path
+	}
+	return p
+}
+
+func TestQueryEventsPaginates(t *testing.T) {
+	db := openTestDB(t, testEntries(7))
+
+	var got []string
+	q := &Query{UserID: "alice", Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		page, err := QueryEvents(db, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, paths(page.Entries)...)
+		if page.NextCursor == "" {
+			break
+		}
+		v, _ := url.ParseQuery("cursor=" + page.NextCursor)
+		next, err := ParseQuery(v)
+		if err != nil {
+			t.Fatalf("cursor %q: %v", page.NextCursor, err)
+		}
+		q.Cursor = next.Cursor
+	}
+
+	want := []string{"/items/g", "/items/e", "/items/c", "/items/a"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestQueryEventsFilters(t *testing.T) {
+	entries := testEntries(4)
+	entries[1].Status, entries[1].Outcome = 403, OutcomeForbidden
+	entries[2].Path = "/items_x"
+	db := openTestDB(t, entries)
+	since := entries[1].Timestamp
+
+	tests := []struct {
+		q    Query
+		want int
+	}{
+		{Query{}, 4},
+		{Query{StatusMin: 400}, 1},
+		{Query{Outcome: OutcomeForbidden}, 1},
+		{Query{PathPrefix: "/items/"}, 3},
+		// "_" is not a wildcard
+		{Query{PathPrefix: "/items_"}, 1},
+		{Query{Since: since}, 3},
+		{Query{Since: since, Until: since.Add(time.Minute)}, 1},
+	}
+	for _, tt := range tests {
+		tt.q.Limit = 10
+		page, err := QueryEvents(db, &tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Entries) != tt.want {
+			t.Errorf("%+v: got %d entries, want %d", tt.q, len(page.Entries), tt.want)
+		}
+		for _, e := range page.Entries {
+			if !tt.q.matches(&e) {
+				t.Errorf("%+v: matches disagrees with the database on %s", tt.q, e.Path)
+			}
+		}
+	}
+}
+
+func TestQueryHandler(t *testing.T) {
+	db := openTestDB(t, testEntries(3))
+	handler := QueryHandler(db, "")
+
+	for _, tt := range []struct {
+		query  string
+		status int
+	}{
+		{"limit=2", http.StatusOK},
+		{"limit=1000", http.StatusBadRequest},
+		// Archive cursors need an archive index
+		{"cursor=a", http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/audit?"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.query, rec.Code, tt.status)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/audit?limit=2", nil))
+	var page Page
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 2 || page.NextCursor == "" {
+		t.Errorf("got %d entries and cursor %q, want 2 and a cursor", len(page.Entries), page.NextCursor)
+	}
+}
+
+// archivedTestDB returns a database holding testEntries(n) and the index of
+// an archive into which all but the last keep entries were moved.
+func archivedTestDB(t *testing.T, n, keep int) (*gorm.DB, string) {
+	t.Helper()
+	entries := testEntries(n)
+	db := openTestDB(t, entries)
+	opts := RetentionOptions{MaxAge: time.Hour, ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+	now := entries[n-keep].Timestamp.Add(opts.MaxAge)
+	if removed, err := PruneEvents(db, opts, now); err != nil || removed != n-keep {
+		t.Fatalf("archived %d entries (%v), want %d", removed, err, n-keep)
+	}
+	return db, ArchiveIndexPath(opts.ArchiveDir)
+}
+
+// queryAll follows cursors from the query string through every page and
+// returns the paths found and the cursors handed out.
+func queryAll(t *testing.T, handler http.HandlerFunc, query string) (got, cursors []string) {
+	t.Helper()
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("too many pages")
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/audit?"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", query, rec.Code, rec.Body)
+		}
+		var page Page
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, paths(page.Entries)...)
+		if page.NextCursor == "" {
+			return got, cursors
+		}
+		cursors = append(cursors, page.NextCursor)
+		v, _ := url.ParseQuery(query)
+		v.Set("cursor", page.NextCursor)
+		query = v.Encode()
+	}
+}
+
+func TestQueryArchivedPaginatesIntoArchives(t *testing.T) {
+	db, index := archivedTestDB(t, 7, 3)
+	handler := QueryHandler(db, index)
+
+	tests := []struct {
+		query   string
+		want    []string
+		cursors []string
+	}{
+		{
+			// The second page ends in the archive, and later pages stay there
+			query:   "limit=2",
+			want:    []string{"/items/g", "/items/f", "/items/e", "/items/d", "/items/c", "/items/b", "/items/a"},
+			cursors: []string{"6", "a4", "a2"},
+		},
+		{
+			// The database runs out on a full page, so the archive is
+			// searched from its newest entry
+			query:   "limit=3",
+			want:    []string{"/items/g", "/items/f", "/items/e", "/items/d", "/items/c", "/items/b", "/items/a"},
+			cursors: []string{"a", "a2"},
+		},
+		{
+			query:   "user_id=alice&limit=3",
+			want:    []string{"/items/g", "/items/e", "/items/c", "/items/a"},
+			cursors: []string{"a3"},
+		},
+		{
+			query: "since=2024-01-01T00:02:00Z&until=2024-01-01T00:05:00Z",
+			want:  []string{"/items/e", "/items/d", "/items/c"},
+		},
+	}
+	for _, tt := range tests {
+		got, cursors := queryAll(t, handler, tt.query)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: got %v, want %v", tt.query, got, tt.want)
+		}
+		if strings.Join(cursors, " ") != strings.Join(tt.cursors, " ") {
+			t.Errorf("%s: got cursors %v, want %v", tt.query, cursors, tt.cursors)
+		}
+	}
+}
+
+func TestQueryArchivedCursorSkipsNewerEntries(t *testing.T) {
+	db, index := archivedTestDB(t, 7, 3)
+	handler := QueryHandler(db, index)
+
+	// An archive cursor never returns to the database
+	got, _ := queryAll(t, handler, "cursor=a")
+	if want := "/items/d /items/c /items/b /items/a"; strings.Join(got, " ") != want {
+		t.Errorf("cursor=a: got %v, want %s", got, want)
+	}
+	got, _ = queryAll(t, handler, "cursor=a3")
+	if want := "/items/b /items/a"; strings.Join(got, " ") != want {
+		t.Errorf("cursor=a3: got %v, want %s", got, want)
+	}
+	for _, query := range []string{"cursor=a0", "cursor=a-1", "cursor=ab"} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/audit?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, rec.Code)
+		}
+	}
+}
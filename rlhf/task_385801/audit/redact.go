@@ -0,0 +1,219 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// RedactionPolicy decides which parts of a captured body are masked before
+// it is written to the audit log.
+type RedactionPolicy struct {
+	Fields          []string // JSON and form field names to mask, case-insensitive
+	Headers         []string // Header names whose values are masked, case-insensitive
+	MaskCardNumbers bool     // Mask anything that looks like a payment card number
+	Mask            string   // Replacement for masked values
+
+	once          sync.Once
+	textPatterns  []*regexp.Regexp // "field": value pairs in unparsed JSON
+	queryPatterns []*regexp.Regexp // field=value pairs in unparsed form data
+}
+
+// DefaultRedactionPolicy masks credentials, tokens, cookies and card data.
+var DefaultRedactionPolicy = &RedactionPolicy{
+	Fields: []string{
+		"password", "new_password", "old_password",
+		"token", "access_token", "refresh_token", "id_token",
+		"secret", "client_secret", "api_key", "authorization",
+		"mfa_token", "otp", "otpauth_uri", "recovery_code", "recovery_codes",
+		"card_number", "cvv", "cvc",
+	},
+	Headers: []string{
+		"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+		"X-CSRF-Token", "X-API-Key",
+	},
+	MaskCardNumbers: true,
+	Mask:            "[REDACTED]",
+}
+
+// cardNumberPattern matches 13 to 19 digits, optionally separated by spaces
+// or dashes. Matches are only masked if they pass the Luhn check.
+var cardNumberPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+
+func (p *RedactionPolicy) isSensitive(field string) bool {
+	for _, f := range p.Fields {
+		if strings.EqualFold(f, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact returns a printable, masked copy of body. Bodies that are cut short
+// or not JSON or form data fall back to pattern matching on the raw text.
+func (p *RedactionPolicy) Redact(body []byte, contentType string) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if !utf8.Valid(body) {
+		return "[non-UTF-8 body omitted]"
+	}
+
+	// Clients often mislabel JSON, so anything that looks like it is parsed
+	// as JSON regardless of the declared type
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	trimmed := bytes.TrimSpace(body)
+	looksJSON := len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[')
+	if looksJSON || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		if redacted, ok := p.redactJSON(body); ok {
+			return redacted
+		}
+	} else if mediaType == "application/x-www-form-urlencoded" {
+		if redacted, ok := p.redactForm(body); ok {
+			return redacted
+		}
+	}
+	return p.redactText(string(body))
+}
+
+func (p *RedactionPolicy) redactJSON(body []byte) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", false
+	}
+	b, err := json.Marshal(p.redactValue(v))
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+func (p *RedactionPolicy) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if p.isSensitive(k) {
+				v[k] = p.Mask
+			} else {
+				v[k] = p.redactValue(child)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = p.redactValue(child)
+		}
+		return v
+	case string:
+		return p.maskCards(v)
+	case json.Number:
+		if masked := p.maskCards(v.String()); masked != v.String() {
+			return masked
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func (p *RedactionPolicy) redactForm(body []byte) (string, bool) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", false
+	}
+	for k, vs := range values {
+		for i := range vs {
+			if p.isSensitive(k) {
+				vs[i] = p.Mask
+			} else {
+				vs[i] = p.maskCards(vs[i])
+			}
+		}
+	}
+	return values.Encode(), true
+}
+
+// redactText masks sensitive "field": value pairs and card numbers in text
+// that could not be parsed.
+func (p *RedactionPolicy) redactText(s string) string {
+	p.once.Do(func() {
+		for _, f := range p.Fields {
+			name := regexp.QuoteMeta(f)
+			p.textPatterns = append(p.textPatterns,
+				regexp.MustCompile(`(?i)("`+name+`"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\s]*)`))
+			p.queryPatterns = append(p.queryPatterns,
+				regexp.MustCompile(`(?i)(^|[&?])(`+name+`=)[^&]*`))
+		}
+	})
+
+	for _, re := range p.textPatterns {
+		s = re.ReplaceAllString(s, `${1}"`+p.Mask+`"`)
+	}
+	for _, re := range p.queryPatterns {
+		s = re.ReplaceAllString(s, `${1}${2}`+p.Mask)
+	}
+	return p.maskCards(s)
+}
+
+func (p *RedactionPolicy) maskCards(s string) string {
+	if !p.MaskCardNumbers {
+		return s
+	}
+	return cardNumberPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if luhnValid(m) {
+			return p.Mask
+		}
+		return m
+	})
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum.
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// cappedBuffer keeps at most max bytes of what is written to it.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := c.max - c.buf.Len(); len(p) > room {
+		c.truncated = true
+		p = p[:room]
+	}
+	c.buf.Write(p)
+	return n, nil
+}
+
+// BodyCapture enables capture of request and response bodies on a route.
+type BodyCapture struct {
+	MaxBytes int              // Bytes kept from each body; the rest is never buffered
+	Policy   *RedactionPolicy // Masking applied before the body is logged
+}
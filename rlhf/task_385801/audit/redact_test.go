@@ -0,0 +1,165 @@
+package audit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	p := DefaultRedactionPolicy
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        string
+	}{
+		{"empty", "", "application/json", ""},
+		{
+			"JSON fields",
+			`{"username":"alice","password":"hunter22"}`,
+			"application/json",
+			`{"password":"[REDACTED]","username":"alice"}`,
+		},
+		{
+			"nested and case-insensitive",
+			`{"user":{"Password":"x"},"items":[{"TOKEN":"t","id":1}]}`,
+			"application/json",
+			`{"items":[{"TOKEN":"[REDACTED]","id":1}],"user":{"Password":"[REDACTED]"}}`,
+		},
+		{
+			"mislabeled JSON",
+			`{"secret":"s"}`,
+			"text/plain",
+			`{"secret":"[REDACTED]"}`,
+		},
+		{
+			"large numbers are kept",
+			`{"amount":12345678901234567890}`,
+			"application/json",
+			`{"amount":12345678901234567890}`,
+		},
+		{
+			"card number in JSON",
+			`{"note":"card 4111 1111 1111 1111 on file"}`,
+			"application/json",
+			`{"note":"card [REDACTED] on file"}`,
+		},
+		{
+			"card number as a JSON number",
+			`{"pan":4111111111111111}`,
+			"application/json",
+			`{"pan":"[REDACTED]"}`,
+		},
+		{
+			"digits failing the Luhn check",
+			`{"order":"4111111111111112"}`,
+			"application/json",
+			`{"order":"4111111111111112"}`,
+		},
+		{
+			"form",
+			"username=alice&password=hunter22",
+			"application/x-www-form-urlencoded",
+			"password=%5BREDACTED%5D&username=alice",
+		},
+		{
+			"truncated JSON",
+			`{"username":"alice","password":"hunter22","otp":"1234`,
+			"application/json",
+			`{"username":"alice","password":"[REDACTED]","otp":"[REDACTED]"`,
+		},
+		{
+			"truncated JSON with a bare value",
+			`{"api_key": 12345, "n":`,
+			"application/json",
+			`{"api_key": "[REDACTED]", "n":`,
+		},
+		{
+			"query string in text",
+			"retry?token=abc&x=1",
+			"text/plain",
+			"retry?token=[REDACTED]&x=1",
+		},
+		{"binary", "\xff\xfe", "application/octet-stream", "[non-UTF-8 body omitted]"},
+	}
+	for _, tt := range tests {
+		if got := p.Redact([]byte(tt.body), tt.contentType); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedactWithoutCardMasking(t *testing.T) {
+	p := &RedactionPolicy{Fields: []string{"pin"}, Mask: "***"}
+	got := p.Redact([]byte(`{"pin":"1234","pan":"4111111111111111"}`), "application/json")
+	if want := `{"pan":"4111111111111111","pin":"***"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestLuhnValid(t *testing.T) {
+	for s, want := range map[string]bool{
+		"4111111111111111":    true,
+		"4111-1111-1111-1111": true,
+		"5500 0000 0000 0004": true,
+		"4111111111111112":    false,
+		"1234567890123":       false,
+	} {
+		if got := luhnValid(s); got != want {
+			t.Errorf("luhnValid(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	b := &cappedBuffer{max: 5}
+	for _, s := range []string{"abc", "defg", "h"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if b.buf.String() != "abcde" || !b.truncated {
+		t.Errorf("got %q, truncated %v; want \"abcde\", true", b.buf.String(), b.truncated)
+	}
+}
+
+func TestCaptureHandlerRecordsRedactedBodies(t *testing.T) {
+	sink := &recordingSink{}
+	capture := &BodyCapture{MaxBytes: 40, Policy: DefaultRedactionPolicy}
+	h := NewLogger(sink, nil).CaptureHandler(capture, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"abc","expires_in":300}`))
+	}))
+
+	body := `{"username":"alice","password":"hunter22","remember":true}`
+	req := httptest.NewRequest("POST", "/auth", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	e := sink.only(t)
+	if strings.Contains(e.RequestBody, "hunter22") || !e.RequestBodyTruncated {
+		t.Errorf("request body %q, truncated %v", e.RequestBody, e.RequestBodyTruncated)
+	}
+	if want := `{"access_token":"[REDACTED]","expires_in":300}`; e.ResponseBody != want || e.ResponseBodyTruncated {
+		t.Errorf("response body %q, want %q", e.ResponseBody, want)
+	}
+	if e.RequestSize != int64(len(body)) {
+		t.Errorf("request size %d, want the full %d", e.RequestSize, len(body))
+	}
+}
+
+func TestHandlerWithoutCaptureRecordsNoBodies(t *testing.T) {
+	sink := &recordingSink{}
+	h := NewLogger(sink, nil).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.Write([]byte("secret"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("password=x")))
+	if e := sink.only(t); e.RequestBody != "" || e.ResponseBody != "" {
+		t.Errorf("bodies recorded without capture: %q, %q", e.RequestBody, e.ResponseBody)
+	}
+}
@@ -0,0 +1,166 @@
+package audit
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ResponseWriterWithStatus records the status code and body size of a
+// response.
+type ResponseWriterWithStatus struct {
+	http.ResponseWriter
+	StatusCode  int
+	Bytes       int64
+	WroteHeader bool
+	Hijacked    bool
+
+	capture *cappedBuffer // Copy of the start of the body, if enabled
+}
+
+func (rw *ResponseWriterWithStatus) WriteHeader(code int) {
+	if !rw.WroteHeader {
+		rw.StatusCode = code
+		// Informational responses may be followed by the final status
+		rw.WroteHeader = code >= 200 || code == http.StatusSwitchingProtocols
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *ResponseWriterWithStatus) Write(b []byte) (int, error) {
+	rw.WroteHeader = true
+	n, err := rw.ResponseWriter.Write(b)
+	rw.Bytes += int64(n)
+	if rw.capture != nil {
+		rw.capture.Write(b[:n])
+	}
+	return n, err
+}
+
+// Flush implements http.Flusher. It is only reachable through wrapResponseWriter
+// when the underlying writer supports it.
+func (rw *ResponseWriterWithStatus) Flush() {
+	rw.WroteHeader = true
+	rw.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Hijack implements http.Hijacker. It is only reachable through
+// wrapResponseWriter when the underlying writer supports it.
+func (rw *ResponseWriterWithStatus) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := rw.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		rw.Hijacked = true
+		if !rw.WroteHeader {
+			rw.StatusCode = http.StatusSwitchingProtocols
+			rw.WroteHeader = true
+		}
+	}
+	return conn, brw, err
+}
+
+// Push implements http.Pusher. It is only reachable through wrapResponseWriter
+// when the underlying writer supports it.
+func (rw *ResponseWriterWithStatus) Push(target string, opts *http.PushOptions) error {
+	return rw.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *ResponseWriterWithStatus) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// recorder is the part of ResponseWriterWithStatus that every wrapped writer
+// exposes.
+type recorder interface {
+	http.ResponseWriter
+	Unwrap() http.ResponseWriter
+}
+
+// wrapResponseWriter wraps w for recording. The returned writer implements
+// exactly the optional interfaces that w implements, so handlers that check
+// for http.Flusher, http.Hijacker or http.Pusher behave as if unwrapped.
+func wrapResponseWriter(w http.ResponseWriter) (*ResponseWriterWithStatus, http.ResponseWriter) {
+	rw := &ResponseWriterWithStatus{
+		ResponseWriter: w,
+		StatusCode:     http.StatusOK, // Default to 200 (OK) if WriteHeader is not called
+	}
+
+	_, isFlusher := w.(http.Flusher)
+	_, isHijacker := w.(http.Hijacker)
+	_, isPusher := w.(http.Pusher)
+
+	switch {
+	case isFlusher && isHijacker && isPusher:
+		return rw, struct {
+			recorder
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{rw, rw, rw, rw}
+	case isFlusher && isHijacker:
+		return rw, struct {
+			recorder
+			http.Flusher
+			http.Hijacker
+		}{rw, rw, rw}
+	case isFlusher && isPusher:
+		return rw, struct {
+			recorder
+			http.Flusher
+			http.Pusher
+		}{rw, rw, rw}
+	case isHijacker && isPusher:
+		return rw, struct {
+			recorder
+			http.Hijacker
+			http.Pusher
+		}{rw, rw, rw}
+	case isFlusher:
+		return rw, struct {
+			recorder
+			http.Flusher
+		}{rw, rw}
+	case isHijacker:
+		return rw, struct {
+			recorder
+			http.Hijacker
+		}{rw, rw}
+	case isPusher:
+		return rw, struct {
+			recorder
+			http.Pusher
+		}{rw, rw}
+	default:
+		return rw, struct{ recorder }{rw}
+	}
+}
+
+// countingBody counts the bytes read from a request body. Only what the
+// handler reads is counted or captured.
+type countingBody struct {
+	io.ReadCloser
+	n       int64
+	capture *cappedBuffer // Copy of the start of the body, if enabled
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.capture != nil {
+		b.capture.Write(p[:n])
+	}
+	return n, err
+}
+
+// requestSize returns the size of the request body: the bytes the handler
+// read, or the declared length if it read less.
+func requestSize(r *http.Request, body *countingBody) int64 {
+	if body != nil && body.n > r.ContentLength {
+		return body.n
+	}
+	if r.ContentLength > 0 {
+		return r.ContentLength
+	}
+	return 0
+}
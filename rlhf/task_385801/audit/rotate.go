@@ -0,0 +1,269 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// rotatingWriter appends JSON lines to a file, rotating it out to an archive
+// file when it grows too large or a new day starts. Rotated files are listed
+// in an index next to the active file, and removed or moved to an archive
+// directory once they expire.
+type rotatingWriter struct {
+	path  string
+	opts  RetentionOptions
+	index *ArchiveIndex
+
+	file *os.File
+	size int64
+	cur  ArchiveFile // Entries in the active file
+}
+
+// NewRotatingFileSink returns a file sink that rotates and expires the file
+// at path according to rot. The chain continues across rotations, and
+// VerifyFile checks the rotated files along with the active one.
+func NewRotatingFileSink(path string, rot RetentionOptions, opts BatchOptions) (Sink, error) {
+	idx, err := LoadArchiveIndex(indexPathFor(path))
+	if err != nil {
+		return nil, err
+	}
+	w := &rotatingWriter{path: path, opts: rot, index: idx}
+	if err := w.scan(); err != nil {
+		return nil, err
+	}
+	if err := w.recover(); err != nil {
+		return nil, err
+	}
+
+	head, err := readChainHead(path)
+	if err != nil {
+		return nil, err
+	}
+	// A freshly rotated file continues from the newest archive
+	if archived := idx.head(); archived.Seq > head.Seq {
+		head = archived
+	}
+
+	if w.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	if err := w.expire(time.Now()); err != nil {
+		log.Printf("Error expiring audit archives: %v", err)
+	}
+	return newBatchingSink(w, head, opts), nil
+}
+
+// scan describes the entries already in the active file.
+func (w *rotatingWriter) scan() error {
+	w.cur, w.size = ArchiveFile{}, 0
+	f, err := os.Open(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return eachLine(f, func(_ int, line []byte) error {
+		w.size += int64(len(line)) + 1
+		var entry Event
+		if err := json.Unmarshal(line, &entry); err == nil {
+			w.cur.add(&entry)
+		}
+		return nil
+	})
+}
+
+// recover finishes a rotation interrupted by a crash. The index is updated
+// before the file is moved, so the newest archive may still be the active
+// file or may not have been compressed yet.
+func (w *rotatingWriter) recover() error {
+	if len(w.index.Archives) == 0 {
+		return nil
+	}
+	last := w.index.Archives[len(w.index.Archives)-1]
+	archive := w.index.resolve(last)
+	if raw := strings.TrimSuffix(archive, ".gz"); raw != archive {
+		if _, err := os.Stat(raw); err == nil {
+			if _, err := os.Stat(archive); err == nil {
+				return os.Remove(raw)
+			}
+			return compressFile(raw)
+		}
+	}
+	if w.cur.Entries == 0 || w.cur.LastSeq != last.LastSeq {
+		return nil
+	}
+	if _, err := os.Stat(archive); err == nil {
+		return nil
+	}
+	log.Printf("Finishing interrupted rotation of %s", w.path)
+	if err := w.finishRotation(archive); err != nil {
+		return err
+	}
+	return w.scan()
+}
+
+func (w *rotatingWriter) writeBatch(entries []*Event) error {
+	buf := bufio.NewWriter(w.file)
+	for _, entry := range entries {
+		if w.shouldRotate(entry) {
+			if err := w.flush(buf); err != nil {
+				return err
+			}
+			if err := w.rotate(); err != nil {
+				return err
+			}
+			buf.Reset(w.file)
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if _, err := buf.Write(line); err != nil {
+			return err
+		}
+		w.size += int64(len(line))
+		w.cur.add(entry)
+	}
+	return w.flush(buf)
+}
+
+// flush writes buffered lines, syncs the file and records the chain head.
+func (w *rotatingWriter) flush(buf *bufio.Writer) error {
+	if buf.Buffered() == 0 {
+		return nil
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return writeChainHead(w.path, chainHead{Seq: w.cur.LastSeq, Hash: w.cur.LastHash})
+}
+
+func (w *rotatingWriter) shouldRotate(next *Event) bool {
+	if w.cur.Entries == 0 {
+		return false
+	}
+	if w.opts.MaxBytes > 0 && w.size >= w.opts.MaxBytes {
+		return true
+	}
+	day := func(t time.Time) time.Time { return t.UTC().Truncate(24 * time.Hour) }
+	return w.opts.Daily && day(next.Timestamp).After(day(w.cur.To))
+}
+
+// rotate moves the active file to a new archive file and starts an empty one.
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(w.path)
+	name := strings.TrimSuffix(w.path, ext) + "-" + w.cur.From.UTC().Format(archiveTimeFormat) + ext
+	if w.opts.Compress {
+		name += ".gz"
+	}
+	name = uniquePath(name)
+
+	a := w.cur
+	a.File = w.index.relative(name)
+	w.index.add(a)
+	if err := w.index.save(); err != nil {
+		return err
+	}
+	if err := w.finishRotation(name); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w.file, w.size, w.cur = f, 0, ArchiveFile{}
+	if err := w.expire(time.Now()); err != nil {
+		log.Printf("Error expiring audit archives: %v", err)
+	}
+	return nil
+}
+
+// finishRotation moves the active file to archive, compressing it if the
+// name ends in .gz. The head file stays, as the new file continues the chain
+// from the same entry.
+func (w *rotatingWriter) finishRotation(archive string) error {
+	raw := strings.TrimSuffix(archive, ".gz")
+	if err := os.Rename(w.path, raw); err != nil {
+		return err
+	}
+	if raw != archive {
+		return compressFile(raw)
+	}
+	return nil
+}
+
+// expire deletes rotated files whose newest entry is older than MaxAge, or
+// moves them to ArchiveDir, where they stay in the index.
+func (w *rotatingWriter) expire(now time.Time) error {
+	if w.opts.MaxAge <= 0 {
+		return nil
+	}
+	cutoff := now.Add(-w.opts.MaxAge)
+	archiveDir, _ := filepath.Abs(w.opts.ArchiveDir)
+
+	kept := w.index.Archives[:0]
+	changed := false
+	var firstErr error
+	for _, a := range w.index.Archives {
+		path := w.index.resolve(a)
+		if !a.To.Before(cutoff) {
+			kept = append(kept, a)
+			continue
+		}
+		if w.opts.ArchiveDir == "" {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				kept = append(kept, a)
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			changed = true
+			continue
+		}
+
+		if abs, _ := filepath.Abs(path); filepath.Dir(abs) != archiveDir {
+			dst := uniquePath(filepath.Join(w.opts.ArchiveDir, filepath.Base(path)))
+			err := os.MkdirAll(w.opts.ArchiveDir, 0700)
+			if err == nil {
+				err = moveFile(path, dst)
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else {
+				a.File = w.index.relative(dst)
+				changed = true
+			}
+		}
+		kept = append(kept, a)
+	}
+	w.index.Archives = kept
+	if changed {
+		if err := w.index.save(); err != nil {
+			return err
+		}
+	}
+	return firstErr
+}
+
+func (w *rotatingWriter) close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,264 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite" // Used by OpenSink
+)
+
+// ErrSinkFull is returned by Write when the sink's queue is full.
+var ErrSinkFull = errors.New("audit sink queue is full")
+
+// ErrSinkClosed is returned by Write after the sink has been closed.
+var ErrSinkClosed = errors.New("audit sink is closed")
+
+// Sink is a destination for audit events. Write only queues the
+// entry; it is linked into the sink's hash chain and persisted later by a
+// background goroutine.
+type Sink interface {
+	Write(entry *Event) error
+	Close() error
+}
+
+// BatchOptions controls how a sink groups entries before flushing them.
+type BatchOptions struct {
+	BatchSize     int           // Flush once this many entries are buffered
+	FlushInterval time.Duration // Flush buffered entries at least this often
+	QueueSize     int           // Entries held in memory before Write fails
+}
+
+// DefaultBatchOptions are used by the built-in sinks unless overridden.
+var DefaultBatchOptions = BatchOptions{
+	BatchSize:     100,
+	FlushInterval: time.Second,
+	QueueSize:     1024,
+}
+
+// batchWriter persists a batch of entries in one operation.
+type batchWriter interface {
+	writeBatch(entries []*Event) error
+	close() error
+}
+
+// batchingSink queues entries, chains them and hands them to a batchWriter
+// in batches.
+type batchingSink struct {
+	w     batchWriter
+	chain *hashChain
+	opts  BatchOptions
+	queue chan *Event
+	done  chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newBatchingSink(w batchWriter, head chainHead, opts BatchOptions) *batchingSink {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchOptions.BatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultBatchOptions.FlushInterval
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultBatchOptions.QueueSize
+	}
+
+	s := &batchingSink{
+		w:     w,
+		chain: newHashChain(head),
+		opts:  opts,
+		queue: make(chan *Event, opts.QueueSize),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write queues an entry without waiting for it to be persisted.
+func (s *batchingSink) Write(entry *Event) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return ErrSinkClosed
+	}
+
+	select {
+	case s.queue <- entry:
+		return nil
+	default:
+		return ErrSinkFull
+	}
+}
+
+// Close flushes any queued entries and releases the underlying writer.
+func (s *batchingSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	<-s.done
+	return s.w.close()
+}
+
+func (s *batchingSink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Event, 0, s.opts.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.w.writeBatch(batch); err != nil {
+			log.Printf("Error writing audit batch: %v", err)
+		}
+		batch = make([]*Event, 0, s.opts.BatchSize)
+	}
+
+	for {
+		select {
+		case entry, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if err := s.chain.link(entry); err != nil {
+				log.Printf("Error chaining audit entry: %v", err)
+				continue
+			}
+			batch = append(batch, entry)
+			if len(batch) >= s.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// jsonLinesWriter writes one JSON object per line.
+type jsonLinesWriter struct {
+	w io.Writer
+}
+
+func (j *jsonLinesWriter) writeBatch(entries []*Event) error {
+	buf := bufio.NewWriter(j.w)
+	enc := json.NewEncoder(buf)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+func (j *jsonLinesWriter) close() error {
+	return nil
+}
+
+// NewStdoutSink returns a sink that writes JSON lines to standard output.
+func NewStdoutSink(opts BatchOptions) Sink {
+	return newBatchingSink(&jsonLinesWriter{w: os.Stdout}, chainHead{}, opts)
+}
+
+// NewFileSink returns a sink that appends JSON lines to the file at path. The
+// chain head is recorded next to it after every batch so VerifyFile can
+// detect truncation.
+func NewFileSink(path string, opts BatchOptions) (Sink, error) {
+	return NewRotatingFileSink(path, RetentionOptions{}, opts)
+}
+
+// gormWriter inserts entries into the audit_logs table.
+type gormWriter struct {
+	db *gorm.DB
+}
+
+func (g *gormWriter) writeBatch(entries []*Event) error {
+	tx := g.db.Begin()
+	for _, entry := range entries {
+		if err := tx.Create(entry).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// close leaves the database open; it is owned by the caller.
+func (g *gormWriter) close() error {
+	return nil
+}
+
+// NewGormSink returns a sink that stores entries in the audit_logs table of
+// db, creating the table if needed.
+func NewGormSink(db *gorm.DB, opts BatchOptions) (Sink, error) {
+	if err := db.AutoMigrate(&Event{}).Error; err != nil {
+		return nil, err
+	}
+
+	// Continue the chain from the last stored entry
+	var last Event
+	err := db.Order("seq desc").First(&last).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	head := chainHead{Seq: last.Seq, Hash: last.Hash}
+	return newBatchingSink(&gormWriter{db: db}, head, opts), nil
+}
+
+// OpenSink creates a sink by name, as selected on a command line: "stdout",
+// "file" (JSON lines at path), "sqlite" (a database at path) or "syslog"
+// (a collector URL at path; see ParseSyslogURL). Files are rotated and
+// expired according to retention, and database entries expired. The
+// returned cleanup function must be called after the sink has been closed.
+func OpenSink(kind, path string, retention RetentionOptions) (Sink, func(), error) {
+	switch kind {
+	case "stdout":
+		return NewStdoutSink(DefaultBatchOptions), func() {}, nil
+	case "file":
+		sink, err := NewRotatingFileSink(path, retention, DefaultBatchOptions)
+		return sink, func() {}, err
+	case "sqlite":
+		db, err := gorm.Open("sqlite3", path)
+		if err != nil {
+			return nil, nil, err
+		}
+		sink, err := NewGormSink(db, DefaultBatchOptions)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		stop := func() {}
+		if retention.MaxAge > 0 {
+			stop = StartRetention(db, retention, time.Hour)
+		}
+		return sink, func() { stop(); db.Close() }, nil
+	case "syslog":
+		opts, err := ParseSyslogURL(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		sink, err := NewSyslogSink(opts, DefaultBatchOptions)
+		return sink, func() {}, err
+	default:
+		return nil, nil, fmt.Errorf("unknown audit sink %q", kind)
+	}
+}
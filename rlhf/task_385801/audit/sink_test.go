@@ -0,0 +1,155 @@
+package audit
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// memoryWriter records the batches it is given. If block is set, each batch
+// waits for it to be closed.
+type memoryWriter struct {
+	mu      sync.Mutex
+	batches [][]*Event
+	block   chan struct{}
+	closed  bool
+}
+
+func (m *memoryWriter) writeBatch(entries []*Event) error {
+	if m.block != nil {
+		<-m.block
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches = append(m.batches, append([]*Event(nil), entries...))
+	return nil
+}
+
+func (m *memoryWriter) close() error {
+	m.closed = true
+	return nil
+}
+
+func (m *memoryWriter) entries() []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var all []*Event
+	for _, b := range m.batches {
+		all = append(all, b...)
+	}
+	return all
+}
+
+func TestBatchingSinkBatchesAndFlushesOnClose(t *testing.T) {
+	w := &memoryWriter{}
+	s := newBatchingSink(w, chainHead{}, BatchOptions{BatchSize: 2, FlushInterval: time.Hour, QueueSize: 10})
+	for i := 0; i < 5; i++ {
+		if err := s.Write(&Event{Path: "/", Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if !w.closed {
+		t.Error("writer not closed")
+	}
+	if len(w.batches) != 3 {
+		t.Errorf("got %d batches, want 3", len(w.batches))
+	}
+	prev := genesisHash
+	for i, e := range w.entries() {
+		if e.Seq != uint64(i+1) || e.PrevHash != prev {
+			t.Fatalf("entry %d: seq %d prev %q, want seq %d prev %q", i, e.Seq, e.PrevHash, i+1, prev)
+		}
+		prev = e.Hash
+	}
+}
+
+func TestBatchingSinkFlushesOnInterval(t *testing.T) {
+	w := &memoryWriter{}
+	s := newBatchingSink(w, chainHead{}, BatchOptions{BatchSize: 100, FlushInterval: 10 * time.Millisecond})
+	defer s.Close()
+	s.Write(&Event{Path: "/"})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(w.entries()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("entry not flushed by the interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBatchingSinkFullAndClosed(t *testing.T) {
+	w := &memoryWriter{block: make(chan struct{})}
+	s := newBatchingSink(w, chainHead{}, BatchOptions{BatchSize: 1, FlushInterval: time.Hour, QueueSize: 1})
+
+	// The writer is stuck on the first entry, so the queue fills up
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = s.Write(&Event{})
+	}
+	if err != ErrSinkFull {
+		t.Errorf("Write to a full queue: got %v, want ErrSinkFull", err)
+	}
+
+	close(w.block)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := s.Write(&Event{}); err != ErrSinkClosed {
+		t.Errorf("Write after Close: got %v, want ErrSinkClosed", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestGormSinkContinuesChain(t *testing.T) {
+	db, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for run := 0; run < 2; run++ {
+		s, err := NewGormSink(db, BatchOptions{FlushInterval: time.Hour})
+		if err != nil {
+			t.Fatalf("NewGormSink: %v", err)
+		}
+		s.Write(&Event{Path: "/a", Timestamp: time.Now()})
+		s.Write(&Event{Path: "/b", Timestamp: time.Now()})
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	var events []Event
+	if err := db.Order("seq").Find(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("got %d events, want 4", len(events))
+	}
+	prev := genesisHash
+	for i, e := range events {
+		if e.Seq != uint64(i+1) || e.PrevHash != prev {
+			t.Fatalf("event %d: seq %d prev %q, want seq %d prev %q", i, e.Seq, e.PrevHash, i+1, prev)
+		}
+		if hash, _ := hashEntry(&e); hash != e.Hash {
+			t.Errorf("event %d: stored hash does not match", i)
+		}
+		prev = e.Hash
+	}
+}
+
+func TestOpenSinkRejectsUnknownKind(t *testing.T) {
+	if _, _, err := OpenSink("kafka", "", RetentionOptions{}); err == nil {
+		t.Error("OpenSink accepted an unknown sink")
+	}
+}
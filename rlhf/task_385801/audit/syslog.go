@@ -0,0 +1,521 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syslog message formats.
+const (
+	FormatRFC5424 = "rfc5424" // Event fields as RFC 5424 structured data
+	FormatCEF     = "cef"     // ArcSight Common Event Format in the message
+)
+
+// sdID is the structured data ID of audit events. 32473 is the private
+// enterprise number reserved for documentation (RFC 5612).
+const sdID = "audit@32473"
+
+// SyslogOptions configures a syslog sink.
+type SyslogOptions struct {
+	Network   string      // "udp", "tcp" or "tls"
+	Addr      string      // Collector host:port
+	Format    string      // FormatRFC5424 or FormatCEF
+	TLSConfig *tls.Config // Used when Network is "tls"
+
+	Facility int    // Syslog facility; 13 (log audit) if zero
+	Hostname string // Defaults to the local host name
+	AppName  string // Defaults to the program name
+
+	// SpoolPath is a local file that holds messages while the collector is
+	// unreachable. They are sent before new messages once it is back. If
+	// empty, messages that cannot be sent are dropped.
+	SpoolPath     string
+	SpoolMaxBytes int64 // Messages beyond this are dropped; 64 MiB if zero
+
+	// HeadPath is a local file recording the chain head, so that seq and
+	// prevHash continue across restarts. It defaults to SpoolPath+".head".
+	// Without either, every run starts a new chain at seq 1 from the
+	// genesis hash, and a verifier must treat that as a restart.
+	HeadPath string
+
+	DialTimeout  time.Duration // 5s if zero
+	WriteTimeout time.Duration // 5s if zero
+	MaxBackoff   time.Duration // Longest wait between reconnect attempts; 30s if zero
+}
+
+// syslogWriter sends batches to a syslog collector.
+type syslogWriter struct {
+	opts SyslogOptions
+	pid  string
+
+	conn     net.Conn
+	backoff  time.Duration
+	nextDial time.Time
+	down     bool // Collector unreachable; logged once per outage
+}
+
+// NewSyslogSink returns a sink that sends entries to a syslog collector,
+// reconnecting as needed and spooling to disk while it is unreachable.
+func NewSyslogSink(opts SyslogOptions, batch BatchOptions) (Sink, error) {
+	w, head, err := newSyslogWriter(opts)
+	if err != nil {
+		return nil, err
+	}
+	return newBatchingSink(w, head, batch), nil
+}
+
+// newSyslogWriter fills in the defaults of opts and returns a writer with
+// the chain head to continue from.
+func newSyslogWriter(opts SyslogOptions) (*syslogWriter, chainHead, error) {
+	switch opts.Network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, chainHead{}, fmt.Errorf("unsupported syslog network %q", opts.Network)
+	}
+	if opts.Format == "" {
+		opts.Format = FormatRFC5424
+	}
+	if opts.Format != FormatRFC5424 && opts.Format != FormatCEF {
+		return nil, chainHead{}, fmt.Errorf("unsupported syslog format %q", opts.Format)
+	}
+	if opts.Facility == 0 {
+		opts.Facility = 13
+	}
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+	if opts.AppName == "" {
+		opts.AppName = filepath.Base(os.Args[0])
+	}
+	if opts.SpoolMaxBytes == 0 {
+		opts.SpoolMaxBytes = 64 << 20
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 5 * time.Second
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+
+	if opts.HeadPath == "" && opts.SpoolPath != "" {
+		opts.HeadPath = opts.SpoolPath + ".head"
+	}
+
+	// Continue the chain from the last run
+	var head chainHead
+	if opts.HeadPath != "" {
+		last, err := loadHead(opts.HeadPath)
+		if err != nil {
+			return nil, chainHead{}, fmt.Errorf("reading %s: %v", opts.HeadPath, err)
+		}
+		if last != nil {
+			head = *last
+		}
+	}
+
+	return &syslogWriter{opts: opts, pid: strconv.Itoa(os.Getpid())}, head, nil
+}
+
+// ParseSyslogURL returns options for a collector given as
+// network://host:port?format=cef&spool=path&head=path&ca=path, as taken
+// from a flag.
+func ParseSyslogURL(s string) (SyslogOptions, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return SyslogOptions{}, err
+	}
+	if u.Host == "" {
+		return SyslogOptions{}, fmt.Errorf("syslog URL %q has no host", s)
+	}
+	q := u.Query()
+	opts := SyslogOptions{
+		Network:   u.Scheme,
+		Addr:      u.Host,
+		Format:    q.Get("format"),
+		AppName:   q.Get("app"),
+		SpoolPath: q.Get("spool"),
+		HeadPath:  q.Get("head"),
+	}
+	if opts.Network == "tls" {
+		opts.TLSConfig = &tls.Config{ServerName: u.Hostname()}
+		if ca := q.Get("ca"); ca != "" {
+			pem, err := os.ReadFile(ca)
+			if err != nil {
+				return SyslogOptions{}, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return SyslogOptions{}, fmt.Errorf("no certificates in %s", ca)
+			}
+			opts.TLSConfig.RootCAs = pool
+		}
+	}
+	return opts, nil
+}
+
+func (s *syslogWriter) writeBatch(entries []*Event) error {
+	msgs := make([][]byte, len(entries))
+	for i, entry := range entries {
+		msgs[i] = s.format(entry)
+	}
+
+	// Record the head first: after a crash a gap in seq shows what was
+	// lost, where a reused seq would fork the chain
+	if s.opts.HeadPath != "" {
+		last := entries[len(entries)-1]
+		if err := saveHead(s.opts.HeadPath, chainHead{Seq: last.Seq, Hash: last.Hash}); err != nil {
+			log.Printf("Error recording syslog chain head: %v", err)
+		}
+	}
+
+	// Keep messages in order: nothing new is sent until the spool is empty
+	if err := s.drainSpool(); err != nil {
+		return s.spool(msgs, err)
+	}
+	for i, msg := range msgs {
+		if err := s.send(msg); err != nil {
+			return s.spool(msgs[i:], err)
+		}
+	}
+	return nil
+}
+
+func (s *syslogWriter) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// connect dials the collector unless a recent attempt failed.
+func (s *syslogWriter) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	if time.Now().Before(s.nextDial) {
+		return fmt.Errorf("waiting to reconnect to %s", s.opts.Addr)
+	}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: s.opts.DialTimeout}
+	if s.opts.Network == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.opts.Addr, s.opts.TLSConfig)
+	} else {
+		conn, err = dialer.Dial(s.opts.Network, s.opts.Addr)
+	}
+	if err != nil {
+		if s.backoff == 0 {
+			s.backoff = time.Second
+		} else if s.backoff *= 2; s.backoff > s.opts.MaxBackoff {
+			s.backoff = s.opts.MaxBackoff
+		}
+		s.nextDial = time.Now().Add(s.backoff)
+		return err
+	}
+
+	s.conn, s.backoff = conn, 0
+	if s.down {
+		log.Printf("Reconnected to syslog collector %s", s.opts.Addr)
+		s.down = false
+	}
+	return nil
+}
+
+// send writes one message, reconnecting once if the connection was lost.
+// Stream transports use octet-counting framing (RFC 6587).
+func (s *syslogWriter) send(msg []byte) error {
+	frame := msg
+	if s.opts.Network != "udp" {
+		frame = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = s.connect(); err != nil {
+			return err
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+		if _, err = s.conn.Write(frame); err == nil {
+			return nil
+		}
+		s.close()
+	}
+	return err
+}
+
+// spool stores msgs to be sent later, after sending failed with cause.
+func (s *syslogWriter) spool(msgs [][]byte, cause error) error {
+	if !s.down {
+		log.Printf("Syslog collector %s unavailable, spooling audit entries: %v", s.opts.Addr, cause)
+		s.down = true
+	}
+	if s.opts.SpoolPath == "" {
+		return fmt.Errorf("dropped %d audit entries: %v", len(msgs), cause)
+	}
+
+	f, err := os.OpenFile(s.opts.SpoolPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	buf := bufio.NewWriter(f)
+	for i, msg := range msgs {
+		frame := strconv.Itoa(len(msg)) + " "
+		size += int64(len(frame) + len(msg))
+		if size > s.opts.SpoolMaxBytes {
+			buf.Flush()
+			return fmt.Errorf("audit spool %s is full, dropped %d entries", s.opts.SpoolPath, len(msgs)-i)
+		}
+		buf.WriteString(frame)
+		buf.Write(msg)
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// drainSpool sends spooled messages. On failure the unsent ones are kept.
+func (s *syslogWriter) drainSpool() error {
+	if s.opts.SpoolPath == "" {
+		return nil
+	}
+	info, err := os.Stat(s.opts.SpoolPath)
+	if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Leave the spool alone until the collector is reachable again
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(s.opts.SpoolPath)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := readFrames(data)
+	if err != nil {
+		log.Printf("Error reading audit spool %s, keeping %d readable entries: %v", s.opts.SpoolPath, len(msgs), err)
+	}
+	for i, msg := range msgs {
+		if err := s.send(msg); err != nil {
+			// Rewrite the spool with what is left
+			if werr := os.Remove(s.opts.SpoolPath); werr != nil {
+				return werr
+			}
+			s.spool(msgs[i:], err)
+			return err
+		}
+	}
+	return os.Remove(s.opts.SpoolPath)
+}
+
+// readFrames splits octet-counted frames.
+func readFrames(data []byte) ([][]byte, error) {
+	var msgs [][]byte
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		prefix, err := r.ReadString(' ')
+		if err == io.EOF && prefix == "" {
+			return msgs, nil
+		}
+		if err != nil {
+			return msgs, errors.New("truncated frame")
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(prefix, " "))
+		if err != nil || n < 0 {
+			return msgs, fmt.Errorf("invalid frame length %q", prefix)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return msgs, errors.New("truncated frame")
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// severity returns the syslog severity for an event's outcome.
+func severity(e *Event) int {
+	switch e.Outcome {
+	case OutcomeError:
+		return 3 // Error
+	case OutcomeUnauthenticated, OutcomeForbidden:
+		return 4 // Warning
+	default:
+		return 6 // Informational
+	}
+}
+
+// format renders e as an RFC 5424 message, with the event either as
+// structured data or as a CEF record in the message body.
+func (s *syslogWriter) format(e *Event) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s audit ",
+		s.opts.Facility*8+severity(e),
+		e.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		headerField(s.opts.Hostname, 255),
+		headerField(s.opts.AppName, 48),
+		s.pid)
+
+	if s.opts.Format == FormatCEF {
+		b.WriteString("- ")
+		b.WriteString(s.cef(e))
+		return b.Bytes()
+	}
+
+	b.WriteString("[" + sdID)
+	param := func(name, value string) {
+		if value != "" {
+			b.WriteString(" " + name + `="` + sdEscaper.Replace(value) + `"`)
+		}
+	}
+	param("seq", strconv.FormatUint(e.Seq, 10))
+	param("userId", e.UserID)
+	param("username", e.Username)
+	param("method", e.Method)
+	param("path", e.Path)
+	param("remoteIp", e.RemoteIP)
+	param("userAgent", e.UserAgent)
+	param("status", strconv.Itoa(e.Status))
+	param("grpcCode", e.GRPCCode)
+	param("outcome", e.Outcome)
+	param("reason", e.Reason)
+	param("rule", e.Rule)
+	param("target", e.Target)
+	if len(e.Changes) > 0 {
+		if changes, err := json.Marshal(e.Changes); err == nil {
+			param("changes", string(changes))
+		}
+	}
+	param("durationMs", strconv.FormatFloat(e.DurationMs, 'f', 3, 64))
+	param("requestSize", strconv.FormatInt(e.RequestSize, 10))
+	param("responseSize", strconv.FormatInt(e.ResponseSize, 10))
+	param("protocol", e.Protocol)
+	param("prevHash", e.PrevHash)
+	param("hash", e.Hash)
+	b.WriteString("] ")
+	fmt.Fprintf(&b, "%s %s %d", e.Method, e.Path, e.Status)
+	return b.Bytes()
+}
+
+// sdEscaper escapes structured data parameter values (RFC 5424 6.3.3).
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// headerField makes s a valid header field: printable ASCII without spaces,
+// at most max characters, or "-" if empty.
+func headerField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	if len(s) > max {
+		s = s[:max]
+	}
+	return s
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// cefSeverity returns the CEF severity (0-10) for an event's outcome.
+func cefSeverity(e *Event) int {
+	switch e.Outcome {
+	case OutcomeError:
+		return 7
+	case OutcomeUnauthenticated, OutcomeForbidden:
+		return 5
+	default:
+		return 3
+	}
+}
+
+// cef renders e as a CEF:0 record.
+func (s *syslogWriter) cef(e *Event) string {
+	var b strings.Builder
+	outcome := e.Outcome
+	if outcome == "" {
+		outcome = OutcomeFor(e.Status)
+	}
+	fmt.Fprintf(&b, "CEF:0|audit|%s|1.0|%s|%s|%d|",
+		cefHeaderEscaper.Replace(s.opts.AppName),
+		cefHeaderEscaper.Replace(outcome),
+		cefHeaderEscaper.Replace(e.Method+" "+e.Path),
+		cefSeverity(e))
+
+	sep := ""
+	ext := func(key, value string) {
+		if value != "" {
+			b.WriteString(sep + key + "=" + cefExtensionEscaper.Replace(value))
+			sep = " "
+		}
+	}
+	ext("rt", strconv.FormatInt(e.Timestamp.UnixMilli(), 10))
+	ext("externalId", strconv.FormatUint(e.Seq, 10))
+	ext("suid", e.UserID)
+	ext("suser", e.Username)
+	ext("src", e.RemoteIP)
+	ext("requestMethod", e.Method)
+	ext("request", e.Path)
+	ext("requestClientApplication", e.UserAgent)
+	ext("app", e.Protocol)
+	ext("outcome", outcome)
+	ext("reason", e.Reason)
+	ext("in", strconv.FormatInt(e.RequestSize, 10))
+	ext("out", strconv.FormatInt(e.ResponseSize, 10))
+	ext("cn1Label", "status")
+	ext("cn1", strconv.Itoa(e.Status))
+	if e.GRPCCode != "" {
+		ext("cs1Label", "grpcCode")
+		ext("cs1", e.GRPCCode)
+	}
+	ext("cs2Label", "hash")
+	ext("cs2", e.Hash)
+	ext("cs3Label", "prevHash")
+	ext("cs3", e.PrevHash)
+	if e.Rule != "" {
+		ext("cs4Label", "rule")
+		ext("cs4", e.Rule)
+	}
+	if e.Target != "" {
+		ext("cs5Label", "target")
+		ext("cs5", e.Target)
+	}
+	return b.String()
+}
@@ -0,0 +1,273 @@
+package audit
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSyslogBatch = BatchOptions{BatchSize: 1, FlushInterval: 10 * time.Millisecond}
+
+// testEvent returns an event as recorded for a request.
+func testEvent(path string, status int) *Event {
+	return &Event{
+		Timestamp: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Method:    "GET",
+		Path:      path,
+		Status:    status,
+		Outcome:   OutcomeFor(status),
+		Username:  "alice",
+		RemoteIP:  "192.0.2.1",
+	}
+}
+
+// listenTCP returns a listener whose frames, from every connection in turn,
+// are read by calling the returned function after the writer has closed.
+func listenTCP(t *testing.T, addr string) (net.Listener, func() [][]byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan []byte)
+	go func() {
+		var all []byte
+		defer func() { received <- all }()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			data, _ := io.ReadAll(conn)
+			conn.Close()
+			all = append(all, data...)
+		}
+	}()
+	return ln, func() [][]byte {
+		ln.Close()
+		msgs, err := readFrames(<-received)
+		if err != nil {
+			t.Fatalf("reading frames: %v", err)
+		}
+		return msgs
+	}
+}
+
+func TestSyslogSinkRFC5424OverTCP(t *testing.T) {
+	ln, received := listenTCP(t, "127.0.0.1:0")
+	sink, err := NewSyslogSink(SyslogOptions{
+		Network:  "tcp",
+		Addr:     ln.Addr().String(),
+		Hostname: "host",
+		AppName:  "app",
+	}, testSyslogBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write(testEvent(`/a"b]`, 200))
+	sink.Write(testEvent("/denied", 403))
+	sink.Close()
+
+	msgs := received()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	header := regexp.MustCompile(`^<(\d+)>1 2024-05-01T12:00:00\.000000Z host app \d+ audit \[audit@32473 `)
+	for i, want := range []string{"110", "108"} {
+		m := header.FindSubmatch(msgs[i])
+		if m == nil || string(m[1]) != want {
+			t.Errorf("message %d: got %q, want PRI <%s> and an RFC 5424 header", i, msgs[i], want)
+		}
+	}
+	if !strings.Contains(string(msgs[0]), ` seq="1" `) || !strings.Contains(string(msgs[0]), ` path="/a\"b\]" `) {
+		t.Errorf("structured data not escaped or incomplete: %s", msgs[0])
+	}
+	if !strings.HasSuffix(string(msgs[1]), "] GET /denied 403") || !strings.Contains(string(msgs[1]), ` seq="2" `) {
+		t.Errorf("got %s", msgs[1])
+	}
+}
+
+func TestSyslogSinkCEFOverUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewSyslogSink(SyslogOptions{
+		Network:  "udp",
+		Addr:     conn.LocalAddr().String(),
+		Format:   FormatCEF,
+		Hostname: "host",
+		AppName:  "my|app",
+	}, testSyslogBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := testEvent("/items", 500)
+	e.Reason = "a=b"
+	sink.Write(e)
+	defer sink.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64<<10)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+
+	// A datagram holds one message without a length prefix
+	prefix := `<107>1 2024-05-01T12:00:00.000000Z host my|app `
+	cef := ` audit - CEF:0|audit|my\|app|1.0|error|GET /items|7|rt=1714564800000 externalId=1 `
+	if !strings.HasPrefix(msg, prefix) || !strings.Contains(msg, cef) {
+		t.Errorf("got %s, want a CEF record for seq 1", msg)
+	}
+	for _, ext := range []string{" suser=alice ", " src=192.0.2.1 ", ` reason=a\=b `, " cn1=500 ", " cs3=" + genesisHash} {
+		if !strings.Contains(msg, ext) {
+			t.Errorf("missing %q in %s", ext, msg)
+		}
+	}
+}
+
+// linked returns events chained from the start, as a sink would pass them.
+func linked(events ...*Event) []*Event {
+	chain := newHashChain(chainHead{})
+	for _, e := range events {
+		chain.link(e)
+	}
+	return events
+}
+
+func TestSyslogWriterSpoolsUntilCollectorReturns(t *testing.T) {
+	// Find a free port, then leave nothing listening on it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	spool := filepath.Join(t.TempDir(), "audit.spool")
+	w, _, err := newSyslogWriter(SyslogOptions{Network: "tcp", Addr: addr, SpoolPath: spool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := linked(testEvent("/1", 200), testEvent("/2", 200), testEvent("/3", 200))
+
+	if err := w.writeBatch(events[:2]); err != nil {
+		t.Fatalf("spooling: %v", err)
+	}
+	data, err := os.ReadFile(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := readFrames(data); err != nil || len(msgs) != 2 {
+		t.Fatalf("spool holds %d messages (%v), want 2", len(msgs), err)
+	}
+
+	// Once the collector is back, spooled messages go first
+	_, received := listenTCP(t, addr)
+	w.nextDial = time.Time{}
+	if err := w.writeBatch(events[2:]); err != nil {
+		t.Fatalf("replaying: %v", err)
+	}
+	w.close()
+
+	msgs := received()
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	for i, msg := range msgs {
+		if want := "GET /" + string(rune('1'+i)) + " 200"; !strings.HasSuffix(string(msg), want) {
+			t.Errorf("message %d: got %s, want it to end with %q", i, msg, want)
+		}
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("spool left behind after replay: %v", err)
+	}
+}
+
+func TestSyslogWriterDropsWithoutSpool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	w, _, err := newSyslogWriter(SyslogOptions{Network: "tcp", Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.writeBatch(linked(testEvent("/", 200))); err == nil {
+		t.Error("no error for entries that could not be sent")
+	}
+}
+
+func TestSyslogSinkContinuesChainAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	opts := SyslogOptions{Network: "tcp", SpoolPath: filepath.Join(dir, "audit.spool")}
+
+	var hashes []string
+	for run := 1; run <= 2; run++ {
+		ln, received := listenTCP(t, "127.0.0.1:0")
+		opts.Addr = ln.Addr().String()
+		sink, err := NewSyslogSink(opts, testSyslogBatch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := testEvent("/", 200)
+		sink.Write(e)
+		sink.Close()
+		received()
+
+		if e.Seq != uint64(run) {
+			t.Errorf("run %d: got seq %d, want %d", run, e.Seq, run)
+		}
+		if run > 1 && e.PrevHash != hashes[run-2] {
+			t.Errorf("run %d: prevHash does not link to the last run", run)
+		}
+		hashes = append(hashes, e.Hash)
+	}
+
+	head, err := loadHead(opts.SpoolPath + ".head")
+	if err != nil || head == nil || head.Seq != 2 || head.Hash != hashes[1] {
+		t.Errorf("got head %+v (%v), want seq 2 and the last hash", head, err)
+	}
+}
+
+func TestSyslogSinkRejectsCorruptHead(t *testing.T) {
+	head := filepath.Join(t.TempDir(), "syslog.head")
+	os.WriteFile(head, []byte("{"), 0600)
+	if _, err := NewSyslogSink(SyslogOptions{Network: "udp", Addr: "127.0.0.1:514", HeadPath: head}, testSyslogBatch); err == nil {
+		t.Error("NewSyslogSink accepted a corrupt head file")
+	}
+}
+
+func TestParseSyslogURL(t *testing.T) {
+	opts, err := ParseSyslogURL("tcp://collector:601?format=cef&app=api&spool=/var/spool/audit&head=/var/lib/audit.head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SyslogOptions{Network: "tcp", Addr: "collector:601", Format: FormatCEF, AppName: "api", SpoolPath: "/var/spool/audit", HeadPath: "/var/lib/audit.head"}
+	if opts != want {
+		t.Errorf("got %+v, want %+v", opts, want)
+	}
+
+	for _, s := range []string{"udp:///nohost", "tls://collector:6514?ca=/does/not/exist"} {
+		if _, err := ParseSyslogURL(s); err == nil {
+			t.Errorf("ParseSyslogURL(%q) succeeded, want an error", s)
+		}
+	}
+	if _, err := NewSyslogSink(SyslogOptions{Network: "unix", Addr: "x"}, testSyslogBatch); err == nil {
+		t.Error("NewSyslogSink accepted an unsupported network")
+	}
+}
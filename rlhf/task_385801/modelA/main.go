@@ -1,58 +1,84 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"audit"
+	"audit/clientip"
+	"audit/ginaudit"
 	"github.com/gin-gonic/gin"
 )
 
-type auditEntry struct {
-	Timestamp time.Time `json:"timestamp"`
-	Method    string    `json:"method"`
-	Path      string    `json:"path"`
-	IP        string    `json:"ip"`
-	User      string    `json:"user"`
-	Status    int       `json:"status"`
-}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(audit.RunVerify(os.Args[2:]))
+	}
 
-func AuditMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		start := time.Now()
-		// Process request
-		c.Next()
+	sinkKind := flag.String("audit-sink", "stdout", "Audit sink: stdout, file, sqlite or syslog")
+	sinkPath := flag.String("audit-path", "audit.log", "Audit file, SQLite database path or syslog URL such as tcp://host:601?format=cef&spool=audit.spool")
+	retention := audit.RetentionFlags(flag.CommandLine)
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose forwarding headers are trusted")
+	verbosity := flag.String("audit-verbosity", "metadata", "What audit entries record: metadata, headers or bodies")
+	flag.Parse()
 
-		user, exist := c.Get("user")
-		if !exist {
-			user = "some User"
-		}
-		entry := auditEntry{
-			Timestamp: start,
-			Method:    c.Request.Method,
-			Path:      c.Request.URL.Path,
-			IP:        c.ClientIP(),
-			User:      user.(string), // Get the user from the context
-			Status:    c.Writer.Status(),
-		}
+	resolver, err := clientip.ParseList(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Error parsing trusted proxies: %v", err)
+	}
 
-		// Write audit entry to log file or other storage
-		auditLog(entry)
+	sink, cleanup, err := audit.OpenSink(*sinkKind, *sinkPath, retention())
+	if err != nil {
+		log.Fatalf("Error opening audit sink: %v", err)
 	}
-}
 
-func auditLog(entry auditEntry) {
-	fmt.Println("Audit Log:", entry)
-	log.Printf("%s %s %s %s %s %d", entry.Timestamp.Format(time.RFC3339), entry.Method, entry.Path, entry.IP, entry.User, entry.Status)
-}
+	auditLogger := audit.NewLogger(sink, resolver)
+	defaultPolicy := audit.RoutePolicy{}
+	if defaultPolicy.Verbosity, err = audit.ParseVerbosity(*verbosity); err != nil {
+		log.Fatalf("Error parsing audit verbosity: %v", err)
+	}
+	auditLogger.Paths = []audit.PathPolicy{{Prefix: "/", RoutePolicy: defaultPolicy}}
 
-func main() {
 	router := gin.Default()
-	router.Use(AuditMiddleware())
+	router.Use(ginaudit.Middleware(auditLogger))
+
+	// Health checks are not audited
+	health := router.Group("/healthz", ginaudit.Policy(audit.RoutePolicy{Exclude: true}))
+	health.GET("", func(c *gin.Context) {
+		c.String(200, "ok")
+	})
+
 	// Initialize user authentication here
 	router.GET("/", func(c *gin.Context) {
-		c.Set("user", "testUser") // Set a test user
+		ginaudit.SetUser(c, "testUser", "testUser") // Set a test user
 		c.String(200, "Hello, World!")
 	})
-	router.Run(":8080")
+
+	srv := &http.Server{Addr: ":8080", Handler: router}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a shutdown signal so buffered audit entries can be flushed
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		log.Printf("Error closing audit sink: %v", err)
+	}
+	cleanup()
 }
@@ -1,84 +1,97 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"log"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"audit"
+	"audit/clientip"
+	"audit/muxaudit"
 	"github.com/gorilla/mux"
 )
 
-// AuditLog represents an audit log entry
-type AuditLog struct {
-	Timestamp time.Time `json:"timestamp"`
-	Method    string    `json:"method"`
-	Path      string    `json:"path"`
-	RemoteIP  string    `json:"remote_ip"`
-	UserAgent string    `json:"user_agent"`
-	Status    int       `json:"status"`
-}
+// auditLogger records every request handled by LoggingMiddleware
+var auditLogger *audit.Logger
 
-type ResponseWriterWithStatus struct {
-	http.ResponseWriter
-	StatusCode int
+// LoggingMiddleware is a middleware to log HTTP requests
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return auditLogger.Handler(next)
 }
 
-func (rw *ResponseWriterWithStatus) WriteHeader(code int) {
-	rw.StatusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+func helloWorld(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Hello, world!"))
 }
 
-// LoggingMiddleware is a middleware to log HTTP requests
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		// Wrap the ResponseWriter
-		rw := &ResponseWriterWithStatus{
-			ResponseWriter: w,
-			StatusCode:     http.StatusOK, // Default to 200 (OK) if WriteHeader is not called
-		}
+// healthz answers load balancer health checks, which are not audited
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
 
-		// Handle the request
-		next.ServeHTTP(rw, r)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(audit.RunVerify(os.Args[2:]))
+	}
 
-		// Create an audit log entry
-		logEntry := &AuditLog{
-			Timestamp: start,
-			Method:    r.Method,
-			Path:      r.URL.Path,
-			RemoteIP:  strings.SplitN(r.RemoteAddr, ":", 2)[0],
-			UserAgent: r.UserAgent(),
-			Status:    rw.StatusCode,
-		}
+	sinkKind := flag.String("audit-sink", "stdout", "Audit sink: stdout, file, sqlite or syslog")
+	sinkPath := flag.String("audit-path", "audit.log", "Audit file, SQLite database path or syslog URL such as tcp://host:601?format=cef&spool=audit.spool")
+	retention := audit.RetentionFlags(flag.CommandLine)
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose forwarding headers are trusted")
+	verbosity := flag.String("audit-verbosity", "metadata", "What audit entries record: metadata, headers or bodies")
+	flag.Parse()
 
-		// Log the audit entry
-		logAudit(logEntry)
-	})
-}
-
-func logAudit(logEntry *AuditLog) {
-	b, err := json.Marshal(logEntry)
+	resolver, err := clientip.ParseList(*trustedProxies)
 	if err != nil {
-		log.Printf("Error marshaling audit log: %v", err)
-		return
+		log.Fatalf("Error parsing trusted proxies: %v", err)
 	}
-	log.Println(string(b))
-}
 
-func helloWorld(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Hello, world!"))
-}
+	sink, cleanup, err := audit.OpenSink(*sinkKind, *sinkPath, retention())
+	if err != nil {
+		log.Fatalf("Error opening audit sink: %v", err)
+	}
+	auditLogger = audit.NewLogger(sink, resolver)
+	defaultPolicy := audit.RoutePolicy{}
+	if defaultPolicy.Verbosity, err = audit.ParseVerbosity(*verbosity); err != nil {
+		log.Fatalf("Error parsing audit verbosity: %v", err)
+	}
+	auditLogger.Paths = []audit.PathPolicy{{Prefix: "/", RoutePolicy: defaultPolicy}}
 
-func main() {
 	r := mux.NewRouter()
-	r.HandleFunc("/", helloWorld).Methods("GET")
+	r.HandleFunc("/", helloWorld).Methods("GET").Name("hello")
+	r.HandleFunc("/healthz", healthz).Methods("GET").Name("health")
+	r.Use(muxaudit.NamedRoutes(map[string]audit.RoutePolicy{
+		"health": {Exclude: true},
+	}))
 
 	// Wrap the router with the logging middleware
 	loggedRouter := LoggingMiddleware(r)
 
-	log.Fatal(http.ListenAndServe(":8080", loggedRouter))
+	srv := &http.Server{Addr: ":8080", Handler: loggedRouter}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a shutdown signal so buffered audit entries can be flushed
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		log.Printf("Error closing audit sink: %v", err)
+	}
+	cleanup()
 }
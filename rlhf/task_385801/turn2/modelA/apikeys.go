@@ -0,0 +1,473 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"audit"
+	"audit/access"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	apiKeyPrefix     = "ak_"
+	apiKeyDefaultTTL = 90 * 24 * time.Hour
+	apiKeyMaxTTL     = 365 * 24 * time.Hour
+)
+
+var (
+	// ErrInvalidAPIKey is returned for malformed, unknown or wrong keys.
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	// ErrAPIKeyExpired is returned for keys past their expiry.
+	ErrAPIKeyExpired = errors.New("API key expired")
+	// ErrAPIKeyRevoked is returned for revoked keys.
+	ErrAPIKeyRevoked = errors.New("API key revoked")
+	// ErrAPIKeyNotFound is returned when no key has the given ID.
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// APIKey is a long-lived credential for automation. Only a hash of the
+// secret is kept; the key itself is shown once, when it is created or
+// rotated. Keys act as their user, narrowed to their scopes.
+type APIKey struct {
+	ID         string     `json:"id" gorm:"primary_key"`
+	Hash       string     `json:"-"`
+	Name       string     `json:"name"`
+	UserID     string     `json:"user_id" gorm:"index"`
+	Scopes     Scopes     `json:"scopes" gorm:"type:text"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Scopes limit the requests an API key may make. Each is a path pattern in
+// the policy syntax, optionally preceded by a method, e.g. "GET /protected/**".
+type Scopes []string
+
+// Value implements driver.Valuer.
+func (s Scopes) Value() (driver.Value, error) {
+	b, err := json.Marshal([]string(s))
+	return string(b), err
+}
+
+// Scan implements sql.Scanner.
+func (s *Scopes) Scan(src interface{}) error {
+	var b []byte
+	switch src := src.(type) {
+	case nil:
+	case string:
+		b = []byte(src)
+	case []byte:
+		b = src
+	default:
+		return fmt.Errorf("cannot scan %T into Scopes", src)
+	}
+	*s = nil
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, s)
+}
+
+// splitScope returns the method and path pattern of a scope; the method is
+// empty if the scope allows any.
+func splitScope(scope string) (method, pattern string) {
+	if i := strings.IndexByte(scope, ' '); i >= 0 {
+		return strings.ToUpper(scope[:i]), strings.TrimSpace(scope[i+1:])
+	}
+	return "", scope
+}
+
+// scopeMethods are the methods a scope may be limited to.
+var scopeMethods = map[string]bool{
+	"*": true, "GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+// validate checks that every scope is well formed, with a path pattern as
+// the access policy accepts.
+func (s Scopes) validate() error {
+	if len(s) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range s {
+		method, pattern := splitScope(scope)
+		if method != "" && !scopeMethods[method] {
+			return fmt.Errorf("scope %q: invalid method %q", scope, method)
+		}
+		if err := access.ValidatePattern(pattern); err != nil {
+			return fmt.Errorf("scope %q: %v", scope, err)
+		}
+	}
+	return nil
+}
+
+// Allow reports whether any scope covers a request.
+func (s Scopes) Allow(method, urlPath string) bool {
+	for _, scope := range s {
+		m, pattern := splitScope(scope)
+		if m != "" && m != "*" && m != method {
+			continue
+		}
+		if _, ok := access.MatchPaths([]string{pattern}, urlPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyStore keeps API keys.
+type APIKeyStore struct {
+	db *gorm.DB
+}
+
+// NewAPIKeyStore returns an APIKeyStore using db, creating its table if
+// needed.
+func NewAPIKeyStore(db *gorm.DB) (*APIKeyStore, error) {
+	if err := db.AutoMigrate(&APIKey{}).Error; err != nil {
+		return nil, err
+	}
+	return &APIKeyStore{db: db}, nil
+}
+
+// newAPIKeySecret returns a key for id and the hash stored for it. The ID is
+// part of the key so that it can be looked up without scanning hashes.
+func newAPIKeySecret(id string) (key, hash string, err error) {
+	secret, err := randomID()
+	if err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + id + "_" + secret
+	return key, hashToken(key), nil
+}
+
+// Create issues a key for userID with scopes, valid for ttl. It returns the
+// stored key and the secret to hand to the caller.
+func (s *APIKeyStore) Create(userID, name string, scopes Scopes, ttl time.Duration) (*APIKey, string, error) {
+	if err := scopes.validate(); err != nil {
+		return nil, "", err
+	}
+	if ttl <= 0 || ttl > apiKeyMaxTTL {
+		return nil, "", fmt.Errorf("expiry must be between 0 and %s", apiKeyMaxTTL)
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	id := hex.EncodeToString(b)
+	secret, hash, err := newAPIKeySecret(id)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	key := &APIKey{
+		ID:        id,
+		Hash:      hash,
+		Name:      name,
+		UserID:    userID,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := s.db.Create(key).Error; err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// Find returns the key with id.
+func (s *APIKeyStore) Find(id string) (*APIKey, error) {
+	key := &APIKey{}
+	if err := s.db.Where("id = ?", id).First(key).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// List returns the keys of userID, or every key if it is empty, newest first.
+func (s *APIKeyStore) List(userID string) ([]APIKey, error) {
+	q := s.db.Order("created_at desc")
+	if userID != "" {
+		q = q.Where("user_id = ?", userID)
+	}
+	var keys []APIKey
+	err := q.Find(&keys).Error
+	return keys, err
+}
+
+// Verify returns the key secret belongs to if it is valid.
+func (s *APIKeyStore) Verify(secret string) (*APIKey, error) {
+	rest := strings.TrimPrefix(secret, apiKeyPrefix)
+	i := strings.IndexByte(rest, '_')
+	if rest == secret || i <= 0 {
+		return nil, ErrInvalidAPIKey
+	}
+	key, err := s.Find(rest[:i])
+	if err == ErrAPIKeyNotFound {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(key.Hash)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if key.RevokedAt != nil {
+		return nil, ErrAPIKeyRevoked
+	}
+	if now.After(key.ExpiresAt) {
+		return nil, ErrAPIKeyExpired
+	}
+
+	// Recording every use would write on each request
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > time.Minute {
+		if err := s.db.Model(key).Update("last_used_at", now).Error; err != nil {
+			log.Printf("Error recording use of API key %s: %v", key.ID, err)
+		}
+	}
+	return key, nil
+}
+
+// Rotate replaces the secret of key id, keeping its ID, scopes and expiry.
+// The old secret stops working at once.
+func (s *APIKeyStore) Rotate(id string) (*APIKey, string, error) {
+	key, err := s.Find(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if key.RevokedAt != nil {
+		return nil, "", ErrAPIKeyRevoked
+	}
+	secret, hash, err := newAPIKeySecret(id)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	if err := s.db.Model(key).Updates(map[string]interface{}{"hash": hash, "rotated_at": now}).Error; err != nil {
+		return nil, "", err
+	}
+	key.Hash, key.RotatedAt = hash, &now
+	return key, secret, nil
+}
+
+// Revoke disables key id. The key is kept so audit entries can be traced
+// back to it.
+func (s *APIKeyStore) Revoke(id string) (*APIKey, error) {
+	key, err := s.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt == nil {
+		now := time.Now()
+		if err := s.db.Model(key).Update("revoked_at", now).Error; err != nil {
+			return nil, err
+		}
+		key.RevokedAt = &now
+	}
+	return key, nil
+}
+
+// RevokeUser disables every key of userID.
+func (s *APIKeyStore) RevokeUser(userID string) error {
+	return s.db.Model(&APIKey{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", time.Now()).Error
+}
+
+// apiKeyStore holds API keys
+var apiKeyStore *APIKeyStore
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// apiKeyReason returns the audit reason code for a rejected API key
+func apiKeyReason(err error) string {
+	switch err {
+	case ErrAPIKeyExpired:
+		return "api_key_expired"
+	case ErrAPIKeyRevoked:
+		return "api_key_revoked"
+	}
+	return "invalid_api_key"
+}
+
+// apiKeyPrincipal returns the principal of a caller authenticated by key.
+// The key ID is recorded as the token ID.
+func apiKeyPrincipal(user *User, key *APIKey) *audit.Principal {
+	principal := principalFor(user, audit.AuthAPIKey)
+	principal.TokenID = key.ID
+	scopes := make([]interface{}, len(key.Scopes))
+	for i, scope := range key.Scopes {
+		scopes[i] = scope
+	}
+	principal.Claims = map[string]interface{}{
+		"key_name": key.Name,
+		"scope":    scopes,
+		"exp":      float64(key.ExpiresAt.Unix()),
+	}
+	return principal
+}
+
+// principalScopes returns the scopes of a caller authenticated by API key.
+// ok is false for other callers, who are not limited by scopes.
+func principalScopes(p *audit.Principal) (scopes Scopes, ok bool) {
+	if p.AuthMethod != audit.AuthAPIKey {
+		return nil, false
+	}
+	list, _ := p.Claims["scope"].([]interface{})
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, true
+}
+
+// apiKeyRequest is the body of a request to create an API key
+type apiKeyRequest struct {
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+	Name      string `json:"name"`
+	Scopes    Scopes `json:"scopes"`
+	ExpiresIn string `json:"expires_in"` // Duration such as "720h"; 90 days if empty
+}
+
+// apiKeyResponse is an API key with its secret, returned once
+type apiKeyResponse struct {
+	*APIKey
+	Key string `json:"key"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// CreateAPIKey issues an API key for a user
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var user *User
+	var err error
+	switch {
+	case req.UserID != "":
+		user, err = userStore.FindByID(req.UserID)
+	case req.Username != "":
+		user, err = userStore.FindByUsername(req.Username)
+	default:
+		http.Error(w, "user_id or username is required", http.StatusBadRequest)
+		return
+	}
+	if err == ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up user: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ttl := apiKeyDefaultTTL
+	if req.ExpiresIn != "" {
+		if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil {
+			http.Error(w, "Invalid expires_in", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if err := req.Scopes.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ttl <= 0 || ttl > apiKeyMaxTTL {
+		http.Error(w, fmt.Sprintf("expires_in must be positive and at most %s", apiKeyMaxTTL), http.StatusBadRequest)
+		return
+	}
+
+	key, secret, err := apiKeyStore.Create(user.ID, req.Name, req.Scopes, ttl)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created API key %s (%s) for user %s", key.ID, key.Name, user.ID)
+	writeJSON(w, http.StatusCreated, apiKeyResponse{key, secret})
+}
+
+// ListAPIKeys lists API keys, optionally those of one user
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := apiKeyStore.List(r.URL.Query().Get("user_id"))
+	if err != nil {
+		log.Printf("Error listing API keys: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// RotateAPIKey replaces the secret of an API key
+func RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	key, secret, err := apiKeyStore.Rotate(mux.Vars(r)["id"])
+	if !apiKeyFound(w, err) {
+		return
+	}
+	log.Printf("Rotated API key %s", key.ID)
+	writeJSON(w, http.StatusOK, apiKeyResponse{key, secret})
+}
+
+// RevokeAPIKey disables an API key
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	key, err := apiKeyStore.Revoke(mux.Vars(r)["id"])
+	if !apiKeyFound(w, err) {
+		return
+	}
+	log.Printf("Revoked API key %s", key.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiKeyFound writes the error response for err, if any
+func apiKeyFound(w http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case ErrAPIKeyNotFound:
+		http.Error(w, "API key not found", http.StatusNotFound)
+	case ErrAPIKeyRevoked:
+		http.Error(w, "API key revoked", http.StatusConflict)
+	default:
+		log.Printf("Error updating API key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScopesValidate(t *testing.T) {
+	for _, tt := range []struct {
+		scopes Scopes
+		valid  bool
+	}{
+		{Scopes{"/reports/**"}, true},
+		{Scopes{"GET /protected/users/{id}", "post /reports/*.pdf", "* /x"}, true},
+		{nil, false},
+		{Scopes{"reports/**"}, false},
+		{Scopes{"GET"}, false},
+		{Scopes{"GET /ok", "/[unterminated"}, false},
+		{Scopes{"FETCH /x"}, false},
+	} {
+		if err := tt.scopes.validate(); (err == nil) != tt.valid {
+			t.Errorf("%q: got %v, want valid %v", tt.scopes, err, tt.valid)
+		}
+	}
+}
+
+func TestScopesAllow(t *testing.T) {
+	s := Scopes{"GET /reports/**", "/protected/users/{id}"}
+	for _, tt := range []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "/reports/2024/q1", true},
+		{"POST", "/reports/2024/q1", false},
+		{"DELETE", "/protected/users/42", true},
+		{"GET", "/protected/users/42/keys", false},
+		{"GET", "/reports/../admin", false},
+	} {
+		if got := s.Allow(tt.method, tt.path); got != tt.want {
+			t.Errorf("%s %s: got %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCreateAPIKeyRejectsInvalidScopes(t *testing.T) {
+	setupTestStores(t)
+	if _, err := userStore.CreateExternal("svc", "service"); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		`{"username":"svc","name":"k","scopes":["/[x"]}`,
+		`{"username":"svc","name":"k","scopes":["GRAB /x"]}`,
+		`{"username":"svc","name":"k","scopes":[]}`,
+	} {
+		rec := httptest.NewRecorder()
+		CreateAPIKey(rec, httptest.NewRequest("POST", "/admin/api-keys", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", body, rec.Code)
+		}
+	}
+}
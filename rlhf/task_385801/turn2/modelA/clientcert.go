@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"audit"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUnmappedCert is returned when a client certificate matches no entry in
+// the certificate table.
+var ErrUnmappedCert = errors.New("client certificate is not mapped to a user")
+
+// CertTable maps client certificate identities to users. It is loaded from
+// YAML; the first entry that matches a certificate wins.
+type CertTable struct {
+	Entries []CertMapping `yaml:"certificates"`
+}
+
+// CertMapping maps certificates with one identity to a user. Exactly one of
+// the matchers must be set.
+type CertMapping struct {
+	Subject    string `yaml:"subject"`     // Full subject DN, e.g. "CN=billing,O=Example"
+	CommonName string `yaml:"common_name"` // Subject CN
+	DNS        string `yaml:"dns"`         // DNS SAN
+	URI        string `yaml:"uri"`         // URI SAN, e.g. a SPIFFE ID
+	Email      string `yaml:"email"`       // Email SAN
+	SHA256     string `yaml:"sha256"`      // Hex fingerprint of the certificate, pinning it
+
+	Username string `yaml:"username"` // User the caller acts as
+}
+
+// LoadCertTable reads and validates the certificate table at path.
+func LoadCertTable(path string) (*CertTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &CertTable{}
+	if err := yaml.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for i := range t.Entries {
+		m := &t.Entries[i]
+		set := 0
+		for _, v := range []string{m.Subject, m.CommonName, m.DNS, m.URI, m.Email, m.SHA256} {
+			if v != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("certificate entry %d: exactly one of subject, common_name, dns, uri, email or sha256 must be set", i+1)
+		}
+		if m.Username == "" {
+			return nil, fmt.Errorf("certificate entry %d: missing username", i+1)
+		}
+		m.SHA256 = strings.ToLower(strings.Replace(m.SHA256, ":", "", -1))
+	}
+	return t, nil
+}
+
+// matches reports whether cert has the identity m maps.
+func (m *CertMapping) matches(cert *x509.Certificate) bool {
+	switch {
+	case m.Subject != "":
+		return cert.Subject.String() == m.Subject
+	case m.CommonName != "":
+		return cert.Subject.CommonName == m.CommonName
+	case m.DNS != "":
+		for _, name := range cert.DNSNames {
+			if strings.EqualFold(name, m.DNS) {
+				return true
+			}
+		}
+	case m.URI != "":
+		for _, u := range cert.URIs {
+			if u.String() == m.URI {
+				return true
+			}
+		}
+	case m.Email != "":
+		for _, email := range cert.EmailAddresses {
+			if strings.EqualFold(email, m.Email) {
+				return true
+			}
+		}
+	case m.SHA256 != "":
+		return certFingerprint(cert) == m.SHA256
+	}
+	return false
+}
+
+// Lookup returns the username cert is mapped to.
+func (t *CertTable) Lookup(cert *x509.Certificate) (string, error) {
+	for i := range t.Entries {
+		if t.Entries[i].matches(cert) {
+			return t.Entries[i].Username, nil
+		}
+	}
+	return "", ErrUnmappedCert
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadClientCAs reads the PEM bundle of CAs client certificates must chain
+// to.
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certTable maps client certificates to users; nil if client certificates
+// are not accepted
+var certTable *CertTable
+
+// verifiedClientCert returns the client certificate of r if the TLS
+// handshake verified it against the client CAs.
+func verifiedClientCert(r *http.Request) (*x509.Certificate, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return r.TLS.VerifiedChains[0][0], true
+}
+
+// certPrincipal returns the principal of a caller authenticated by cert.
+// The certificate's identity is recorded in the claims.
+func certPrincipal(user *User, cert *x509.Certificate) *audit.Principal {
+	principal := principalFor(user, audit.AuthClientCert)
+	principal.TokenID = cert.SerialNumber.Text(16)
+	claims := map[string]interface{}{
+		"sub":    cert.Subject.String(),
+		"iss":    cert.Issuer.String(),
+		"sha256": certFingerprint(cert),
+		"exp":    float64(cert.NotAfter.Unix()),
+	}
+	var sans []interface{}
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "dns:"+name)
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, "uri:"+u.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	if len(sans) > 0 {
+		claims["san"] = sans
+	}
+	principal.Claims = claims
+	return principal
+}
+
+// findCertUser returns the user cert is mapped to, or the audit reason code
+// the caller is refused with
+func findCertUser(cert *x509.Certificate) (*User, string) {
+	username, err := certTable.Lookup(cert)
+	if err != nil {
+		return nil, "unmapped_client_cert"
+	}
+	user, err := userStore.FindByUsername(username)
+	if err != nil {
+		if err != ErrUserNotFound {
+			log.Printf("Error looking up user %s: %v", username, err)
+		}
+		return nil, "unknown_user"
+	}
+	if user.Disabled {
+		return nil, "user_disabled"
+	}
+	return user, ""
+}
+
+// clientCertTLSConfig returns the server TLS configuration for verifying
+// client certificates signed by cas. If required is false, callers without
+// a certificate may still authenticate with a session.
+func clientCertTLSConfig(cas *x509.CertPool, required bool) *tls.Config {
+	auth := tls.VerifyClientCertIfGiven
+	if required {
+		auth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		ClientCAs:  cas,
+		ClientAuth: auth,
+		MinVersion: tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"audit"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// recordingSink keeps the audit events written to it.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*audit.Event
+}
+
+func (s *recordingSink) Write(e *audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+// last returns the most recent event.
+func (s *recordingSink) last(t *testing.T) *audit.Event {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) == 0 {
+		t.Fatal("no audit events recorded")
+	}
+	return s.events[len(s.events)-1]
+}
+
+// setupTestStores points the package's stores and audit logger at a fresh
+// database, restoring them when the test ends.
+func setupTestStores(t *testing.T) (*gorm.DB, *recordingSink) {
+	t.Helper()
+	db, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldUsers, oldTokens, oldMFA, oldKeys, oldKeyring, oldGuard, oldLogger := userStore, tokenStore, mfaStore, apiKeyStore, keyring, loginGuard, auditLogger
+	t.Cleanup(func() {
+		userStore, tokenStore, mfaStore, apiKeyStore, keyring, loginGuard, auditLogger = oldUsers, oldTokens, oldMFA, oldKeys, oldKeyring, oldGuard, oldLogger
+		db.Close()
+	})
+	if userStore, err = NewUserStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if tokenStore, err = NewTokenStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if mfaStore, err = NewMFAStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if apiKeyStore, err = NewAPIKeyStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if keyring, err = NewEphemeralKeyring(); err != nil {
+		t.Fatal(err)
+	}
+	loginGuard = NewLoginGuard(DefaultLoginGuardConfig)
+	sink := &recordingSink{}
+	auditLogger = audit.NewLogger(sink, nil)
+	return db, sink
+}
+
+// testCA signs certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate and key for tmpl, signed by the CA. Serial
+// number, validity and key usage are filled in.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// clientTemplate returns a client certificate template with every kind of
+// identity a mapping can match.
+func clientTemplate(cn string) *x509.Certificate {
+	spiffe, _ := url.Parse("spiffe://example.org/" + cn)
+	return &x509.Certificate{
+		Subject:        pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		DNSNames:       []string{cn + ".internal"},
+		URIs:           []*url.URL{spiffe},
+		EmailAddresses: []string{cn + "@example.org"},
+	}
+}
+
+// certFor returns a client certificate for cn signed by ca.
+func certFor(t *testing.T, ca *testCA, cn string) *tls.Certificate {
+	cert := ca.issue(t, clientTemplate(cn), x509.ExtKeyUsageClientAuth)
+	return &cert
+}
+
+// clientFor returns a client of a server whose certificate ca signed. It
+// presents cert if it is not nil, even one the server's CAs did not sign.
+func clientFor(ca *testCA, cert *tls.Certificate) *http.Client {
+	cfg := &tls.Config{RootCAs: ca.pool()}
+	if cert != nil {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+}
+
+func writeCertTable(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "certs.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCertTableLookup(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	billing := ca.issue(t, clientTemplate("billing"), x509.ExtKeyUsageClientAuth).Leaf
+	pinned := ca.issue(t, clientTemplate("pinned"), x509.ExtKeyUsageClientAuth).Leaf
+
+	// Fingerprints are accepted in upper case with colons
+	fp := certFingerprint(pinned)
+	var colons []string
+	for i := 0; i < len(fp); i += 2 {
+		colons = append(colons, strings.ToUpper(fp[i:i+2]))
+	}
+
+	table, err := LoadCertTable(writeCertTable(t, `
+certificates:
+  - sha256: "`+strings.Join(colons, ":")+`"
+    username: by-fingerprint
+  - subject: "CN=billing,O=Example"
+    username: by-subject
+  - common_name: billing
+    username: by-cn
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := table.Lookup(pinned); got != "by-fingerprint" || err != nil {
+		t.Errorf("pinned: got %q, %v; want by-fingerprint", got, err)
+	}
+	// The first matching entry wins
+	if got, err := table.Lookup(billing); got != "by-subject" || err != nil {
+		t.Errorf("billing: got %q, %v; want by-subject", got, err)
+	}
+
+	tests := []struct {
+		mapping string
+		cert    *x509.Certificate
+		want    bool
+	}{
+		{`common_name: billing`, billing, true},
+		{`common_name: Billing`, billing, false},
+		{`subject: "CN=billing"`, billing, false},
+		{`dns: BILLING.internal`, billing, true},
+		{`dns: billing.example`, billing, false},
+		{`uri: spiffe://example.org/billing`, billing, true},
+		{`uri: spiffe://example.org/pinned`, billing, false},
+		{`email: Billing@Example.org`, billing, true},
+		{`sha256: ` + fp, billing, false},
+	}
+	for _, tt := range tests {
+		table, err := LoadCertTable(writeCertTable(t, "certificates:\n  - "+tt.mapping+"\n    username: u\n"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.mapping, err)
+		}
+		_, err = table.Lookup(tt.cert)
+		if matched := err == nil; matched != tt.want {
+			t.Errorf("%s: matched %v, want %v", tt.mapping, matched, tt.want)
+		}
+		if err != nil && err != ErrUnmappedCert {
+			t.Errorf("%s: got error %v, want ErrUnmappedCert", tt.mapping, err)
+		}
+	}
+}
+
+func TestLoadCertTableRejectsInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"no matcher":       "certificates: [{username: u}]",
+		"two matchers":     "certificates: [{common_name: a, dns: a.internal, username: u}]",
+		"missing username": "certificates: [{common_name: a}]",
+		"YAML":             "certificates: {",
+	} {
+		if _, err := LoadCertTable(writeCertTable(t, data)); err == nil {
+			t.Errorf("%s: LoadCertTable succeeded, want an error", name)
+		}
+	}
+	if _, err := LoadCertTable(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadCertTable succeeded without a file")
+	}
+}
+
+func TestClientCertAuthentication(t *testing.T) {
+	_, sink := setupTestStores(t)
+	for _, name := range []string{"billing", "retired"} {
+		if _, err := userStore.CreateExternal(name, "service"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	retired, _ := userStore.FindByUsername("retired")
+	retired.Disabled = true
+	if err := userStore.Update(retired); err != nil {
+		t.Fatal(err)
+	}
+
+	oldTable := certTable
+	defer func() { certTable = oldTable }()
+	var err error
+	certTable, err = LoadCertTable(writeCertTable(t, `
+certificates:
+  - common_name: billing
+    username: billing
+  - common_name: retired
+    username: retired
+  - common_name: ghost
+    username: ghost
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t, "Test CA")
+	srv := httptest.NewUnstartedServer(LoggingMiddleware(requiresAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := audit.PrincipalFrom(r.Context())
+		w.Write([]byte(principal.AuthMethod + " " + principal.Username))
+	}))))
+	srv.TLS = clientCertTLSConfig(ca.pool(), false)
+	srv.TLS.Certificates = []tls.Certificate{ca.issue(t, &x509.Certificate{
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, x509.ExtKeyUsageServerAuth)}
+	srv.StartTLS()
+	defer srv.Close()
+
+	rogue := newTestCA(t, "Rogue CA")
+	tests := []struct {
+		name       string
+		cert       *tls.Certificate
+		wantStatus int
+		wantBody   string
+		wantReason string
+	}{
+		{"mapped", certFor(t, ca, "billing"), http.StatusOK, "client_cert billing", ""},
+		{"unmapped", certFor(t, ca, "stranger"), http.StatusForbidden, "", "unmapped_client_cert"},
+		{"disabled user", certFor(t, ca, "retired"), http.StatusForbidden, "", "user_disabled"},
+		{"unknown user", certFor(t, ca, "ghost"), http.StatusForbidden, "", "unknown_user"},
+		// Without a certificate the caller needs a session
+		{"no certificate", nil, http.StatusUnauthorized, "", "missing_token"},
+	}
+	for _, tt := range tests {
+		resp, err := clientFor(ca, tt.cert).Get(srv.URL + "/protected")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus || (tt.wantBody != "" && string(body) != tt.wantBody) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, resp.StatusCode, body, tt.wantStatus, tt.wantBody)
+		}
+		if e := sink.last(t); e.Reason != tt.wantReason {
+			t.Errorf("%s: got reason %q, want %q", tt.name, e.Reason, tt.wantReason)
+		}
+	}
+
+	// A certificate from another CA fails the handshake, whatever it names
+	if _, err := clientFor(ca, certFor(t, rogue, "billing")).Get(srv.URL + "/protected"); err == nil {
+		t.Error("certificate signed by another CA was accepted")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"audit"
+)
+
+const (
+	csrfCookie = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// CSRFConfig controls cross-site request forgery protection for the cookie
+// session. A CSRF token is issued with every access token and embedded in
+// it; state-changing requests must echo it in the X-CSRF-Token header, which
+// a cross-site page cannot read from the cookie.
+type CSRFConfig struct {
+	SameSite http.SameSite
+	// AllowedOrigins lists the origins, as scheme://host[:port], that may
+	// send state-changing requests. If empty only the request's own host is
+	// allowed.
+	AllowedOrigins map[string]bool
+}
+
+// csrf is the CSRF configuration set in main
+var csrf = &CSRFConfig{SameSite: http.SameSiteLaxMode}
+
+// ParseSameSite parses a SameSite cookie policy as given on the command line.
+func ParseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("invalid SameSite policy %q", s)
+}
+
+// ParseOrigins parses a comma-separated list of allowed origins.
+func ParseOrigins(list string) (map[string]bool, error) {
+	origins := make(map[string]bool)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid origin %q", s)
+		}
+		origins[u.Scheme+"://"+u.Host] = true
+	}
+	return origins, nil
+}
+
+// csrfError is a failed CSRF check, with the reason code recorded in the
+// audit log.
+type csrfError struct {
+	reason string
+	msg    string
+}
+
+func (e *csrfError) Error() string {
+	return e.msg
+}
+
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// checkOrigin verifies the Origin header, or the Referer if the browser sent
+// no Origin, against the allowed origins. Requests with neither come from
+// non-browser clients and are left to the token check.
+func (c *CSRFConfig) checkOrigin(r *http.Request) *csrfError {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		referer := r.Header.Get("Referer")
+		if referer == "" {
+			return nil
+		}
+		u, err := url.Parse(referer)
+		if err != nil {
+			return &csrfError{"csrf_bad_referer", "invalid referer"}
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+
+	if len(c.AllowedOrigins) > 0 {
+		if !c.AllowedOrigins[origin] {
+			return &csrfError{"csrf_origin_not_allowed", "origin " + origin + " not allowed"}
+		}
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Host, r.Host) {
+		return &csrfError{"csrf_cross_origin", "cross-origin request from " + origin}
+	}
+	return nil
+}
+
+// verify checks a state-changing request against the CSRF token bound to
+// the caller's access token.
+func (c *CSRFConfig) verify(r *http.Request, claims *Token) *csrfError {
+	if err := c.checkOrigin(r); err != nil {
+		return err
+	}
+	sent := r.Header.Get(csrfHeader)
+	if sent == "" {
+		return &csrfError{"csrf_token_missing", "missing " + csrfHeader + " header"}
+	}
+	if claims.CSRF == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(claims.CSRF)) != 1 {
+		return &csrfError{"csrf_token_mismatch", "CSRF token mismatch"}
+	}
+	return nil
+}
+
+// setCookie sets the CSRF cookie, which scripts on the page read to fill in
+// the header.
+func (c *CSRFConfig) setCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Secure:   true,
+		Path:     "/",
+		SameSite: c.SameSite,
+		MaxAge:   int(refreshTokenTTL / time.Second),
+	})
+	w.Header().Set(csrfHeader, token)
+}
+
+// rejectCSRF refuses a request that failed CSRF checks.
+func rejectCSRF(w http.ResponseWriter, r *http.Request, err *csrfError) {
+	log.Printf("Rejected %s %s from %s: %v", r.Method, r.URL.Path, auditLogger.ClientIP(r), err)
+	audit.SetReason(r.Context(), err.reason)
+	http.Error(w, "CSRF validation failed", http.StatusForbidden)
+}
+
+// checkOriginMiddleware rejects cross-origin state-changing requests to
+// routes that have no session yet, such as login and refresh.
+func checkOriginMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !safeMethod(r.Method) {
+			if err := csrf.checkOrigin(r); err != nil {
+				rejectCSRF(w, r, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"audit"
+)
+
+// signIn issues a password session for user and returns its cookies.
+func signIn(t *testing.T, user *User) []*http.Cookie {
+	t.Helper()
+	family, err := randomID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err := issueSession(rec, user.ID, family, "", []string{amrPassword}); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()
+}
+
+// cookie returns the value of the cookie called name.
+func cookie(cookies []*http.Cookie, name string) string {
+	for _, c := range cookies {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// withCSRF sets the CSRF configuration for the rest of the test.
+func withCSRF(t *testing.T, cfg *CSRFConfig) {
+	old := csrf
+	csrf = cfg
+	t.Cleanup(func() { csrf = old })
+}
+
+// serve calls handler with req and returns the response and audit event.
+func serve(handler http.Handler, req *http.Request) (*httptest.ResponseRecorder, *audit.Event) {
+	ctx, e := audit.Begin(req.Context())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req.WithContext(ctx))
+	return rec, e
+}
+
+func TestParseOrigins(t *testing.T) {
+	origins, err := ParseOrigins(" https://app.test, http://localhost:3000/ ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(origins) != 2 || !origins["https://app.test"] || !origins["http://localhost:3000"] {
+		t.Errorf("got %v, want https://app.test and http://localhost:3000", origins)
+	}
+	for _, list := range []string{"app.test", "https://app.test/login", "https://", "://x"} {
+		if _, err := ParseOrigins(list); err == nil {
+			t.Errorf("%q: got no error", list)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := &CSRFConfig{AllowedOrigins: map[string]bool{"https://app.test": true}}
+	tests := []struct {
+		name    string
+		cfg     *CSRFConfig
+		origin  string
+		referer string
+		reason  string
+	}{
+		{"no origin or referer", &CSRFConfig{}, "", "", ""},
+		{"same origin", &CSRFConfig{}, "https://api.test", "", ""},
+		{"cross origin", &CSRFConfig{}, "https://evil.test", "", "csrf_cross_origin"},
+		{"same-origin referer", &CSRFConfig{}, "", "https://api.test/page", ""},
+		{"cross-origin referer", &CSRFConfig{}, "", "https://evil.test/page", "csrf_cross_origin"},
+		{"invalid referer", &CSRFConfig{}, "", "https://api.test/%zz", "csrf_bad_referer"},
+		{"origin beats referer", &CSRFConfig{}, "https://evil.test", "https://api.test/page", "csrf_cross_origin"},
+		{"allowed origin", allowed, "https://app.test", "", ""},
+		{"unlisted origin", allowed, "https://api.test", "", "csrf_origin_not_allowed"},
+		{"unlisted referer", allowed, "", "https://evil.test/page", "csrf_origin_not_allowed"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "https://api.test/auth", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+		reason := ""
+		if err := tt.cfg.checkOrigin(req); err != nil {
+			reason = err.reason
+		}
+		if reason != tt.reason {
+			t.Errorf("%s: got %q, want %q", tt.name, reason, tt.reason)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	cfg := &CSRFConfig{}
+	tests := []struct {
+		name   string
+		origin string
+		sent   string
+		bound  string
+		reason string
+	}{
+		{"matching token", "", "abc", "abc", ""},
+		{"missing token", "", "", "abc", "csrf_token_missing"},
+		{"mismatched token", "", "abd", "abc", "csrf_token_mismatch"},
+		{"token without a bound one", "", "abc", "", "csrf_token_mismatch"},
+		{"cross origin", "https://evil.test", "abc", "abc", "csrf_cross_origin"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "https://api.test/x", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.sent != "" {
+			req.Header.Set(csrfHeader, tt.sent)
+		}
+		reason := ""
+		if err := cfg.verify(req, &Token{CSRF: tt.bound}); err != nil {
+			reason = err.reason
+		}
+		if reason != tt.reason {
+			t.Errorf("%s: got %q, want %q", tt.name, reason, tt.reason)
+		}
+	}
+}
+
+func TestRequiresAuthChecksCSRF(t *testing.T) {
+	setupTestStores(t)
+	withCSRF(t, &CSRFConfig{SameSite: http.SameSiteLaxMode})
+	alice, _ := userStore.Create("alice", "correct horse", "user")
+	cookies := signIn(t, alice)
+	handler := requiresAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		origin string
+		token  string
+		status int
+		reason string
+	}{
+		{"safe method", "GET", "https://evil.test", "", http.StatusNoContent, ""},
+		{"missing token", "POST", "", "", http.StatusForbidden, "csrf_token_missing"},
+		{"wrong token", "POST", "", "forged", http.StatusForbidden, "csrf_token_mismatch"},
+		{"cross origin", "POST", "https://evil.test", cookie(cookies, csrfCookie), http.StatusForbidden, "csrf_cross_origin"},
+		{"matching token", "POST", "https://api.test", cookie(cookies, csrfCookie), http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "https://api.test/protected/x", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: cookie(cookies, "token")})
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.token != "" {
+			req.Header.Set(csrfHeader, tt.token)
+		}
+		rec, e := serve(handler, req)
+		if rec.Code != tt.status || e.Reason != tt.reason {
+			t.Errorf("%s: got %d (%s), want %d (%s)", tt.name, rec.Code, e.Reason, tt.status, tt.reason)
+		}
+	}
+}
+
+func TestRequiresAuthSkipsCSRFForAPIKeys(t *testing.T) {
+	setupTestStores(t)
+	svc, _ := userStore.CreateExternal("svc", "service")
+	_, secret, err := apiKeyStore.Create(svc.ID, "ci", Scopes{"/protected/**"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := requiresAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// Browsers cannot attach the header, so a key needs neither origin nor token
+	req := httptest.NewRequest("POST", "https://api.test/protected/x", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	req.Header.Set("Origin", "https://evil.test")
+	if rec, e := serve(handler, req); rec.Code != http.StatusNoContent {
+		t.Errorf("got %d (%s), want 204", rec.Code, e.Reason)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// FakeIdP is a minimal OpenID provider for tests. It signs in whoever the
+// login_hint names without asking for credentials.
+type FakeIdP struct {
+	Issuer   string
+	ClientID string
+
+	// Users holds extra ID token claims by username, such as groups
+	Users map[string]map[string]interface{}
+
+	keyring *Keyring
+	mu      sync.Mutex
+	grants  map[string]*fakeGrant // By authorization code
+	mux     *http.ServeMux
+}
+
+// fakeGrant is an authorization code waiting to be redeemed.
+type fakeGrant struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	username    string
+	expires     time.Time
+}
+
+// NewFakeIdP returns a fake provider serving issuer for clientID, signing
+// with an ephemeral key.
+func NewFakeIdP(issuer, clientID string) (*FakeIdP, error) {
+	kr, err := NewEphemeralKeyring()
+	if err != nil {
+		return nil, err
+	}
+	f := &FakeIdP{
+		Issuer:   issuer,
+		ClientID: clientID,
+		Users:    make(map[string]map[string]interface{}),
+		keyring:  kr,
+		grants:   make(map[string]*fakeGrant),
+		mux:      http.NewServeMux(),
+	}
+	f.mux.HandleFunc("/.well-known/openid-configuration", f.discovery)
+	f.mux.HandleFunc("/authorize", f.authorize)
+	f.mux.HandleFunc("/token", f.token)
+	f.mux.HandleFunc("/jwks", kr.JWKSHandler)
+	return f, nil
+}
+
+func (f *FakeIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.ServeHTTP(w, r)
+}
+
+func (f *FakeIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, oidcDiscovery{
+		Issuer:                f.Issuer,
+		AuthorizationEndpoint: f.Issuer + "/authorize",
+		TokenEndpoint:         f.Issuer + "/token",
+		JWKSURI:               f.Issuer + "/jwks",
+	})
+}
+
+// authorize approves every request at once and redirects back with a code
+func (f *FakeIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != f.ClientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	username := q.Get("login_hint")
+	if username == "" {
+		username = "alice"
+	}
+	code, err := randomID()
+	if err != nil {
+		http.Error(w, "server_error", http.StatusInternalServerError)
+		return
+	}
+	f.mu.Lock()
+	f.grants[code] = &fakeGrant{
+		redirectURI: redirect.String(),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		username:    username,
+		expires:     time.Now().Add(time.Minute),
+	}
+	f.mu.Unlock()
+
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token redeems a code once, checking the PKCE verifier
+func (f *FakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+	}
+	if r.Method != "POST" || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		fail("invalid_request")
+		return
+	}
+	f.mu.Lock()
+	grant, ok := f.grants[r.PostForm.Get("code")]
+	delete(f.grants, r.PostForm.Get("code"))
+	f.mu.Unlock()
+	if !ok || time.Now().After(grant.expires) || r.PostForm.Get("client_id") != f.ClientID ||
+		r.PostForm.Get("redirect_uri") != grant.redirectURI {
+		fail("invalid_grant")
+		return
+	}
+	if pkceChallenge(r.PostForm.Get("code_verifier")) != grant.challenge {
+		fail("invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                f.Issuer,
+		"sub":                "fake|" + grant.username,
+		"aud":                f.ClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"preferred_username": grant.username,
+		"email":              grant.username + "@example.com",
+		"amr":                []string{"pwd"},
+	}
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+	for k, v := range f.Users[grant.username] {
+		claims[k] = v
+	}
+	idToken, err := f.keyring.Sign(claims)
+	if err != nil {
+		log.Printf("Error signing fake ID token: %v", err)
+		fail("server_error")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "fake-" + grant.username,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeyringConfig describes the keys used to sign and verify tokens. It is
+// read from a JSON file or the JWT_KEYRING environment variable.
+type KeyringConfig struct {
+	Active      string      `json:"active"`       // kid of the key that signs new tokens
+	GracePeriod string      `json:"grace_period"` // How long retired keys still verify, e.g. "168h"
+	Keys        []KeyConfig `json:"keys"`
+}
+
+// KeyConfig describes one key. The key is given inline as PEM or as a path
+// to a PEM file; keys that only verify may give just the public key.
+type KeyConfig struct {
+	ID             string    `json:"kid"`
+	Algorithm      string    `json:"alg,omitempty"` // RS256, ES256 or EdDSA; inferred from the key if empty
+	PrivateKey     string    `json:"private_key,omitempty"`
+	PrivateKeyFile string    `json:"private_key_file,omitempty"`
+	PublicKey      string    `json:"public_key,omitempty"`
+	PublicKeyFile  string    `json:"public_key_file,omitempty"`
+	RetiredAt      time.Time `json:"retired_at,omitempty"`
+}
+
+// keyringKey is a loaded key.
+type keyringKey struct {
+	id        string
+	method    jwt.SigningMethod
+	private   crypto.Signer // nil for verify-only keys
+	public    crypto.PublicKey
+	retiredAt time.Time
+}
+
+// Keyring signs tokens with its active key and verifies tokens signed by
+// any key that is active or still within its grace period.
+type Keyring struct {
+	mu     sync.RWMutex
+	active *keyringKey
+	keys   map[string]*keyringKey
+	grace  time.Duration
+}
+
+// LoadKeyring loads the keyring from the JSON file at path, or from the
+// JWT_KEYRING environment variable if path is empty. Relative key file
+// paths are resolved against the directory of the keyring file.
+func LoadKeyring(path string) (*Keyring, error) {
+	var data []byte
+	dir := "."
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data, dir = b, filepath.Dir(path)
+	} else if env := os.Getenv("JWT_KEYRING"); env != "" {
+		data = []byte(env)
+	} else {
+		return nil, errors.New("no keyring configured")
+	}
+
+	var cfg KeyringConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid keyring: %v", err)
+	}
+	return newKeyring(&cfg, dir)
+}
+
+// NewEphemeralKeyring returns a keyring with a single Ed25519 key generated
+// in memory. Tokens it signs do not survive a restart.
+func NewEphemeralKeyring() (*Keyring, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key := &keyringKey{
+		id:      fmt.Sprintf("ephemeral-%d", time.Now().Unix()),
+		method:  jwt.SigningMethodEdDSA,
+		private: priv,
+		public:  priv.Public(),
+	}
+	return &Keyring{active: key, keys: map[string]*keyringKey{key.id: key}}, nil
+}
+
+func newKeyring(cfg *KeyringConfig, dir string) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[string]*keyringKey)}
+	if cfg.GracePeriod != "" {
+		grace, err := time.ParseDuration(cfg.GracePeriod)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grace_period: %v", err)
+		}
+		kr.grace = grace
+	}
+
+	for i := range cfg.Keys {
+		key, err := loadKey(&cfg.Keys[i], dir)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", cfg.Keys[i].ID, err)
+		}
+		if _, dup := kr.keys[key.id]; dup {
+			return nil, fmt.Errorf("duplicate kid %q", key.id)
+		}
+		kr.keys[key.id] = key
+	}
+
+	active, ok := kr.keys[cfg.Active]
+	if !ok {
+		return nil, fmt.Errorf("active key %q not found", cfg.Active)
+	}
+	if active.private == nil {
+		return nil, fmt.Errorf("active key %q has no private key", cfg.Active)
+	}
+	if !active.retiredAt.IsZero() {
+		return nil, fmt.Errorf("active key %q is retired", cfg.Active)
+	}
+	kr.active = active
+	return kr, nil
+}
+
+func loadKey(cfg *KeyConfig, dir string) (*keyringKey, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("missing kid")
+	}
+	key := &keyringKey{id: cfg.ID, retiredAt: cfg.RetiredAt}
+
+	privPEM, err := readPEM(cfg.PrivateKey, cfg.PrivateKeyFile, dir)
+	if err != nil {
+		return nil, err
+	}
+	if privPEM != nil {
+		if key.private, err = parsePrivateKey(privPEM); err != nil {
+			return nil, err
+		}
+		key.public = key.private.Public()
+	} else {
+		pubPEM, err := readPEM(cfg.PublicKey, cfg.PublicKeyFile, dir)
+		if err != nil {
+			return nil, err
+		}
+		if pubPEM == nil {
+			return nil, errors.New("no private or public key")
+		}
+		if key.public, err = x509.ParsePKIXPublicKey(pubPEM.Bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	if key.method, err = signingMethod(cfg.Algorithm, key.public); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// readPEM returns the PEM block given inline or in a file, or nil if neither
+// is set.
+func readPEM(inline, file, dir string) (*pem.Block, error) {
+	data := []byte(inline)
+	if file != "" {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+	return block, nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// signingMethod returns the method for alg, checking that it suits pub. An
+// empty alg is inferred from the key type.
+func signingMethod(alg string, pub crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if alg == "" || alg == "RS256" {
+			if pub.N.BitLen() < 2048 {
+				return nil, errors.New("RSA keys must be at least 2048 bits")
+			}
+			return jwt.SigningMethodRS256, nil
+		}
+	case *ecdsa.PublicKey:
+		if (alg == "" || alg == "ES256") && pub.Curve == elliptic.P256() {
+			return jwt.SigningMethodES256, nil
+		}
+	case ed25519.PublicKey:
+		if alg == "" || alg == "EdDSA" {
+			return jwt.SigningMethodEdDSA, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return nil, fmt.Errorf("algorithm %q does not match the key", alg)
+}
+
+// Sign signs claims with the active key and stamps its kid in the header.
+func (kr *Keyring) Sign(claims jwt.Claims) (string, error) {
+	kr.mu.RLock()
+	active := kr.active
+	kr.mu.RUnlock()
+
+	token := jwt.NewWithClaims(active.method, claims)
+	token.Header["kid"] = active.id
+	return token.SignedString(active.private)
+}
+
+// usable reports whether key may still verify tokens at now.
+func (kr *Keyring) usable(key *keyringKey, now time.Time) bool {
+	return key.retiredAt.IsZero() || now.Before(key.retiredAt.Add(kr.grace))
+}
+
+// Keyfunc finds the verification key for a token by its kid header. It
+// rejects unknown kids, expired keys and algorithms that do not match the
+// key, so a token cannot choose how it is verified.
+func (kr *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	kr.mu.RLock()
+	key, ok := kr.keys[kid]
+	kr.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if !kr.usable(key, time.Now()) {
+		return nil, fmt.Errorf("key %q is past its grace period", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Method.Alg())
+	}
+	return key.public, nil
+}
+
+// Replace swaps in the keys of other, as on a reload after rotation.
+func (kr *Keyring) Replace(other *Keyring) {
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.active, kr.keys, kr.grace = other.active, other.keys, other.grace
+}
+
+// jwk is a public key in JSON Web Key form (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func toJWK(key *keyringKey) jwk {
+	k := jwk{Kid: key.id, Alg: key.method.Alg(), Use: "sig"}
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N = b64(pub.N.Bytes())
+		k.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		k.Kty, k.Crv = "EC", "P-256"
+		k.X = b64(pub.X.FillBytes(make([]byte, size)))
+		k.Y = b64(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		k.Kty, k.Crv = "OKP", "Ed25519"
+		k.X = b64(pub)
+	}
+	return k
+}
+
+// fromJWK returns the public key of a JWK, as published by an identity
+// provider.
+func fromJWK(k jwk) (crypto.PublicKey, error) {
+	decode := func(s string) ([]byte, error) { return base64.RawURLEncoding.DecodeString(s) }
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 coordinates")
+		}
+		// ecdh rejects points that are not on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key %q", k.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// JWKSHandler serves the public keys that may still verify tokens, for
+// /.well-known/jwks.json.
+func (kr *Keyring) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{}}
+
+	kr.mu.RLock()
+	for _, key := range kr.keys {
+		if kr.usable(key, now) {
+			set.Keys = append(set.Keys, toJWK(key))
+		}
+	}
+	kr.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeys returns a new private key for each supported algorithm.
+func testKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey}
+}
+
+// keyConfig returns a KeyConfig for key with its private key inline.
+func keyConfig(t *testing.T, kid string, key crypto.Signer) KeyConfig {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return KeyConfig{ID: kid, PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))}
+}
+
+func mustKeyring(t *testing.T, cfg *KeyringConfig) *Keyring {
+	t.Helper()
+	kr, err := newKeyring(cfg, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+// verifyToken parses a token signed by a keyring, as requiresAuth does.
+func verifyToken(kr *Keyring, token string) error {
+	_, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, kr.Keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}))
+	return err
+}
+
+func TestKeyringSignsAndVerifies(t *testing.T) {
+	for alg, key := range testKeys(t) {
+		kr := mustKeyring(t, &KeyringConfig{Active: alg, Keys: []KeyConfig{keyConfig(t, alg, key)}})
+		token, err := kr.Sign(&jwt.RegisteredClaims{Subject: "42"})
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Header["alg"] != alg || parsed.Header["kid"] != alg {
+			t.Errorf("%s: got header %v", alg, parsed.Header)
+		}
+		if err := verifyToken(kr, token); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+	}
+}
+
+func TestKeyringRejectsUnknownKid(t *testing.T) {
+	keys := testKeys(t)
+	signer := mustKeyring(t, &KeyringConfig{Active: "a", Keys: []KeyConfig{keyConfig(t, "a", keys["EdDSA"])}})
+	verifier := mustKeyring(t, &KeyringConfig{Active: "b", Keys: []KeyConfig{keyConfig(t, "b", keys["EdDSA"])}})
+	token, err := signer.Sign(&jwt.RegisteredClaims{Subject: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyToken(verifier, token); err == nil {
+		t.Error("a token with an unknown kid verified")
+	}
+}
+
+func TestKeyringGracePeriod(t *testing.T) {
+	keys := testKeys(t)
+	old, next := keyConfig(t, "old", keys["ES256"]), keyConfig(t, "new", keys["EdDSA"])
+	signer := mustKeyring(t, &KeyringConfig{Active: "old", Keys: []KeyConfig{old}})
+	token, err := signer.Sign(&jwt.RegisteredClaims{Subject: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		retired   time.Duration // Before now
+		ok        bool
+		published int
+	}{
+		{time.Hour, true, 2},
+		{3 * time.Hour, false, 1},
+	}
+	for _, tt := range tests {
+		old.RetiredAt = time.Now().Add(-tt.retired)
+		kr := mustKeyring(t, &KeyringConfig{Active: "new", GracePeriod: "2h", Keys: []KeyConfig{old, next}})
+		if err := verifyToken(kr, token); (err == nil) != tt.ok {
+			t.Errorf("retired %v ago: got %v, want verified %v", tt.retired, err, tt.ok)
+		}
+
+		// Only keys that still verify are published
+		rec := httptest.NewRecorder()
+		kr.JWKSHandler(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&set); err != nil {
+			t.Fatal(err)
+		}
+		if len(set.Keys) != tt.published {
+			t.Errorf("retired %v ago: got %d published keys, want %d", tt.retired, len(set.Keys), tt.published)
+		}
+	}
+
+	if _, err := newKeyring(&KeyringConfig{Active: "old", Keys: []KeyConfig{old}}, t.TempDir()); err == nil {
+		t.Error("a retired key was accepted as the active key")
+	}
+}
+
+func TestJWKSRoundTrip(t *testing.T) {
+	keys := testKeys(t)
+	kr := mustKeyring(t, &KeyringConfig{Active: "RS256", Keys: []KeyConfig{
+		keyConfig(t, "RS256", keys["RS256"]),
+		keyConfig(t, "ES256", keys["ES256"]),
+		keyConfig(t, "EdDSA", keys["EdDSA"]),
+	}})
+
+	rec := httptest.NewRecorder()
+	kr.JWKSHandler(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != len(keys) {
+		t.Fatalf("got %d keys, want %d", len(set.Keys), len(keys))
+	}
+	for _, k := range set.Keys {
+		pub, err := fromJWK(k)
+		if err != nil {
+			t.Errorf("%s: %v", k.Kid, err)
+			continue
+		}
+		want := keys[k.Kid].Public().(interface{ Equal(crypto.PublicKey) bool })
+		if k.Alg != k.Kid || !want.Equal(pub) {
+			t.Errorf("%s: got alg %s and a different key back", k.Kid, k.Alg)
+		}
+	}
+
+	for _, k := range []jwk{
+		{Kty: "EC", Crv: "P-384"},
+		{Kty: "EC", Crv: "P-256", X: b64(make([]byte, 32)), Y: b64(make([]byte, 32))},
+		{Kty: "OKP", Crv: "X25519", X: b64(make([]byte, 32))},
+		{Kty: "oct"},
+	} {
+		if _, err := fromJWK(k); err == nil {
+			t.Errorf("%+v: got no error", k)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginGuardConfig sets how failed logins are throttled.
+type LoginGuardConfig struct {
+	MaxFailures   int           // Failures per username before it is locked
+	IPMaxFailures int           // Failures per client IP before it is locked
+	BaseDelay     time.Duration // Wait after a username's first failure, doubled for each one after
+	MaxDelay      time.Duration // Longest wait between attempts before lockout
+	Lockout       time.Duration // How long a lockout lasts; failures older than this are forgotten
+
+	// MaxEntries caps the usernames and the IPs tracked. Beyond it the
+	// least recently active are forgotten, so spraying usernames cannot
+	// exhaust memory. Locked and in-flight entries are kept; while there
+	// are only those to forget, new usernames and IPs are refused.
+	MaxEntries int
+}
+
+// DefaultLoginGuardConfig locks a username after 5 failures and an IP after
+// 20, for 15 minutes.
+var DefaultLoginGuardConfig = LoginGuardConfig{
+	MaxFailures:   5,
+	IPMaxFailures: 20,
+	BaseDelay:     time.Second,
+	MaxDelay:      time.Minute,
+	Lockout:       15 * time.Minute,
+	MaxEntries:    100000,
+}
+
+// attempts tracks the logins of one username or IP.
+type attempts struct {
+	key         string
+	failures    int
+	inFlight    int // Attempts begun but not yet ended
+	lastFailure time.Time
+	nextAllowed time.Time
+	lockedUntil time.Time
+}
+
+// evictScan bounds how many of the least recently used attempts a full
+// attemptTable looks through for one it may drop.
+const evictScan = 64
+
+// attemptTable holds attempts by key, dropping the least recently used
+// that are neither locked nor in flight once it is full.
+type attemptTable struct {
+	max   int
+	items map[string]*list.Element
+	order *list.List // Of *attempts, most recently used first
+}
+
+func newAttemptTable(max int) *attemptTable {
+	return &attemptTable{max: max, items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (t *attemptTable) get(key string) *attempts {
+	if el, ok := t.items[key]; ok {
+		t.order.MoveToFront(el)
+		return el.Value.(*attempts)
+	}
+	return nil
+}
+
+// getOrCreate returns the attempts for key, creating them if needed. It
+// returns nil if the table is full and nothing can be dropped.
+func (t *attemptTable) getOrCreate(key string, now time.Time) *attempts {
+	if a := t.get(key); a != nil {
+		return a
+	}
+	if t.max > 0 && t.order.Len() >= t.max && !t.evict(now) {
+		return nil
+	}
+	a := &attempts{key: key}
+	t.items[key] = t.order.PushFront(a)
+	return a
+}
+
+// evict drops the least recently used attempts that are neither locked nor
+// in flight, reporting whether there were any. The limits rest on the
+// others, so forgetting them would let a flood of new keys reset a lockout.
+func (t *attemptTable) evict(now time.Time) bool {
+	el := t.order.Back()
+	for i := 0; el != nil && i < evictScan; i++ {
+		if a := el.Value.(*attempts); a.inFlight == 0 && !now.Before(a.lockedUntil) {
+			t.delete(a.key)
+			return true
+		}
+		el = el.Prev()
+	}
+	return false
+}
+
+func (t *attemptTable) delete(key string) bool {
+	el, ok := t.items[key]
+	if ok {
+		t.order.Remove(el)
+		delete(t.items, key)
+	}
+	return ok
+}
+
+// LoginGuard counts failed logins per username and per client IP. Each
+// failure for a username doubles the wait before its next attempt, and too
+// many failures lock the username or IP out for a while. IPs get no backoff
+// so that users behind a shared address are not slowed by each other's
+// typos. State is kept in memory.
+//
+// An attempt is reserved by Begin before the password is checked, so
+// concurrent guesses cannot all get past the limits before the first
+// failure is counted.
+type LoginGuard struct {
+	cfg LoginGuardConfig
+
+	mu    sync.Mutex
+	users *attemptTable
+	ips   *attemptTable
+}
+
+// NewLoginGuard returns a LoginGuard with the given limits.
+func NewLoginGuard(cfg LoginGuardConfig) *LoginGuard {
+	return &LoginGuard{
+		cfg:   cfg,
+		users: newAttemptTable(cfg.MaxEntries),
+		ips:   newAttemptTable(cfg.MaxEntries),
+	}
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// LoginAttempt is a login reserved by Begin. It must be ended with Fail,
+// Succeed or Release; only the first of these has any effect.
+type LoginAttempt struct {
+	g        *LoginGuard
+	username string
+	ip       string
+	ended    bool
+}
+
+// Begin reserves a login attempt for username from ip. If the attempt may
+// not be made now, it returns nil with how long the client must wait and a
+// reason code. Only one attempt per username may be in flight at a time.
+func (g *LoginGuard) Begin(username, ip string) (attempt *LoginAttempt, wait time.Duration, reason string) {
+	username = normalizeUsername(username)
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	user := g.current(g.users, username, now)
+	if user != nil {
+		if now.Before(user.lockedUntil) {
+			return nil, user.lockedUntil.Sub(now), "account_locked"
+		}
+		if now.Before(user.nextAllowed) {
+			return nil, user.nextAllowed.Sub(now), "login_backoff"
+		}
+		if user.inFlight > 0 {
+			return nil, g.cfg.BaseDelay, "login_backoff"
+		}
+	}
+	addr := g.current(g.ips, ip, now)
+	if addr != nil {
+		if now.Before(addr.lockedUntil) {
+			return nil, addr.lockedUntil.Sub(now), "ip_locked"
+		}
+		// Attempts in flight would lock the IP if they all failed
+		if addr.failures+addr.inFlight >= g.cfg.IPMaxFailures {
+			return nil, g.cfg.BaseDelay, "login_backoff"
+		}
+	}
+
+	if user == nil {
+		user = g.users.getOrCreate(username, now)
+	}
+	if addr == nil && user != nil {
+		addr = g.ips.getOrCreate(ip, now)
+	}
+	if user == nil || addr == nil {
+		return nil, g.cfg.BaseDelay, "login_guard_full"
+	}
+	user.inFlight++
+	addr.inFlight++
+	return &LoginAttempt{g: g, username: username, ip: ip}, 0, ""
+}
+
+// current returns the attempts for key, forgetting them once they are older
+// than the lockout period.
+func (g *LoginGuard) current(t *attemptTable, key string, now time.Time) *attempts {
+	a := t.get(key)
+	if a == nil {
+		return nil
+	}
+	if a.inFlight == 0 && now.After(a.lockedUntil) && now.Sub(a.lastFailure) > g.cfg.Lockout {
+		t.delete(key)
+		return nil
+	}
+	return a
+}
+
+// end ends the attempt and then calls fn, unless it already ended.
+func (a *LoginAttempt) end(fn func()) {
+	g := a.g
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if a.ended {
+		return
+	}
+	a.ended = true
+	// Either may have been forgotten meanwhile
+	for _, s := range []*attempts{g.users.get(a.username), g.ips.get(a.ip)} {
+		if s != nil && s.inFlight > 0 {
+			s.inFlight--
+		}
+	}
+	fn()
+}
+
+// Fail counts the attempt as a failed login. It reports whether this
+// failure locked the username or IP.
+func (a *LoginAttempt) Fail() (locked bool) {
+	now := time.Now()
+	a.end(func() {
+		g := a.g
+		locked = g.fail(g.users.getOrCreate(a.username, now), g.cfg.MaxFailures, true, now)
+		if g.fail(g.ips.getOrCreate(a.ip, now), g.cfg.IPMaxFailures, false, now) {
+			locked = true
+		}
+	})
+	return locked
+}
+
+func (g *LoginGuard) fail(a *attempts, max int, backoff bool, now time.Time) bool {
+	// Unlocked while the attempt was in flight, and the table filled since
+	if a == nil {
+		return false
+	}
+	a.failures++
+	a.lastFailure = now
+
+	if backoff {
+		delay := g.cfg.MaxDelay
+		if a.failures <= 30 {
+			if d := g.cfg.BaseDelay << uint(a.failures-1); d < delay {
+				delay = d
+			}
+		}
+		a.nextAllowed = now.Add(delay)
+	}
+	if a.failures >= max && now.After(a.lockedUntil) {
+		a.lockedUntil = now.Add(g.cfg.Lockout)
+		return true
+	}
+	return false
+}
+
+// Succeed ends the attempt as a successful login, clearing the failures of
+// its username. The IP's failures are kept so that one valid account cannot
+// be used to reset the count while guessing others.
+func (a *LoginAttempt) Succeed() {
+	a.end(func() {
+		a.g.users.delete(a.username)
+	})
+}
+
+// Release ends the attempt without counting it either way, as when the
+// password was right but a second factor is still due. It does nothing if
+// the attempt already ended, so it can be deferred.
+func (a *LoginAttempt) Release() {
+	a.end(func() {})
+}
+
+// UnlockUser clears the failures and lockout of username. It reports
+// whether there was anything to clear.
+func (g *LoginGuard) UnlockUser(username string) bool {
+	return g.unlock(g.users, normalizeUsername(username))
+}
+
+// UnlockIP clears the failures and lockout of a client IP.
+func (g *LoginGuard) UnlockIP(ip string) bool {
+	return g.unlock(g.ips, ip)
+}
+
+func (g *LoginGuard) unlock(t *attemptTable, key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	a := t.get(key)
+	t.delete(key)
+	return a != nil && a.failures > 0
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGuardConfig has no backoff so that attempts can follow each other.
+var testGuardConfig = LoginGuardConfig{
+	MaxFailures:   3,
+	IPMaxFailures: 5,
+	Lockout:       time.Minute,
+	MaxEntries:    100,
+}
+
+func TestLoginGuardLocksUsername(t *testing.T) {
+	g := NewLoginGuard(testGuardConfig)
+	for i := 1; i <= 3; i++ {
+		a, _, reason := g.Begin("Alice", "192.0.2.1")
+		if a == nil {
+			t.Fatalf("attempt %d refused: %s", i, reason)
+		}
+		if locked := a.Fail(); locked != (i == 3) {
+			t.Fatalf("attempt %d: locked = %v", i, locked)
+		}
+	}
+	if a, wait, reason := g.Begin(" alice ", "192.0.2.2"); a != nil || reason != "account_locked" || wait <= 0 {
+		t.Errorf("got %v, %v, %q; want account_locked", a, wait, reason)
+	}
+
+	if !g.UnlockUser("ALICE") {
+		t.Error("UnlockUser found nothing to clear")
+	}
+	if a, _, reason := g.Begin("alice", "192.0.2.2"); a == nil {
+		t.Errorf("refused after unlock: %s", reason)
+	}
+}
+
+func TestLoginGuardLocksIP(t *testing.T) {
+	g := NewLoginGuard(testGuardConfig)
+	for i := 0; i < 5; i++ {
+		a, _, reason := g.Begin(fmt.Sprintf("user%d", i), "192.0.2.1")
+		if a == nil {
+			t.Fatalf("attempt %d refused: %s", i, reason)
+		}
+		a.Fail()
+	}
+	if a, _, reason := g.Begin("someone", "192.0.2.1"); a != nil || reason != "ip_locked" {
+		t.Errorf("got %v, %q; want ip_locked", a, reason)
+	}
+	if a, _, _ := g.Begin("someone", "192.0.2.9"); a == nil {
+		t.Error("another IP was refused")
+	}
+}
+
+func TestLoginGuardSuccessKeepsIPFailures(t *testing.T) {
+	g := NewLoginGuard(testGuardConfig)
+	a, _, _ := g.Begin("alice", "192.0.2.1")
+	a.Fail()
+	a, _, _ = g.Begin("alice", "192.0.2.1")
+	a.Succeed()
+
+	if g.UnlockUser("alice") {
+		t.Error("username failures survived a successful login")
+	}
+	if !g.UnlockIP("192.0.2.1") {
+		t.Error("IP failures were cleared by a successful login")
+	}
+}
+
+func TestLoginGuardReleaseDoesNotReset(t *testing.T) {
+	g := NewLoginGuard(testGuardConfig)
+	for i := 0; i < 2; i++ {
+		a, _, _ := g.Begin("alice", "192.0.2.1")
+		a.Fail()
+	}
+	// A correct password before a second factor must not clear failures
+	a, _, _ := g.Begin("alice", "192.0.2.1")
+	a.Release()
+	a.Fail() // Already ended, so not counted
+
+	a, _, _ = g.Begin("alice", "192.0.2.1")
+	if !a.Fail() {
+		t.Error("third failure did not lock the username")
+	}
+}
+
+func TestLoginGuardReservesConcurrentAttempts(t *testing.T) {
+	g := NewLoginGuard(testGuardConfig)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	admitted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, _, _ := g.Begin("alice", "192.0.2.1")
+			if a == nil {
+				return
+			}
+			mu.Lock()
+			admitted++
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			a.Fail()
+		}()
+	}
+	wg.Wait()
+	if admitted != 1 {
+		t.Errorf("%d concurrent attempts for one username were admitted, want 1", admitted)
+	}
+
+	// Attempts in flight count towards the IP limit
+	var attempts []*LoginAttempt
+	for i := 0; ; i++ {
+		a, _, _ := g.Begin(fmt.Sprintf("user%d", i), "192.0.2.1")
+		if a == nil {
+			break
+		}
+		attempts = append(attempts, a)
+	}
+	if len(attempts) != 4 {
+		t.Errorf("%d attempts in flight from one IP, want 4", len(attempts))
+	}
+	for _, a := range attempts {
+		a.Release()
+	}
+}
+
+func TestLoginGuardForgetsLeastRecentlyUsed(t *testing.T) {
+	cfg := testGuardConfig
+	cfg.MaxEntries = 10
+	g := NewLoginGuard(cfg)
+	a, _, _ := g.Begin("victim", "192.0.2.1")
+	a.Fail()
+	for i := 0; i < 1000; i++ {
+		a, _, _ := g.Begin(fmt.Sprintf("spray%d", i), fmt.Sprintf("198.51.100.%d", i%250))
+		a.Fail()
+	}
+	if n := len(g.users.items); n > cfg.MaxEntries {
+		t.Errorf("tracking %d usernames, want at most %d", n, cfg.MaxEntries)
+	}
+	if n := g.ips.order.Len(); n > cfg.MaxEntries {
+		t.Errorf("tracking %d IPs, want at most %d", n, cfg.MaxEntries)
+	}
+}
+
+func TestLoginGuardKeepsLockedAndInFlightEntries(t *testing.T) {
+	cfg := testGuardConfig
+	cfg.MaxEntries = 2
+	g := NewLoginGuard(cfg)
+
+	// Lock one username and leave an attempt in flight for another
+	for i := 0; i < 3; i++ {
+		a, _, reason := g.Begin("victim", "192.0.2.1")
+		if a == nil {
+			t.Fatalf("attempt %d refused: %s", i, reason)
+		}
+		a.Fail()
+	}
+	pending, _, reason := g.Begin("pending", "192.0.2.1")
+	if pending == nil {
+		t.Fatalf("pending attempt refused: %s", reason)
+	}
+
+	// Neither can be forgotten, so a new username is refused
+	if a, _, reason := g.Begin("spray", "192.0.2.1"); a != nil || reason != "login_guard_full" {
+		t.Errorf("got %v, %q; want login_guard_full", a, reason)
+	}
+	if a, _, reason := g.Begin("victim", "192.0.2.1"); a != nil || reason != "account_locked" {
+		t.Errorf("victim: got %v, %q; want account_locked", a, reason)
+	}
+
+	// Once the attempt ends its entry may make room
+	pending.Release()
+	if a, _, reason := g.Begin("spray", "192.0.2.1"); a == nil {
+		t.Errorf("refused after the attempt ended: %s", reason)
+	}
+	if a, _, reason := g.Begin("victim", "192.0.2.1"); a != nil || reason != "account_locked" {
+		t.Errorf("victim after eviction: got %v, %q; want account_locked", a, reason)
+	}
+}
@@ -3,47 +3,93 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"flag"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"audit"
+	"audit/access"
+	"audit/clientip"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
 // User represents a user
 type User struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	ID           string    `json:"id" gorm:"primary_key"`
+	Username     string    `json:"username" gorm:"unique_index"`
+	PasswordHash string    `json:"-"`
+	Role         string    `json:"role"`
+	Disabled     bool      `json:"disabled"` // Disabled users cannot sign in or use existing sessions
+	CreatedAt    time.Time `json:"created_at"`
 }
 
-// AuditLog represents an audit log entry
-type AuditLog struct {
-	Timestamp time.Time `json:"timestamp"`
-	UserID    string    `json:"user_id"`
-	Method    string    `json:"method"`
-	Path      string    `json:"path"`
-	RemoteIP  string    `json:"remote_ip"`
-	UserAgent string    `json:"user_agent"`
-	Status    int       `json:"status"`
+// Credentials is the body of a login request
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 // Token represents a JWT token
 type Token struct {
 	UserID string `json:"user_id"`
+	Family string `json:"fam"`  // Refresh token family the token was issued in
+	CSRF   string `json:"csrf"` // Token state-changing requests must echo
+
+	// AMR lists how the user authenticated, as in OpenID Connect: "pwd",
+	// plus "mfa" and "otp" after a second factor, or "oidc" and the
+	// provider's trusted methods
+	AMR []string `json:"amr,omitempty"`
+
+	// Type is empty for session tokens. Other tokens, such as the one
+	// between the password and second factor steps, are not sessions.
+	Type string `json:"typ,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// Users stores in-memory users
-var Users = []User{
-	{
-		ID:       "user1",
-		Username: "example",
-		Password: "example",
-	},
+// findUser returns the user with the given ID
+func findUser(id string) (*User, bool) {
+	user, err := userStore.FindByID(id)
+	if err != nil {
+		if err != ErrUserNotFound {
+			log.Printf("Error looking up user %s: %v", id, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// activeUser returns the user with the given ID if they may sign in, or the
+// audit reason code they are refused with
+func activeUser(id string) (*User, string) {
+	user, ok := findUser(id)
+	if !ok {
+		return nil, "unknown_user"
+	}
+	if user.Disabled {
+		return nil, "user_disabled"
+	}
+	return user, ""
+}
+
+// principalFor returns the principal of a user authenticated by method
+func principalFor(user *User, method string) *audit.Principal {
+	return &audit.Principal{
+		ID:         user.ID,
+		Username:   user.Username,
+		Roles:      []string{user.Role},
+		AuthMethod: method,
+	}
 }
 
 // Authenticate handles authentication
@@ -53,141 +99,445 @@ func Authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	var creds Credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
 	defer r.Body.Close()
 
-	for _, u := range Users {
-		if u.Username == user.Username && u.Password == user.Password {
-			token := generateToken(u.ID)
-			http.SetCookie(w, &http.Cookie{
-				Name:     "token",
-				Value:    token,
-				HttpOnly: true,
-				Secure:   true,
-				Path:     "/",
-				MaxAge:   60 * 60 * 24 * 7, // Token expires in 1 week
-			})
-			w.WriteHeader(http.StatusOK)
+	ip := auditLogger.ClientIP(r)
+	attempt := beginAttempt(w, r, creds.Username, ip)
+	if attempt == nil {
+		return
+	}
+	defer attempt.Release()
+
+	user, err := userStore.Authenticate(creds.Username, creds.Password)
+	if err == ErrInvalidCredentials {
+		reason := "invalid_credentials"
+		if attempt.Fail() {
+			reason = "invalid_credentials_lockout"
+			log.Printf("Locked out login for %q from %s", creds.Username, ip)
+		}
+		audit.SetReason(r.Context(), reason)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err == ErrUserDisabled {
+		audit.SetReason(r.Context(), "user_disabled")
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error authenticating user: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	audit.WithPrincipal(r.Context(), principalFor(user, audit.AuthPassword))
+
+	// Users with a second factor get a session only once they prove it
+	enrolled, err := mfaStore.Enrolled(user.ID)
+	if err != nil {
+		log.Printf("Error checking MFA enrollment: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if enrolled {
+		// Failures are only cleared by VerifyMFA, or logging in again with
+		// the password would reset the count between guessed codes
+		token, err := generateMFAToken(user.ID)
+		if err != nil {
+			log.Printf("Error issuing MFA token: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		writeJSON(w, http.StatusOK, mfaChallenge{Required: true, Token: token})
+		return
+	}
+	attempt.Succeed()
+
+	family, err := randomID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := issueSession(w, user.ID, family, "", []string{amrPassword}); err != nil {
+		log.Printf("Error issuing session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// beginAttempt reserves a login attempt for username from ip, or refuses
+// the request with 429 and returns nil
+func beginAttempt(w http.ResponseWriter, r *http.Request, username, ip string) *LoginAttempt {
+	attempt, wait, reason := loginGuard.Begin(username, ip)
+	if attempt == nil {
+		audit.SetReason(r.Context(), reason)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many failed login attempts", http.StatusTooManyRequests)
+	}
+	return attempt
+}
+
+// issueSession sets a new access token, CSRF token and refresh token in
+// family on w. A new refresh token is issued if refresh is empty. amr is
+// recorded in the tokens so that refreshed sessions keep it.
+func issueSession(w http.ResponseWriter, userID, family, refresh string, amr []string) error {
+	csrfToken, err := randomID()
+	if err != nil {
+		return err
+	}
+	token, err := generateToken(userID, family, csrfToken, amr)
+	if err != nil {
+		return err
+	}
+	if refresh == "" {
+		if refresh, err = tokenStore.Issue(userID, family, strings.Join(amr, " ")); err != nil {
+			return err
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    token,
+		HttpOnly: true,
+		Secure:   true,
+		Path:     "/",
+		SameSite: csrf.SameSite,
+		MaxAge:   int(accessTokenTTL / time.Second),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refresh,
+		HttpOnly: true,
+		Secure:   true,
+		Path:     "/auth",
+		SameSite: csrf.SameSite,
+		MaxAge:   int(refreshTokenTTL / time.Second),
+	})
+	csrf.setCookie(w, csrfToken)
+	return nil
+}
+
+// clearSession removes the session cookies from the client
+func clearSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: "token", Path: "/", MaxAge: -1, HttpOnly: true, Secure: true})
+	http.SetCookie(w, &http.Cookie{Name: "refresh_token", Path: "/auth", MaxAge: -1, HttpOnly: true, Secure: true})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Path: "/", MaxAge: -1, Secure: true})
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh token
+func Refresh(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("refresh_token")
+	if err != nil {
+		audit.SetReason(r.Context(), "missing_refresh_token")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rt, next, err := tokenStore.Rotate(cookie.Value)
+	switch {
+	case err == ErrRefreshTokenReused:
+		if user, ok := findUser(rt.UserID); ok {
+			audit.WithPrincipal(r.Context(), principalFor(user, audit.AuthRefreshToken))
+		}
+		log.Printf("Refresh token reuse for user %s; revoked token family", rt.UserID)
+		audit.SetReason(r.Context(), "refresh_token_reused")
+		clearSession(w)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	case err == ErrInvalidRefreshToken:
+		audit.SetReason(r.Context(), "invalid_refresh_token")
+		clearSession(w)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.Printf("Error rotating refresh token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if user, ok := findUser(rt.UserID); ok {
+		audit.WithPrincipal(r.Context(), principalFor(user, audit.AuthRefreshToken))
 	}
 
-	http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	if err := issueSession(w, rt.UserID, rt.Family, next, strings.Fields(rt.AMR)); err != nil {
+		log.Printf("Error issuing session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
-// generateToken generates a JWT token
-func generateToken(userID string) string {
+// Logout revokes the caller's access token and its refresh token family
+func Logout(w http.ResponseWriter, r *http.Request) {
+	principal, ok := audit.PrincipalFrom(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if principal.AuthMethod != audit.AuthJWT {
+		audit.SetReason(r.Context(), "no_session")
+		http.Error(w, "No session to log out of", http.StatusBadRequest)
+		return
+	}
+	expiresAt, _ := principal.TimeClaim("exp")
+	family, _ := principal.StringClaim("fam")
+	if err := tokenStore.Revoke(principal.TokenID, expiresAt); err != nil {
+		log.Printf("Error revoking token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tokenStore.RevokeFamily(family); err != nil {
+		log.Printf("Error revoking token family: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	clearSession(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnlockUser clears the failed logins and lockout of a username
+func UnlockUser(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	if !loginGuard.UnlockUser(username) {
+		http.Error(w, "No failed logins for user", http.StatusNotFound)
+		return
+	}
+	log.Printf("Unlocked login for %q", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnlockIP clears the failed logins and lockout of a client IP
+func UnlockIP(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	if !loginGuard.UnlockIP(ip) {
+		http.Error(w, "No failed logins for IP", http.StatusNotFound)
+		return
+	}
+	log.Printf("Unlocked login from %s", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// generateToken generates a short-lived JWT access token in family, bound to
+// csrfToken
+func generateToken(userID, family, csrfToken string, amr []string) (string, error) {
+	jti, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	token := &Token{
 		UserID: userID,
+		Family: family,
+		CSRF:   csrfToken,
+		AMR:    amr,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24 * 7)), // Token expires in 1 week
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
-	secretKey := []byte("super-secret") // Replace this with a secure key
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, token)
-	signedToken, err := jwtToken.SignedString(secretKey)
-	if err != nil {
-		log.Fatalf("Error generating token: %v", err)
-	}
-	return signedToken
+	return keyring.Sign(token)
 }
 
 // requiresAuth is a middleware for authentication
 func requiresAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cert, ok := verifiedClientCert(r); ok && certTable != nil {
+			user, reason := findCertUser(cert)
+			if user == nil {
+				audit.SetReason(r.Context(), reason)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			r = r.WithContext(audit.WithPrincipal(r.Context(), certPrincipal(user, cert)))
+
+			// Browsers present certificates on cross-site requests too, but
+			// only page scripts could send a token, so just the origin is checked
+			if !safeMethod(r.Method) {
+				if err := csrf.checkOrigin(r); err != nil {
+					rejectCSRF(w, r, err)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Browsers never add the header themselves, so API keys need no CSRF check
+		if bearer, ok := bearerToken(r); ok {
+			key, err := apiKeyStore.Verify(bearer)
+			if err != nil && err != ErrInvalidAPIKey && err != ErrAPIKeyExpired && err != ErrAPIKeyRevoked {
+				log.Printf("Error verifying API key: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if err != nil {
+				audit.SetReason(r.Context(), apiKeyReason(err))
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			user, reason := activeUser(key.UserID)
+			if user == nil {
+				audit.SetReason(r.Context(), reason)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(audit.WithPrincipal(r.Context(), apiKeyPrincipal(user, key))))
+			return
+		}
+
 		cookie, err := r.Cookie("token")
 		if err != nil || cookie == nil {
+			audit.SetReason(r.Context(), "missing_token")
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		tokenString := cookie.Value
-		secretKey := []byte("super-secret") // Replace this with a secure key
 		claims := &Token{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Method)
-			}
-			return secretKey, nil
-		})
+		token, err := jwt.ParseWithClaims(tokenString, claims, keyring.Keyfunc,
+			jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}))
 		if err != nil {
+			reason := "invalid_token"
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				reason = "token_expired"
+			}
+			audit.SetReason(r.Context(), reason)
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
 		claims, ok := token.Claims.(*Token)
-		if !ok || !token.Valid {
+		if !ok || !token.Valid || claims.Type != "" {
+			audit.SetReason(r.Context(), "invalid_token")
 			http.Error(w, "Token expired", http.StatusUnauthorized)
 			return
 		}
 
-		r = r.WithContext(context.WithValue(r.Context(), "userID", claims.UserID))
+		revoked, err := tokenStore.IsRevoked(claims.ID, claims.Family)
+		if err != nil {
+			log.Printf("Error checking token revocation: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			audit.SetReason(r.Context(), "token_revoked")
+			http.Error(w, "Token revoked", http.StatusUnauthorized)
+			return
+		}
+
+		user, reason := activeUser(claims.UserID)
+		if user == nil {
+			audit.SetReason(r.Context(), reason)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		principal := principalFor(user, audit.AuthJWT)
+		principal.TokenID = claims.ID
+		// The CSRF token is left out of the audit log like other secrets
+		if principal.Claims, err = audit.ClaimsOf(claims, "csrf"); err != nil {
+			log.Printf("Error recording token claims: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		r = r.WithContext(audit.WithPrincipal(r.Context(), principal))
+
+		// The cookie is sent on cross-site requests too, so state changes
+		// must prove they come from a page that can read the CSRF token
+		if !safeMethod(r.Method) {
+			if err := csrf.verify(r, claims); err != nil {
+				rejectCSRF(w, r, err)
+				return
+			}
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-type ResponseWriterWithStatus struct {
-	http.ResponseWriter
-	StatusCode int
-}
+// policy decides which callers may access which routes
+var policy *access.Engine
 
-func (rw *ResponseWriterWithStatus) WriteHeader(code int) {
-	rw.StatusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+// policyReason returns the audit reason code for a policy denial
+func policyReason(d access.Decision) string {
+	if d.Rule == "" {
+		return "no_matching_rule"
+	}
+	return "denied_by_rule:" + d.Rule
 }
 
 // Authorize is a middleware for authorization
 func Authorize(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userID := r.Context().Value("userID").(string)
-		// Add your authorization logic here. For simplicity, we'll just log the userID
-		log.Printf("User %s accessed path: %s", userID, r.URL.Path)
-		next.ServeHTTP(w, r)
-	})
-}
-
-// LoggingMiddleware is a middleware to log HTTP requests
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		// Wrap the ResponseWriter
-		rw := &ResponseWriterWithStatus{
-			ResponseWriter: w,
-			StatusCode:     http.StatusOK, // Default to 200 (OK) if WriteHeader is not called
+		principal, ok := audit.PrincipalFrom(r.Context())
+		if !ok {
+			audit.SetReason(r.Context(), "missing_principal")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
 
-		// Handle the request
-		next.ServeHTTP(rw, r)
+		// API keys are limited to their scopes on top of the user's access
+		if scopes, ok := principalScopes(principal); ok && !scopes.Allow(r.Method, r.URL.Path) {
+			audit.SetReason(r.Context(), "insufficient_scope")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 
-		// Create an audit log entry
-		logEntry := &AuditLog{
-			Timestamp: start,
+		decision := policy.Decide(&access.Request{
 			Method:    r.Method,
 			Path:      r.URL.Path,
-			RemoteIP:  strings.SplitN(r.RemoteAddr, ":", 2)[0],
-			UserAgent: r.UserAgent(),
-			Status:    rw.StatusCode,
+			Principal: principal,
+			RemoteIP:  auditLogger.ClientIP(r),
+			Time:      time.Now(),
+		})
+		audit.SetRule(r.Context(), decision.Rule)
+		if !decision.Allowed {
+			audit.SetReason(r.Context(), policyReason(decision))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
 		}
 
-		// Log the audit entry
-		logAudit(logEntry)
+		log.Printf("User %s accessed path: %s (rule %s)", principal.ID, r.URL.Path, decision.Rule)
+		next.ServeHTTP(w, r)
 	})
 }
 
-func logAudit(logEntry *AuditLog) {
-	b, err := json.Marshal(logEntry)
-	if err != nil {
-		log.Printf("Error marshaling audit log: %v", err)
-		return
-	}
-	log.Println(string(b))
+// keyring signs and verifies session tokens
+var keyring *Keyring
+
+// userStore holds user accounts
+var userStore UserStore
+
+// loginGuard throttles failed logins
+var loginGuard = NewLoginGuard(DefaultLoginGuardConfig)
+
+// tokenStore holds refresh tokens and revoked access tokens
+var tokenStore *TokenStore
+
+// authCapture records the bodies sent to and returned by /auth
+var authCapture = &audit.BodyCapture{
+	MaxBytes: 4096,
+	Policy:   audit.DefaultRedactionPolicy,
+}
+
+// auditLogger records every request handled by LoggingMiddleware, including
+// those refused by the authentication and authorization middleware inside it
+var auditLogger *audit.Logger
+
+// LoggingMiddleware is a middleware to log HTTP requests
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return auditLogger.Handler(next)
+}
+
+// CaptureLoggingMiddleware is LoggingMiddleware that also records redacted
+// copies of the request and response bodies.
+func CaptureLoggingMiddleware(capture *audit.BodyCapture, next http.Handler) http.Handler {
+	return auditLogger.CaptureHandler(capture, next)
 }
 
 func protectedResource(w http.ResponseWriter, r *http.Request) {
@@ -196,15 +546,270 @@ func protectedResource(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(audit.RunVerify(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		os.Exit(RunUsers(os.Args[2:]))
+	}
+
+	dbPath := flag.String("audit-db", "audit.db", "SQLite database for audit entries, users and sessions")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose forwarding headers are trusted")
+	policyPath := flag.String("policy", "policy.yaml", "YAML access policy, reloaded when it changes")
+	keyringPath := flag.String("jwt-keyring", "", "JSON keyring file for signing tokens; defaults to $JWT_KEYRING")
+	maxFailures := flag.Int("login-max-failures", DefaultLoginGuardConfig.MaxFailures, "Failed logins for a username before it is locked")
+	ipMaxFailures := flag.Int("login-ip-max-failures", DefaultLoginGuardConfig.IPMaxFailures, "Failed logins from a client IP before it is locked")
+	lockout := flag.Duration("login-lockout", DefaultLoginGuardConfig.Lockout, "How long a login lockout lasts")
+	sameSite := flag.String("cookie-samesite", "lax", "SameSite policy for session cookies: lax, strict or none")
+	retentionFlags := audit.RetentionFlags(flag.CommandLine)
+	flag.StringVar(&mfaIssuer, "mfa-issuer", mfaIssuer, "Service name shown in authenticator apps")
+	oidcConfig := flag.String("oidc-config", "", "YAML OpenID Connect provider configuration; enables /auth/oidc/login")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate to serve HTTPS with")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	clientCA := flag.String("client-ca", "", "PEM bundle of CAs whose client certificates are accepted; requires -tls-cert")
+	clientCertMap := flag.String("client-cert-map", "", "YAML table mapping client certificate subjects and SANs to users")
+	requireClientCert := flag.Bool("require-client-cert", false, "Refuse TLS connections without a valid client certificate")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma-separated origins allowed to send state-changing requests; defaults to the request host")
+	flag.Parse()
+
+	if (*clientCA != "" || *clientCertMap != "") && *tlsCert == "" {
+		log.Fatalf("Client certificates require -tls-cert")
+	}
+	if (*clientCA == "") != (*clientCertMap == "") {
+		log.Fatalf("-client-ca and -client-cert-map must be set together")
+	}
+
+	resolver, err := clientip.ParseList(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Error parsing trusted proxies: %v", err)
+	}
+	guardConfig := DefaultLoginGuardConfig
+	guardConfig.MaxFailures, guardConfig.IPMaxFailures, guardConfig.Lockout = *maxFailures, *ipMaxFailures, *lockout
+	loginGuard = NewLoginGuard(guardConfig)
+
+	if csrf.SameSite, err = ParseSameSite(*sameSite); err != nil {
+		log.Fatalf("Error parsing SameSite policy: %v", err)
+	}
+	if csrf.AllowedOrigins, err = ParseOrigins(*allowedOrigins); err != nil {
+		log.Fatalf("Error parsing allowed origins: %v", err)
+	}
+
+	if *keyringPath != "" || os.Getenv("JWT_KEYRING") != "" {
+		keyring, err = LoadKeyring(*keyringPath)
+		if err != nil {
+			log.Fatalf("Error loading JWT keyring: %v", err)
+		}
+	} else {
+		log.Printf("No JWT keyring configured; signing with an ephemeral key")
+		keyring, err = NewEphemeralKeyring()
+		if err != nil {
+			log.Fatalf("Error generating JWT key: %v", err)
+		}
+	}
+
+	if *clientCertMap != "" {
+		if certTable, err = LoadCertTable(*clientCertMap); err != nil {
+			log.Fatalf("Error loading client certificate table: %v", err)
+		}
+	}
+
+	policy, err = access.NewEngine(*policyPath)
+	if err != nil {
+		log.Fatalf("Error loading policy: %v", err)
+	}
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	go policy.Watch(2*time.Second, stopWatch)
+
+	db, err := gorm.Open("sqlite3", *dbPath)
+	if err != nil {
+		log.Fatalf("Error opening audit database: %v", err)
+	}
+	defer db.Close()
+
+	userStore, err = NewUserStore(db)
+	if err != nil {
+		log.Fatalf("Error opening user store: %v", err)
+	}
+	var userCount int
+	if db.Model(&User{}).Count(&userCount); userCount == 0 {
+		log.Printf("No users exist; create one with: %s users create -db %s -username NAME -role admin", os.Args[0], *dbPath)
+	}
+	tokenStore, err = NewTokenStore(db)
+	if err != nil {
+		log.Fatalf("Error opening token store: %v", err)
+	}
+
+	mfaStore, err = NewMFAStore(db)
+	if err != nil {
+		log.Fatalf("Error opening MFA store: %v", err)
+	}
+	apiKeyStore, err = NewAPIKeyStore(db)
+	if err != nil {
+		log.Fatalf("Error opening API key store: %v", err)
+	}
+
+	sink, err := audit.NewGormSink(db, audit.DefaultBatchOptions)
+	if err != nil {
+		log.Fatalf("Error opening audit sink: %v", err)
+	}
+	auditLogger = audit.NewLogger(sink, resolver)
+
+	var archiveIndex string
+	retention := retentionFlags()
+	if retention.MaxAge > 0 {
+		stopRetention := audit.StartRetention(db, retention, time.Hour)
+		defer stopRetention()
+	}
+	if retention.ArchiveDir != "" {
+		archiveIndex = audit.ArchiveIndexPath(retention.ArchiveDir)
+	}
+
+	// Reload the keyring file on SIGHUP so keys can be rotated without a restart
+	if *keyringPath != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				reloaded, err := LoadKeyring(*keyringPath)
+				if err != nil {
+					log.Printf("Error reloading JWT keyring: %v", err)
+					continue
+				}
+				keyring.Replace(reloaded)
+				log.Printf("Reloaded JWT keyring")
+			}
+		}()
+	}
+
+	var oidc *OIDCProvider
+	if *oidcConfig != "" {
+		cfg, err := LoadOIDCConfig(*oidcConfig)
+		if err != nil {
+			log.Fatalf("Error loading OIDC configuration: %v", err)
+		}
+		if oidc, err = NewOIDCProvider(cfg, db); err != nil {
+			log.Fatalf("Error configuring OIDC: %v", err)
+		}
+	}
+
 	r := mux.NewRouter()
-	r.HandleFunc("/auth", Authenticate).Methods("POST")
+	r.HandleFunc("/.well-known/jwks.json", keyring.JWKSHandler).Methods("GET")
+	r.Handle("/auth", CaptureLoggingMiddleware(authCapture, checkOriginMiddleware(http.HandlerFunc(Authenticate)))).Methods("POST")
+	r.Handle("/auth/refresh", LoggingMiddleware(checkOriginMiddleware(http.HandlerFunc(Refresh)))).Methods("POST")
+	r.Handle("/auth/mfa", CaptureLoggingMiddleware(authCapture, checkOriginMiddleware(http.HandlerFunc(VerifyMFA)))).Methods("POST")
+	r.Handle("/auth/mfa/enroll", LoggingMiddleware(requiresAuth(http.HandlerFunc(EnrollMFA)))).Methods("POST")
+	r.Handle("/auth/mfa/confirm", LoggingMiddleware(requiresAuth(http.HandlerFunc(ConfirmMFA)))).Methods("POST")
+	r.Handle("/auth/mfa/disable", LoggingMiddleware(requiresAuth(http.HandlerFunc(DisableMFA)))).Methods("POST")
+	if oidc != nil {
+		r.Handle("/auth/oidc/login", LoggingMiddleware(http.HandlerFunc(oidc.Login))).Methods("GET")
+		r.Handle("/auth/oidc/callback", LoggingMiddleware(http.HandlerFunc(oidc.Callback))).Methods("GET")
+	}
+	r.Handle("/auth/logout", LoggingMiddleware(requiresAuth(http.HandlerFunc(Logout)))).Methods("POST")
 	r.PathPrefix("/protected/").Methods("GET").Handler(
-		requiresAuth(
-			Authorize(
-				LoggingMiddleware(http.HandlerFunc(protectedResource)),
+		LoggingMiddleware(
+			requiresAuth(
+				Authorize(http.HandlerFunc(protectedResource)),
 			),
 		),
 	)
+	r.Handle("/admin/lockouts/users/{username}", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(UnlockUser)),
+		),
+	)).Methods("DELETE")
+	r.Handle("/admin/lockouts/ips/{ip}", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(UnlockIP)),
+		),
+	)).Methods("DELETE")
+	r.Handle("/admin/users", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(ListUsers)),
+		),
+	)).Methods("GET")
+	r.Handle("/admin/users", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(CreateUser)),
+		),
+	)).Methods("POST")
+	r.Handle("/admin/users/{id}", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(GetUser)),
+		),
+	)).Methods("GET")
+	r.Handle("/admin/users/{id}", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(UpdateUser)),
+		),
+	)).Methods("PATCH")
+	r.Handle("/admin/users/{id}", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(DeleteUser)),
+		),
+	)).Methods("DELETE")
+	r.Handle("/admin/users/{id}/password", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(ResetPassword)),
+		),
+	)).Methods("POST")
+	r.Handle("/admin/apikeys", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(ListAPIKeys)),
+		),
+	)).Methods("GET")
+	r.Handle("/admin/apikeys", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(CreateAPIKey)),
+		),
+	)).Methods("POST")
+	r.Handle("/admin/apikeys/{id}/rotate", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(RotateAPIKey)),
+		),
+	)).Methods("POST")
+	r.Handle("/admin/apikeys/{id}", LoggingMiddleware(
+		requiresAuth(
+			Authorize(http.HandlerFunc(RevokeAPIKey)),
+		),
+	)).Methods("DELETE")
+	r.Handle("/audit", LoggingMiddleware(
+		requiresAuth(
+			Authorize(audit.QueryHandler(db, archiveIndex)),
+		),
+	)).Methods("GET")
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	if *clientCA != "" {
+		cas, err := LoadClientCAs(*clientCA)
+		if err != nil {
+			log.Fatalf("Error loading client CAs: %v", err)
+		}
+		srv.TLSConfig = clientCertTLSConfig(cas, *requireClientCert)
+	}
+	go func() {
+		var err error
+		if *tlsCert != "" {
+			err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a shutdown signal so buffered audit entries can be flushed
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		log.Printf("Error closing audit sink: %v", err)
+	}
 }
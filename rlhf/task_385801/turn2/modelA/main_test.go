@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"audit"
+)
+
+func TestRequiresAuthRecordsPrincipal(t *testing.T) {
+	setupTestStores(t)
+	alice, _ := userStore.Create("alice", "correct horse", "user")
+	cookies := signIn(t, alice)
+
+	var seen *audit.Principal
+	rec, e := authed(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = audit.PrincipalFrom(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}, cookies)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got %d (%s), want 204", rec.Code, e.Reason)
+	}
+	if seen == nil || e.Principal != seen {
+		t.Fatalf("got principal %+v in the handler and %+v in the event, want the same", seen, e.Principal)
+	}
+	if e.UserID != alice.ID || e.Username != "alice" {
+		t.Errorf("got user %s (%s), want %s (alice)", e.UserID, e.Username, alice.ID)
+	}
+	p := e.Principal
+	if p.AuthMethod != audit.AuthJWT || !p.HasRole("user") || p.TokenID == "" {
+		t.Errorf("got method %q, roles %v, token %q", p.AuthMethod, p.Roles, p.TokenID)
+	}
+	if fam, _ := p.StringClaim("fam"); fam == "" {
+		t.Errorf("got claims %v, want the token family", p.Claims)
+	}
+	if _, ok := p.Claims["csrf"]; ok {
+		t.Error("the CSRF token was recorded")
+	}
+}
+
+func TestAuthorizeRequiresPrincipal(t *testing.T) {
+	setupTestStores(t)
+	handler := Authorize(http.HandlerFunc(noContent))
+	rec, e := serve(handler, httptest.NewRequest("GET", "/protected/x", nil))
+	if rec.Code != http.StatusUnauthorized || e.Reason != "missing_principal" {
+		t.Errorf("got %d (%s), want 401 (missing_principal)", rec.Code, e.Reason)
+	}
+}
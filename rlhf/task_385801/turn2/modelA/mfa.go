@@ -0,0 +1,550 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"audit"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	totpPeriod = 30 // Seconds per code
+	totpDigits = 6
+	totpSkew   = 1 // Codes from this many periods either side are accepted
+
+	mfaTokenTTL       = 5 * time.Minute
+	mfaPendingType    = "mfa_pending"
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 10 // 80 bits, 16 base32 characters
+)
+
+// Authentication method references recorded in session tokens
+const (
+	amrPassword = "pwd"
+	amrOTP      = "otp"
+	amrMFA      = "mfa"
+	amrOIDC     = "oidc" // Signed in through an OpenID provider
+)
+
+var (
+	// ErrMFANotEnrolled is returned when a user has no confirmed second factor.
+	ErrMFANotEnrolled = errors.New("MFA not enrolled")
+	// ErrMFAEnrolled is returned when enrolling a user who already has MFA.
+	ErrMFAEnrolled = errors.New("MFA already enrolled")
+	// ErrInvalidMFACode is returned for wrong, reused or unknown codes.
+	ErrInvalidMFACode = errors.New("invalid MFA code")
+)
+
+// mfaIssuer names the service in authenticator apps
+var mfaIssuer = "modal-a"
+
+// MFAEnrollment is a user's TOTP secret. It is unconfirmed until the user
+// proves their authenticator produces matching codes.
+type MFAEnrollment struct {
+	UserID    string `gorm:"primary_key"`
+	Secret    string // Base32, as shown to authenticator apps
+	Confirmed bool
+	LastStep  int64 // Time step of the last accepted code, which cannot be used again
+	CreatedAt time.Time
+}
+
+// RecoveryCode is a one-time code that stands in for a TOTP code. Only a
+// hash of the code is kept; with 80 random bits, it needs no salt or slow
+// hash to resist guessing.
+type RecoveryCode struct {
+	Hash   string `gorm:"primary_key"`
+	UserID string `gorm:"index"`
+	UsedAt *time.Time
+}
+
+// MFAStore keeps TOTP enrollments and recovery codes.
+type MFAStore struct {
+	db *gorm.DB
+}
+
+// NewMFAStore returns an MFAStore using db, creating its tables if needed.
+func NewMFAStore(db *gorm.DB) (*MFAStore, error) {
+	if err := db.AutoMigrate(&MFAEnrollment{}, &RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	return &MFAStore{db: db}, nil
+}
+
+func (s *MFAStore) find(userID string) (*MFAEnrollment, error) {
+	e := &MFAEnrollment{}
+	if err := s.db.Where("user_id = ?", userID).First(e).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, ErrMFANotEnrolled
+		}
+		return nil, err
+	}
+	return e, nil
+}
+
+// Enrolled reports whether userID has a confirmed second factor.
+func (s *MFAStore) Enrolled(userID string) (bool, error) {
+	e, err := s.find(userID)
+	if err == ErrMFANotEnrolled {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return e.Confirmed, nil
+}
+
+// Begin generates a new TOTP secret for userID, replacing any unconfirmed
+// one.
+func (s *MFAStore) Begin(userID string) (string, error) {
+	if e, err := s.find(userID); err == nil && e.Confirmed {
+		return "", ErrMFAEnrolled
+	} else if err != nil && err != ErrMFANotEnrolled {
+		return "", err
+	}
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	e := &MFAEnrollment{UserID: userID, Secret: secret, CreatedAt: time.Now()}
+	if err := s.db.Save(e).Error; err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Confirm completes enrollment if code matches the pending secret and
+// returns fresh recovery codes.
+func (s *MFAStore) Confirm(userID, code string) ([]string, error) {
+	e, err := s.find(userID)
+	if err != nil {
+		return nil, err
+	}
+	if e.Confirmed {
+		return nil, ErrMFAEnrolled
+	}
+	if err := s.accept(e, code, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(e).Update("confirmed", true).Error; err != nil {
+		return nil, err
+	}
+	return s.newRecoveryCodes(userID)
+}
+
+// Verify checks a TOTP code of a confirmed enrollment.
+func (s *MFAStore) Verify(userID, code string) error {
+	e, err := s.find(userID)
+	if err != nil {
+		return err
+	}
+	if !e.Confirmed {
+		return ErrMFANotEnrolled
+	}
+	return s.accept(e, code, time.Now())
+}
+
+// accept checks code against e's secret and records its time step so that
+// it cannot be replayed.
+func (s *MFAStore) accept(e *MFAEnrollment, code string, now time.Time) error {
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(e.Secret)
+	if err != nil {
+		return err
+	}
+	step, ok := totpMatch(secret, code, now, e.LastStep)
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	// Claim the step atomically so concurrent logins cannot share a code
+	res := s.db.Model(&MFAEnrollment{}).
+		Where("user_id = ? AND last_step < ?", e.UserID, step).
+		Update("last_step", step)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// UseRecoveryCode consumes one of userID's recovery codes.
+func (s *MFAStore) UseRecoveryCode(userID, code string) error {
+	code = normalizeRecoveryCode(code)
+	if len(code) != base32.StdEncoding.EncodedLen(recoveryCodeBytes) {
+		return ErrInvalidMFACode
+	}
+	res := s.db.Model(&RecoveryCode{}).
+		Where("hash = ? AND user_id = ? AND used_at IS NULL", hashToken(code), userID).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// RemainingRecoveryCodes returns how many unused recovery codes userID has.
+func (s *MFAStore) RemainingRecoveryCodes(userID string) (int, error) {
+	var count int
+	err := s.db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// Disable removes userID's second factor and recovery codes.
+func (s *MFAStore) Disable(userID string) error {
+	if err := s.db.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	return s.db.Where("user_id = ?", userID).Delete(&MFAEnrollment{}).Error
+}
+
+// newRecoveryCodes replaces userID's recovery codes.
+func (s *MFAStore) newRecoveryCodes(userID string) ([]string, error) {
+	if err := s.db.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		rc := &RecoveryCode{Hash: hashToken(code), UserID: userID}
+		if err := s.db.Create(rc).Error; err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode drops the separator and case users may type
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
+
+// totpCode returns the RFC 6238 code of secret for a time step, using
+// HMAC-SHA1 as authenticator apps expect.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// totpMatch returns the time step code is valid for at now, allowing for
+// clock skew. Steps up to and including after are not accepted.
+func totpMatch(secret []byte, code string, now time.Time, after int64) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= after {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// provisioningURI returns the otpauth URI authenticator apps scan as a QR
+// code.
+func provisioningURI(username, secret string) string {
+	label := url.PathEscape(mfaIssuer + ":" + username)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", mfaIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// mfaStore holds second factors
+var mfaStore *MFAStore
+
+// mfaChallenge is the response to a correct password from a user with MFA
+type mfaChallenge struct {
+	Required bool   `json:"mfa_required"`
+	Token    string `json:"mfa_token"`
+}
+
+// mfaRequest is the body of a second factor step. Exactly one of OTP and
+// RecoveryCode is set.
+type mfaRequest struct {
+	Token        string `json:"mfa_token"`
+	OTP          string `json:"otp"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// generateMFAToken issues the short-lived token that proves userID passed
+// the password step. It is not a session and requiresAuth refuses it.
+func generateMFAToken(userID string) (string, error) {
+	jti, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return keyring.Sign(&Token{
+		UserID: userID,
+		Type:   mfaPendingType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+}
+
+// VerifyMFA upgrades an MFA pending token to a session after a valid TOTP
+// or recovery code
+func VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	var req mfaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if (req.OTP == "") == (req.RecoveryCode == "") {
+		http.Error(w, "Exactly one of otp and recovery_code is required", http.StatusBadRequest)
+		return
+	}
+
+	claims := &Token{}
+	token, err := jwt.ParseWithClaims(req.Token, claims, keyring.Keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}))
+	if err != nil || !token.Valid || claims.Type != mfaPendingType {
+		reason := "invalid_mfa_token"
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			reason = "mfa_token_expired"
+		}
+		audit.SetReason(r.Context(), reason)
+		http.Error(w, "Invalid MFA token", http.StatusUnauthorized)
+		return
+	}
+	revoked, err := tokenStore.IsTokenRevoked(claims.ID)
+	if err != nil {
+		log.Printf("Error checking token revocation: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		audit.SetReason(r.Context(), "mfa_token_used")
+		http.Error(w, "Invalid MFA token", http.StatusUnauthorized)
+		return
+	}
+	user, reason := activeUser(claims.UserID)
+	if user == nil {
+		audit.SetReason(r.Context(), reason)
+		http.Error(w, "Invalid MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	// Wrong codes count as failed logins, so guessing is locked out too
+	ip := auditLogger.ClientIP(r)
+	attempt := beginAttempt(w, r, user.Username, ip)
+	if attempt == nil {
+		return
+	}
+	defer attempt.Release()
+
+	method, amr := audit.AuthTOTP, []string{amrPassword, amrOTP, amrMFA}
+	if req.OTP != "" {
+		err = mfaStore.Verify(user.ID, req.OTP)
+	} else {
+		method, amr = audit.AuthRecoveryCode, []string{amrPassword, amrMFA}
+		err = mfaStore.UseRecoveryCode(user.ID, req.RecoveryCode)
+	}
+	audit.WithPrincipal(r.Context(), principalFor(user, method))
+	if err == ErrInvalidMFACode || err == ErrMFANotEnrolled {
+		reason := "invalid_mfa_code"
+		if attempt.Fail() {
+			reason = "invalid_mfa_code_lockout"
+			log.Printf("Locked out login for %q from %s", user.Username, ip)
+		}
+		audit.SetReason(r.Context(), reason)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error verifying MFA code: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	attempt.Succeed()
+
+	// The pending token is spent once it has been upgraded
+	if err := tokenStore.Revoke(claims.ID, claims.ExpiresAt.Time); err != nil {
+		log.Printf("Error revoking MFA token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if method == audit.AuthRecoveryCode {
+		if remaining, err := mfaStore.RemainingRecoveryCodes(user.ID); err == nil && remaining <= 2 {
+			log.Printf("User %s has %d recovery codes left", user.ID, remaining)
+		}
+	}
+
+	family, err := randomID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := issueSession(w, user.ID, family, "", amr); err != nil {
+		log.Printf("Error issuing session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// mfaEnrollment is the response to starting enrollment
+type mfaEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// sessionPrincipal returns the caller if they signed in with a session. A
+// second factor guards the user's sessions, so API keys and client
+// certificates, which bypass it, cannot manage it.
+func sessionPrincipal(w http.ResponseWriter, r *http.Request) (*audit.Principal, bool) {
+	principal, ok := audit.PrincipalFrom(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	if principal.AuthMethod != audit.AuthJWT {
+		audit.SetReason(r.Context(), "no_session")
+		http.Error(w, "MFA can only be managed from a session", http.StatusForbidden)
+		return nil, false
+	}
+	return principal, true
+}
+
+// EnrollMFA starts TOTP enrollment for the caller
+func EnrollMFA(w http.ResponseWriter, r *http.Request) {
+	principal, ok := sessionPrincipal(w, r)
+	if !ok {
+		return
+	}
+	secret, err := mfaStore.Begin(principal.ID)
+	if err == ErrMFAEnrolled {
+		http.Error(w, "MFA already enrolled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error starting MFA enrollment: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, mfaEnrollment{secret, provisioningURI(principal.Username, secret)})
+}
+
+// ConfirmMFA completes enrollment with a code from the caller's
+// authenticator and returns their recovery codes
+func ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	principal, ok := sessionPrincipal(w, r)
+	if !ok {
+		return
+	}
+	var req mfaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OTP == "" {
+		http.Error(w, "otp is required", http.StatusBadRequest)
+		return
+	}
+	codes, err := mfaStore.Confirm(principal.ID, req.OTP)
+	switch err {
+	case nil:
+	case ErrMFANotEnrolled:
+		http.Error(w, "No MFA enrollment in progress", http.StatusConflict)
+		return
+	case ErrMFAEnrolled:
+		http.Error(w, "MFA already enrolled", http.StatusConflict)
+		return
+	case ErrInvalidMFACode:
+		audit.SetReason(r.Context(), "invalid_mfa_code")
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	default:
+		log.Printf("Error confirming MFA enrollment: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s enrolled in MFA", principal.ID)
+	writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// DisableMFA removes the caller's second factor after a current code
+func DisableMFA(w http.ResponseWriter, r *http.Request) {
+	principal, ok := sessionPrincipal(w, r)
+	if !ok {
+		return
+	}
+	var req mfaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OTP == "" {
+		http.Error(w, "otp is required", http.StatusBadRequest)
+		return
+	}
+
+	// Wrong codes count as failed logins, so a stolen session cannot be
+	// used to guess its way to removing the second factor
+	ip := auditLogger.ClientIP(r)
+	attempt := beginAttempt(w, r, principal.Username, ip)
+	if attempt == nil {
+		return
+	}
+	defer attempt.Release()
+
+	err := mfaStore.Verify(principal.ID, req.OTP)
+	if err == ErrInvalidMFACode || err == ErrMFANotEnrolled {
+		reason := "invalid_mfa_code"
+		if attempt.Fail() {
+			reason = "invalid_mfa_code_lockout"
+			log.Printf("Locked out login for %q from %s", principal.Username, ip)
+		}
+		audit.SetReason(r.Context(), reason)
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = mfaStore.Disable(principal.ID)
+	}
+	if err != nil {
+		log.Printf("Error disabling MFA: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	attempt.Succeed()
+	log.Printf("User %s disabled MFA", principal.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"audit"
+)
+
+// enrollTestMFA creates username with password and a confirmed second
+// factor, and returns the TOTP secret and recovery codes.
+func enrollTestMFA(t *testing.T, username, password string) (*User, []byte, []string) {
+	t.Helper()
+	user, err := userStore.Create(username, password, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := mfaStore.Begin(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := mfaStore.Confirm(user.ID, totpCode(secret, time.Now().Unix()/totpPeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, secret, codes
+}
+
+// postJSON calls handler with body as a JSON POST.
+func postJSON(handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/", strings.NewReader(string(b)))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestPasswordLoginDoesNotResetMFAFailures(t *testing.T) {
+	setupTestStores(t)
+	loginGuard = NewLoginGuard(LoginGuardConfig{MaxFailures: 3, IPMaxFailures: 100, Lockout: time.Minute, MaxEntries: 100})
+	enrollTestMFA(t, "alice", "correct horse")
+
+	for i := 0; i < 3; i++ {
+		rec := postJSON(Authenticate, Credentials{Username: "alice", Password: "correct horse"})
+		var challenge mfaChallenge
+		if err := json.NewDecoder(rec.Body).Decode(&challenge); err != nil || !challenge.Required {
+			t.Fatalf("round %d: got %d, want an MFA challenge", i, rec.Code)
+		}
+		rec = postJSON(VerifyMFA, mfaRequest{Token: challenge.Token, RecoveryCode: "aaaa-aaaa-aaaa-aaaa"})
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("round %d: wrong code got %d, want 401", i, rec.Code)
+		}
+	}
+
+	rec := postJSON(Authenticate, Credentials{Username: "alice", Password: "correct horse"})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("after 3 wrong codes: got %d, want 429", rec.Code)
+	}
+}
+
+func TestMFASuccessClearsFailures(t *testing.T) {
+	setupTestStores(t)
+	loginGuard = NewLoginGuard(LoginGuardConfig{MaxFailures: 2, IPMaxFailures: 100, Lockout: time.Minute, MaxEntries: 100})
+	_, _, codes := enrollTestMFA(t, "alice", "correct horse")
+
+	login := func(code string) int {
+		rec := postJSON(Authenticate, Credentials{Username: "alice", Password: "correct horse"})
+		var challenge mfaChallenge
+		json.NewDecoder(rec.Body).Decode(&challenge)
+		return postJSON(VerifyMFA, mfaRequest{Token: challenge.Token, RecoveryCode: code}).Code
+	}
+	if got := login("aaaa-aaaa-aaaa-aaaa"); got != http.StatusUnauthorized {
+		t.Fatalf("wrong code: got %d, want 401", got)
+	}
+	if got := login(codes[0]); got != http.StatusOK {
+		t.Fatalf("recovery code: got %d, want 200", got)
+	}
+	// The earlier failure was cleared, so one more does not lock
+	if got := login("aaaa-aaaa-aaaa-aaaa"); got != http.StatusUnauthorized {
+		t.Fatalf("wrong code: got %d, want 401", got)
+	}
+	if got := login(codes[1]); got != http.StatusOK {
+		t.Errorf("recovery code after one failure: got %d, want 200", got)
+	}
+}
+
+// asPrincipal calls handler with body as a JSON POST made by user, signed in
+// with method.
+func asPrincipal(handler http.HandlerFunc, user *User, method string, body interface{}) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/", strings.NewReader(string(b)))
+	req.Header.Set("Content-Type", "application/json")
+	principal := &audit.Principal{ID: user.ID, Username: user.Username, AuthMethod: method}
+	req = req.WithContext(audit.WithPrincipal(req.Context(), principal))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestMFARequiresSession(t *testing.T) {
+	setupTestStores(t)
+	user, secret, _ := enrollTestMFA(t, "alice", "correct horse")
+	otp := mfaRequest{OTP: totpCode(secret, time.Now().Unix()/totpPeriod)}
+
+	for _, method := range []string{audit.AuthAPIKey, audit.AuthClientCert} {
+		for name, handler := range map[string]http.HandlerFunc{"enroll": EnrollMFA, "confirm": ConfirmMFA, "disable": DisableMFA} {
+			if rec := asPrincipal(handler, user, method, otp); rec.Code != http.StatusForbidden {
+				t.Errorf("%s with %s: got %d, want 403", name, method, rec.Code)
+			}
+		}
+	}
+	if enrolled, err := mfaStore.Enrolled(user.ID); err != nil || !enrolled {
+		t.Errorf("MFA no longer enrolled (%v)", err)
+	}
+}
+
+func TestDisableMFAThrottlesWrongCodes(t *testing.T) {
+	setupTestStores(t)
+	loginGuard = NewLoginGuard(LoginGuardConfig{MaxFailures: 3, IPMaxFailures: 100, Lockout: time.Minute, MaxEntries: 100})
+	user, secret, _ := enrollTestMFA(t, "alice", "correct horse")
+	code := totpCode(secret, time.Now().Unix()/totpPeriod)
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := asPrincipal(DisableMFA, user, audit.AuthJWT, mfaRequest{OTP: wrong}); rec.Code != http.StatusBadRequest {
+			t.Fatalf("attempt %d: got %d, want 400", i, rec.Code)
+		}
+	}
+	rec := asPrincipal(DisableMFA, user, audit.AuthJWT, mfaRequest{OTP: code})
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("right code after lockout: got %d, want 429 with Retry-After", rec.Code)
+	}
+	if enrolled, err := mfaStore.Enrolled(user.ID); err != nil || !enrolled {
+		t.Errorf("MFA disabled during lockout (%v)", err)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	setupTestStores(t)
+	user, _, codes := enrollTestMFA(t, "alice", "correct horse")
+
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 19 || strings.Count(code, "-") != 3 || seen[code] {
+			t.Errorf("got code %q, want unique codes like xxxx-xxxx-xxxx-xxxx", code)
+		}
+		seen[code] = true
+	}
+
+	// Codes are accepted once, in any case and without separators
+	typed := strings.ToUpper(strings.Replace(codes[0], "-", "", -1))
+	if err := mfaStore.UseRecoveryCode(user.ID, typed); err != nil {
+		t.Errorf("got %v for %q, want it accepted", err, typed)
+	}
+	if err := mfaStore.UseRecoveryCode(user.ID, codes[0]); err != ErrInvalidMFACode {
+		t.Errorf("reused code: got %v, want ErrInvalidMFACode", err)
+	}
+	if err := mfaStore.UseRecoveryCode(user.ID, codes[1][:9]); err != ErrInvalidMFACode {
+		t.Errorf("truncated code: got %v, want ErrInvalidMFACode", err)
+	}
+	if remaining, err := mfaStore.RemainingRecoveryCodes(user.ID); err != nil || remaining != recoveryCodeCount-1 {
+		t.Errorf("got %d remaining (%v), want %d", remaining, err, recoveryCodeCount-1)
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"audit"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jinzhu/gorm"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcLoginTTL    = 10 * time.Minute
+	oidcMaxLogins   = 10000       // Pending logins; more are refused until some finish or expire
+	oidcKeyRefresh  = time.Minute // Shortest time between JWKS fetches for unknown kids
+)
+
+// OIDCConfig configures login through an OpenID Connect provider. It is read
+// from YAML.
+type OIDCConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"` // $OIDC_CLIENT_SECRET if empty; none for public clients
+	RedirectURL  string   `yaml:"redirect_url"`  // This server's /auth/oidc/callback
+	Scopes       []string `yaml:"scopes"`        // openid, profile and email if empty
+
+	// UsernameClaim names the claim new users are named after;
+	// preferred_username, falling back to email, if empty
+	UsernameClaim string `yaml:"username_claim"`
+
+	// RoleClaim names a claim listing the user's groups, such as "groups".
+	// Roles maps groups to local roles; the first group that maps wins, and
+	// users are updated on every login.
+	RoleClaim   string            `yaml:"role_claim"`
+	Roles       map[string]string `yaml:"roles"`
+	DefaultRole string            `yaml:"default_role"` // "user" if empty
+
+	// TrustedAMR lists the provider's authentication methods, such as "mfa",
+	// that carry over to sessions, so that a second factor there satisfies
+	// rules requiring one here. List only methods the provider enforces;
+	// sessions record just "oidc" otherwise.
+	TrustedAMR []string `yaml:"trusted_amr"`
+}
+
+// LoadOIDCConfig reads and validates the OIDC configuration at path.
+func LoadOIDCConfig(path string) (*OIDCConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &OIDCConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if cfg.ClientSecret == "" {
+		cfg.ClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	}
+	return cfg, cfg.validate()
+}
+
+func (c *OIDCConfig) validate() error {
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return errors.New("issuer, client_id and redirect_url are required")
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "profile", "email"}
+	}
+	if c.UsernameClaim == "" {
+		c.UsernameClaim = "preferred_username"
+	}
+	if c.DefaultRole == "" {
+		c.DefaultRole = "user"
+	}
+	if verr := validateRole(c.DefaultRole); verr != nil {
+		return fmt.Errorf("default_role %q %s", c.DefaultRole, verr.Error)
+	}
+	for group, role := range c.Roles {
+		if verr := validateRole(role); verr != nil {
+			return fmt.Errorf("roles: %s maps to %q, which %s", group, role, verr.Error)
+		}
+	}
+	return nil
+}
+
+// ExternalIdentity links a user to their subject at an identity provider.
+type ExternalIdentity struct {
+	Issuer      string `gorm:"primary_key"`
+	Subject     string `gorm:"primary_key"`
+	UserID      string `gorm:"index"`
+	CreatedAt   time.Time
+	LastLoginAt time.Time
+}
+
+// oidcLogin is a login started at the provider and not yet returned from.
+type oidcLogin struct {
+	verifier string // PKCE code verifier
+	nonce    string
+	returnTo string
+	expires  time.Time
+}
+
+// OIDCProvider runs the authorization code flow with PKCE against an OpenID
+// provider and signs its users in, creating them on first login.
+type OIDCProvider struct {
+	cfg    *OIDCConfig
+	db     *gorm.DB
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	logins    map[string]*oidcLogin // By state
+	maxLogins int
+}
+
+// oidcDiscovery is the part of the provider metadata the flow uses.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDCProvider returns an OIDCProvider for cfg that links users in db,
+// whose tables the UserStore creates. The provider's metadata is fetched on
+// first use.
+func NewOIDCProvider(cfg *OIDCConfig, db *gorm.DB) (*OIDCProvider, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &OIDCProvider{
+		cfg:       cfg,
+		db:        db,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		logins:    make(map[string]*oidcLogin),
+		maxLogins: oidcMaxLogins,
+	}, nil
+}
+
+func (p *OIDCProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// metadata returns the provider's endpoints, fetching them once.
+func (p *OIDCProvider) metadata() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	d := &oidcDiscovery{}
+	if err := p.getJSON(strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("provider issuer %q does not match %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("provider metadata is missing endpoints")
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// keyfunc finds the provider key that signed an ID token, fetching the key
+// set again when it meets a kid it does not know, as after a key rotation.
+func (p *OIDCProvider) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	d, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[kid]
+	if !ok && time.Since(p.fetchedAt) > oidcKeyRefresh {
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		if err := p.getJSON(d.JWKSURI, &set); err != nil {
+			return nil, err
+		}
+		p.keys, p.fetchedAt = make(map[string]crypto.PublicKey), time.Now()
+		for _, k := range set.Keys {
+			if k.Use != "" && k.Use != "sig" {
+				continue
+			}
+			pub, err := fromJWK(k)
+			if err != nil {
+				log.Printf("Skipping provider key %q: %v", k.Kid, err)
+				continue
+			}
+			p.keys[k.Kid] = pub
+		}
+		key, ok = p.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if _, err := signingMethod(token.Method.Alg(), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// pkceChallenge returns the S256 code challenge of verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// safeReturnTo reports whether to is a path on this server, so that the
+// login cannot be used to redirect elsewhere.
+func safeReturnTo(to string) bool {
+	return strings.HasPrefix(to, "/") && !strings.HasPrefix(to, "//") && !strings.HasPrefix(to, "/\\")
+}
+
+// Login redirects the browser to the provider to sign in
+func (p *OIDCProvider) Login(w http.ResponseWriter, r *http.Request) {
+	d, err := p.metadata()
+	if err != nil {
+		log.Printf("Error fetching OIDC provider metadata: %v", err)
+		audit.SetReason(r.Context(), "oidc_unavailable")
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	returnTo := r.URL.Query().Get("return_to")
+	if !safeReturnTo(returnTo) {
+		returnTo = "/"
+	}
+
+	var state, nonce, verifier string
+	for _, v := range []*string{&state, &nonce, &verifier} {
+		if *v, err = randomID(); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	now := time.Now()
+	p.mu.Lock()
+	for s, l := range p.logins {
+		if now.After(l.expires) {
+			delete(p.logins, s)
+		}
+	}
+	if len(p.logins) >= p.maxLogins {
+		p.mu.Unlock()
+		log.Printf("Refusing OIDC login: %d logins pending", p.maxLogins)
+		audit.SetReason(r.Context(), "oidc_too_many_logins")
+		http.Error(w, "Too many logins in progress", http.StatusServiceUnavailable)
+		return
+	}
+	p.logins[state] = &oidcLogin{verifier: verifier, nonce: nonce, returnTo: returnTo, expires: now.Add(oidcLoginTTL)}
+	p.mu.Unlock()
+
+	// The state is also bound to the browser, so a login started elsewhere
+	// cannot be completed here. Lax lets it through the provider's redirect.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		HttpOnly: true,
+		Secure:   true,
+		Path:     "/auth/oidc",
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcLoginTTL / time.Second),
+	})
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	if hint := r.URL.Query().Get("login_hint"); hint != "" {
+		q.Set("login_hint", hint)
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// Callback completes a login when the provider redirects back, issuing a
+// session for the local user
+func (p *OIDCProvider) Callback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		audit.SetReason(r.Context(), "oidc_error:"+e)
+		http.Error(w, "Login failed at the identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	state := q.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		audit.SetReason(r.Context(), "oidc_state_mismatch")
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc", MaxAge: -1, Secure: true, HttpOnly: true})
+	p.mu.Lock()
+	login, ok := p.logins[state]
+	delete(p.logins, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		audit.SetReason(r.Context(), "oidc_state_expired")
+		http.Error(w, "Login expired", http.StatusBadRequest)
+		return
+	}
+
+	idToken, err := p.exchange(q.Get("code"), login.verifier)
+	if err != nil {
+		log.Printf("Error exchanging OIDC code: %v", err)
+		audit.SetReason(r.Context(), "oidc_exchange_failed")
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := p.verifyIDToken(idToken, login.nonce)
+	if err != nil {
+		log.Printf("Rejected OIDC ID token: %v", err)
+		audit.SetReason(r.Context(), "oidc_invalid_id_token")
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	user, reason, err := p.userFor(claims)
+	if err != nil {
+		log.Printf("Error mapping OIDC user: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		audit.SetReason(r.Context(), reason)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	principal := principalFor(user, audit.AuthOIDC)
+	principal.Claims = map[string]interface{}(claims)
+	delete(principal.Claims, "nonce")
+	audit.WithPrincipal(r.Context(), principal)
+
+	amr := append([]string{amrOIDC}, p.trustedAMR(claims)...)
+	family, err := randomID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := issueSession(w, user.ID, family, "", amr); err != nil {
+		log.Printf("Error issuing session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, login.returnTo, http.StatusSeeOther)
+}
+
+// trustedAMR returns the authentication methods in claims that the
+// configuration trusts the provider to report.
+func (p *OIDCProvider) trustedAMR(claims jwt.MapClaims) []string {
+	list, _ := claims["amr"].([]interface{})
+	var amr []string
+	for _, v := range list {
+		s, _ := v.(string)
+		for _, trusted := range p.cfg.TrustedAMR {
+			if s == trusted && s != amrOIDC {
+				amr = append(amr, s)
+				break
+			}
+		}
+	}
+	return amr
+}
+
+// exchange redeems an authorization code for the ID token.
+func (p *OIDCProvider) exchange(code, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing code")
+	}
+	d, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.cfg.ClientID)
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s: %s", resp.Status, body.Error)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks an ID token's signature, issuer, audience, expiry
+// and nonce, and returns its claims.
+func (p *OIDCProvider) verifyIDToken(raw, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, p.keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(30*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.cfg.ClientID {
+			return nil, errors.New("azp does not name this client")
+		}
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("missing sub")
+	}
+	return claims, nil
+}
+
+// roleFor returns the local role for the groups in claims
+func (p *OIDCProvider) roleFor(claims jwt.MapClaims) string {
+	if p.cfg.RoleClaim == "" {
+		return p.cfg.DefaultRole
+	}
+	var groups []interface{}
+	switch v := claims[p.cfg.RoleClaim].(type) {
+	case []interface{}:
+		groups = v
+	case string:
+		groups = []interface{}{v}
+	}
+	for _, g := range groups {
+		if s, ok := g.(string); ok && p.cfg.Roles[s] != "" {
+			return p.cfg.Roles[s]
+		}
+	}
+	return p.cfg.DefaultRole
+}
+
+// userFor returns the user linked to the ID token's subject, creating one
+// on first login. A nil user comes with the audit reason code it was
+// refused for.
+func (p *OIDCProvider) userFor(claims jwt.MapClaims) (*User, string, error) {
+	sub, _ := claims["sub"].(string)
+	role := p.roleFor(claims)
+	now := time.Now()
+
+	link := &ExternalIdentity{}
+	err := p.db.Where("issuer = ? AND subject = ?", p.cfg.Issuer, sub).First(link).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, "", err
+	}
+	if err == nil {
+		user, err := userStore.FindByID(link.UserID)
+		if err == ErrUserNotFound {
+			return nil, "oidc_user_deleted", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if user.Disabled {
+			return nil, "user_disabled", nil
+		}
+		if p.cfg.RoleClaim != "" && user.Role != role {
+			log.Printf("Changing role of %s from %s to %s from OIDC claims", user.ID, user.Role, role)
+			if err := userStore.SetRole(user.ID, role); err != nil {
+				return nil, "", err
+			}
+			user.Role = role
+		}
+		return user, "", p.db.Model(link).Update("last_login_at", now).Error
+	}
+
+	username, _ := claims[p.cfg.UsernameClaim].(string)
+	if username == "" {
+		username, _ = claims["email"].(string)
+	}
+	if username == "" {
+		return nil, "oidc_missing_username", nil
+	}
+	if verr := validateUsername(username); verr != nil {
+		log.Printf("OIDC subject %s wants username %q, which %s", sub, username, verr.Error)
+		return nil, "oidc_invalid_username", nil
+	}
+	// A local account with the same name is not taken over; an admin has to
+	// link or rename it
+	user, err := userStore.CreateExternal(username, role)
+	if err == ErrUserExists {
+		log.Printf("OIDC subject %s wants username %q, which is taken", sub, username)
+		return nil, "oidc_username_taken", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	log.Printf("Created user %s (%s) for OIDC subject %s", user.ID, user.Username, sub)
+	link = &ExternalIdentity{Issuer: p.cfg.Issuer, Subject: sub, UserID: user.ID, CreatedAt: now, LastLoginAt: now}
+	return user, "", p.db.Create(link).Error
+}
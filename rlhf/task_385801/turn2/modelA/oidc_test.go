@@ -0,0 +1,283 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// oidcTest runs an OIDCProvider against a FakeIdP.
+type oidcTest struct {
+	t        *testing.T
+	provider *OIDCProvider
+	idp      *FakeIdP
+	client   *http.Client // Stops at the provider's redirect back
+}
+
+func newOIDCTest(t *testing.T, trustedAMR ...string) *oidcTest {
+	t.Helper()
+	db, _ := setupTestStores(t)
+	var idp *FakeIdP
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idp.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	idp, err := NewFakeIdP(srv.URL, "modal-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.Users["root"] = map[string]interface{}{
+		"groups": []string{"staff", "admins"},
+		"amr":    []string{"pwd", "mfa", "hwk"},
+	}
+	provider, err := NewOIDCProvider(&OIDCConfig{
+		Issuer:      srv.URL,
+		ClientID:    "modal-a",
+		RedirectURL: "http://app.test/auth/oidc/callback",
+		RoleClaim:   "groups",
+		Roles:       map[string]string{"admins": "admin"},
+		TrustedAMR:  trustedAMR,
+	}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := srv.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	return &oidcTest{t: t, provider: provider, idp: idp, client: client}
+}
+
+// login starts a login as username and returns the provider's
+// authorization URL and the state cookie.
+func (o *oidcTest) login(username string) (*url.URL, *http.Cookie) {
+	o.t.Helper()
+	rec := httptest.NewRecorder()
+	o.provider.Login(rec, httptest.NewRequest("GET", "/auth/oidc/login?return_to=/home&login_hint="+username, nil))
+	if rec.Code != http.StatusFound {
+		o.t.Fatalf("login: got %d, want 302", rec.Code)
+	}
+	to, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		o.t.Fatal("login set no state cookie")
+	}
+	return to, cookie
+}
+
+// authorize visits the provider and returns where it sends the browser back.
+func (o *oidcTest) authorize(to *url.URL) *url.URL {
+	o.t.Helper()
+	resp, err := o.client.Get(to.String())
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := resp.Location()
+	if err != nil {
+		o.t.Fatalf("authorize: got %s, want a redirect back", resp.Status)
+	}
+	return back
+}
+
+// callback returns to the server from the provider.
+func (o *oidcTest) callback(back *url.URL, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", back.RequestURI(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	o.provider.Callback(rec, req)
+	return rec
+}
+
+// signIn runs the whole flow as username and returns the session token.
+func (o *oidcTest) signIn(username string) *Token {
+	o.t.Helper()
+	to, cookie := o.login(username)
+	rec := o.callback(o.authorize(to), cookie)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/home" {
+		o.t.Fatalf("callback: got %d to %q, want 303 to /home", rec.Code, rec.Header().Get("Location"))
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "token" {
+			claims := &Token{}
+			if _, err := jwt.ParseWithClaims(c.Value, claims, keyring.Keyfunc); err != nil {
+				o.t.Fatal(err)
+			}
+			return claims
+		}
+	}
+	o.t.Fatal("callback set no session")
+	return nil
+}
+
+// withQuery returns u with key set to value.
+func withQuery(u *url.URL, key, value string) *url.URL {
+	changed := *u
+	q := changed.Query()
+	q.Set(key, value)
+	changed.RawQuery = q.Encode()
+	return &changed
+}
+
+func TestOIDCLoginCreatesAndMapsUsers(t *testing.T) {
+	o := newOIDCTest(t)
+
+	session := o.signIn("bob")
+	bob, err := userStore.FindByUsername("bob")
+	if err != nil {
+		t.Fatalf("user not created: %v", err)
+	}
+	if session.UserID != bob.ID || bob.Role != "user" {
+		t.Errorf("got session for %s and role %s, want %s and user", session.UserID, bob.Role, bob.ID)
+	}
+	if len(session.AMR) != 1 || session.AMR[0] != amrOIDC {
+		t.Errorf("got amr %v, want [oidc]", session.AMR)
+	}
+
+	// Later logins find the same user and follow group changes
+	o.idp.Users["bob"] = map[string]interface{}{"groups": []string{"admins"}}
+	if again := o.signIn("bob"); again.UserID != bob.ID {
+		t.Errorf("second login: got user %s, want %s", again.UserID, bob.ID)
+	}
+	if bob, _ = userStore.FindByID(bob.ID); bob.Role != "admin" {
+		t.Errorf("got role %s after joining admins, want admin", bob.Role)
+	}
+
+	// A local account is not taken over
+	if _, err := userStore.Create("carol", "correct horse", "user"); err != nil {
+		t.Fatal(err)
+	}
+	to, cookie := o.login("carol")
+	if rec := o.callback(o.authorize(to), cookie); rec.Code != http.StatusForbidden {
+		t.Errorf("taken username: got %d, want 403", rec.Code)
+	}
+}
+
+func TestOIDCTrustedAMR(t *testing.T) {
+	tests := []struct {
+		trusted []string
+		want    []string
+	}{
+		{nil, []string{"oidc"}},
+		{[]string{"mfa"}, []string{"oidc", "mfa"}},
+		{[]string{"mfa", "hwk", "oidc"}, []string{"oidc", "mfa", "hwk"}},
+	}
+	for _, tt := range tests {
+		o := newOIDCTest(t, tt.trusted...)
+		session := o.signIn("root")
+		if len(session.AMR) != len(tt.want) {
+			t.Errorf("trusting %v: got amr %v, want %v", tt.trusted, session.AMR, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if session.AMR[i] != tt.want[i] {
+				t.Errorf("trusting %v: got amr %v, want %v", tt.trusted, session.AMR, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	o := newOIDCTest(t)
+
+	t.Run("wrong state", func(t *testing.T) {
+		to, cookie := o.login("bob")
+		back := withQuery(o.authorize(to), "state", "forged")
+		if rec := o.callback(back, cookie); rec.Code != http.StatusBadRequest {
+			t.Errorf("got %d, want 400", rec.Code)
+		}
+	})
+	t.Run("no state cookie", func(t *testing.T) {
+		to, _ := o.login("bob")
+		if rec := o.callback(o.authorize(to), nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("got %d, want 400", rec.Code)
+		}
+	})
+	t.Run("wrong nonce", func(t *testing.T) {
+		to, cookie := o.login("bob")
+		back := o.authorize(withQuery(to, "nonce", "forged"))
+		if rec := o.callback(back, cookie); rec.Code != http.StatusUnauthorized {
+			t.Errorf("got %d, want 401", rec.Code)
+		}
+	})
+	t.Run("wrong verifier", func(t *testing.T) {
+		to, cookie := o.login("bob")
+		back := o.authorize(withQuery(to, "code_challenge", pkceChallenge("forged")))
+		if rec := o.callback(back, cookie); rec.Code != http.StatusBadGateway {
+			t.Errorf("got %d, want 502", rec.Code)
+		}
+	})
+	t.Run("code reuse", func(t *testing.T) {
+		to, cookie := o.login("bob")
+		back := o.authorize(to)
+		o.provider.mu.Lock()
+		verifier := o.provider.logins[cookie.Value].verifier
+		o.provider.mu.Unlock()
+		if rec := o.callback(back, cookie); rec.Code != http.StatusSeeOther {
+			t.Fatalf("got %d, want 303", rec.Code)
+		}
+		// Both the state and the code are spent
+		if rec := o.callback(back, cookie); rec.Code != http.StatusBadRequest {
+			t.Errorf("replayed callback: got %d, want 400", rec.Code)
+		}
+		if _, err := o.provider.exchange(back.Query().Get("code"), verifier); err == nil {
+			t.Error("code was redeemed twice")
+		}
+	})
+}
+
+func TestOIDCRefusesInvalidUsernames(t *testing.T) {
+	o := newOIDCTest(t)
+	to, cookie := o.login("ab")
+	if rec := o.callback(o.authorize(to), cookie); rec.Code != http.StatusForbidden {
+		t.Errorf("got %d, want 403", rec.Code)
+	}
+	if _, err := userStore.FindByUsername("ab"); err != ErrUserNotFound {
+		t.Errorf("got %v looking up the user, want ErrUserNotFound", err)
+	}
+}
+
+func TestOIDCConfigRejectsInvalidRoles(t *testing.T) {
+	tests := []*OIDCConfig{
+		{Roles: map[string]string{"admins": "Admin"}},
+		{DefaultRole: "power user"},
+	}
+	for _, cfg := range tests {
+		cfg.Issuer, cfg.ClientID, cfg.RedirectURL = "https://idp.test", "modal-a", "https://app.test/auth/oidc/callback"
+		if err := cfg.validate(); err == nil {
+			t.Errorf("roles %v and default %q: got no error", cfg.Roles, cfg.DefaultRole)
+		}
+	}
+}
+
+func TestOIDCLimitsPendingLogins(t *testing.T) {
+	o := newOIDCTest(t)
+	o.provider.maxLogins = 2
+	o.login("bob")
+	to, cookie := o.login("bob")
+
+	rec := httptest.NewRecorder()
+	o.provider.Login(rec, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("login past the limit: got %d, want 503", rec.Code)
+	}
+
+	// Finishing a login makes room for another
+	if rec := o.callback(o.authorize(to), cookie); rec.Code != http.StatusSeeOther {
+		t.Fatalf("callback: got %d, want 303", rec.Code)
+	}
+	o.login("bob")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptHash returns a cheap bcrypt hash of password, as older releases
+// stored.
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestVerifyPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	weak := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("correct horse"), salt, 1, 1024, 1, 32)))
+
+	tests := []struct {
+		name       string
+		hash       string
+		password   string
+		ok, rehash bool
+	}{
+		{"argon2id", hash, "correct horse", true, false},
+		{"argon2id, wrong password", hash, "battery staple", false, false},
+		{"outdated argon2id", weak, "correct horse", true, true},
+		{"bcrypt", bcryptHash(t, "correct horse"), "correct horse", true, true},
+		{"bcrypt, wrong password", bcryptHash(t, "correct horse"), "battery staple", false, false},
+		// The parameters are part of the hash
+		{"altered parameters", strings.Replace(hash, "t=3", "t=1", 1), "correct horse", false, false},
+	}
+	for _, tt := range tests {
+		ok, rehash, err := verifyPassword(tt.hash, tt.password)
+		if err != nil || ok != tt.ok || rehash != tt.rehash {
+			t.Errorf("%s: got %v, %v, %v; want %v, %v", tt.name, ok, rehash, err, tt.ok, tt.rehash)
+		}
+	}
+
+	for _, bad := range []string{"plaintext", "$argon2id$v=18$m=1,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=x$c2FsdA$a2V5", "$argon2id$v=19"} {
+		if _, _, err := verifyPassword(bad, "correct horse"); err == nil {
+			t.Errorf("%q: got no error", bad)
+		}
+	}
+}
+
+func TestLoginUpgradesBcryptHashes(t *testing.T) {
+	db, _ := setupTestStores(t)
+	alice, _ := userStore.Create("alice", "correct horse", "user")
+	old := bcryptHash(t, "correct horse")
+	if err := db.Model(alice).Update("password_hash", old).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := userStore.Authenticate("alice", "battery staple"); err != ErrInvalidCredentials {
+		t.Errorf("wrong password: got %v, want ErrInvalidCredentials", err)
+	}
+	if stored, _ := userStore.FindByID(alice.ID); stored.PasswordHash != old {
+		t.Error("a failed login replaced the hash")
+	}
+
+	if _, err := userStore.Authenticate("alice", "correct horse"); err != nil {
+		t.Fatalf("right password: got %v", err)
+	}
+	stored, _ := userStore.FindByID(alice.ID)
+	if !strings.HasPrefix(stored.PasswordHash, "$argon2id$") {
+		t.Fatalf("got hash %q after login, want argon2id", stored.PasswordHash)
+	}
+	if ok, rehash, err := verifyPassword(stored.PasswordHash, "correct horse"); !ok || rehash || err != nil {
+		t.Errorf("upgraded hash: got %v, %v, %v; want a current match", ok, rehash, err)
+	}
+	if _, err := userStore.Authenticate("alice", "correct horse"); err != nil {
+		t.Errorf("login after the upgrade: got %v", err)
+	}
+}
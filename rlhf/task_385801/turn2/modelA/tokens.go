@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or revoked
+	// refresh tokens.
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token that was
+	// already rotated is presented again. Its family is revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// RefreshToken is a stored refresh token. Only a hash of the token is kept.
+// Every token obtained by rotation shares the family of the login it came
+// from, so that a reused token can revoke the whole chain.
+type RefreshToken struct {
+	Hash      string `gorm:"primary_key"`
+	Family    string `gorm:"index"`
+	UserID    string
+	AMR       string // Space-separated authentication methods of the login
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time // Set once the token has been rotated
+	Revoked   bool
+}
+
+// RevokedToken is an access token revoked before it expired.
+type RevokedToken struct {
+	JTI       string `gorm:"primary_key"`
+	ExpiresAt time.Time
+}
+
+// TokenStore keeps refresh tokens and the access token revocation list.
+type TokenStore struct {
+	db *gorm.DB
+}
+
+// NewTokenStore returns a TokenStore using db, creating its tables if needed.
+func NewTokenStore(db *gorm.DB) (*TokenStore, error) {
+	if err := db.AutoMigrate(&RefreshToken{}, &RevokedToken{}).Error; err != nil {
+		return nil, err
+	}
+	return &TokenStore{db: db}, nil
+}
+
+// randomID returns a random URL-safe identifier.
+func randomID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue creates a refresh token for userID in family, logged in with the
+// authentication methods amr.
+func (s *TokenStore) Issue(userID, family, amr string) (string, error) {
+	token, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	rt := &RefreshToken{
+		Hash:      hashToken(token),
+		Family:    family,
+		UserID:    userID,
+		AMR:       amr,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}
+	if err := s.db.Create(rt).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Rotate marks token as used and issues its replacement. Presenting a token
+// that was already rotated revokes its entire family.
+func (s *TokenStore) Rotate(token string) (rt *RefreshToken, next string, err error) {
+	rt = &RefreshToken{}
+	if err := s.db.Where("hash = ?", hashToken(token)).First(rt).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, "", ErrInvalidRefreshToken
+		}
+		return nil, "", err
+	}
+	if rt.Revoked {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	// Claim the token atomically so concurrent refreshes cannot both succeed
+	now := time.Now()
+	res := s.db.Model(&RefreshToken{}).
+		Where("hash = ? AND used_at IS NULL AND revoked = ?", rt.Hash, false).
+		Update("used_at", now)
+	if res.Error != nil {
+		return nil, "", res.Error
+	}
+	if res.RowsAffected == 0 {
+		if err := s.RevokeFamily(rt.Family); err != nil {
+			return nil, "", err
+		}
+		return rt, "", ErrRefreshTokenReused
+	}
+	if now.After(rt.ExpiresAt) {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	next, err = s.Issue(rt.UserID, rt.Family, rt.AMR)
+	if err != nil {
+		return nil, "", err
+	}
+	return rt, next, nil
+}
+
+// RevokeFamily revokes every refresh token in family, and with them the
+// access tokens issued alongside.
+func (s *TokenStore) RevokeFamily(family string) error {
+	return s.db.Model(&RefreshToken{}).Where("family = ?", family).Update("revoked", true).Error
+}
+
+// RevokeUser revokes every refresh token family of userID, and with them the
+// access tokens issued alongside.
+func (s *TokenStore) RevokeUser(userID string) error {
+	return s.db.Model(&RefreshToken{}).Where("user_id = ?", userID).Update("revoked", true).Error
+}
+
+// Revoke adds an access token to the revocation list until it expires.
+func (s *TokenStore) Revoke(jti string, expiresAt time.Time) error {
+	// Entries for expired tokens are no longer needed
+	if err := s.db.Where("expires_at < ?", time.Now()).Delete(&RevokedToken{}).Error; err != nil {
+		return err
+	}
+	return s.db.Save(&RevokedToken{JTI: jti, ExpiresAt: expiresAt}).Error
+}
+
+// IsRevoked reports whether the access token jti, issued in family, has been
+// revoked on its own or through its family.
+func (s *TokenStore) IsRevoked(jti, family string) (bool, error) {
+	if revoked, err := s.IsTokenRevoked(jti); revoked || err != nil {
+		return revoked, err
+	}
+	var count int
+	err := s.db.Model(&RefreshToken{}).Where("family = ? AND revoked = ?", family, true).Count(&count).Error
+	return count > 0, err
+}
+
+// IsTokenRevoked reports whether the token jti has been revoked on its own,
+// for tokens that belong to no family.
+func (s *TokenStore) IsTokenRevoked(jti string) (bool, error) {
+	var count int
+	err := s.db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"audit"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestIsTokenRevokedIgnoresFamilies(t *testing.T) {
+	db, _ := setupTestStores(t)
+	// A revoked refresh token outside any family must not revoke tokens
+	// that have none either
+	if err := db.Create(&RefreshToken{Hash: "h", UserID: "1", Revoked: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked, err := tokenStore.IsTokenRevoked("jti"); err != nil || revoked {
+		t.Fatalf("got %v, %v before revoking, want false", revoked, err)
+	}
+	if err := tokenStore.Revoke("jti", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := tokenStore.IsTokenRevoked("jti"); err != nil || !revoked {
+		t.Errorf("got %v, %v after revoking, want true", revoked, err)
+	}
+}
+
+// refresh calls Refresh with the refresh token in cookies.
+func refresh(cookies []*http.Cookie) (*httptest.ResponseRecorder, *audit.Event) {
+	req := httptest.NewRequest("POST", "https://api.test/auth/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: cookie(cookies, "refresh_token")})
+	return serve(http.HandlerFunc(Refresh), req)
+}
+
+// authed calls handler behind requiresAuth with the session in cookies.
+func authed(handler http.HandlerFunc, cookies []*http.Cookie) (*httptest.ResponseRecorder, *audit.Event) {
+	req := httptest.NewRequest("POST", "https://api.test/auth/logout", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: cookie(cookies, "token")})
+	req.Header.Set(csrfHeader, cookie(cookies, csrfCookie))
+	return serve(requiresAuth(handler), req)
+}
+
+func noContent(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	setupTestStores(t)
+	alice, _ := userStore.Create("alice", "correct horse", "user")
+	first := signIn(t, alice)
+
+	rec, _ := refresh(first)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: got %d, want 200", rec.Code)
+	}
+	second := rec.Result().Cookies()
+	if cookie(second, "refresh_token") == cookie(first, "refresh_token") {
+		t.Fatal("refresh token was not rotated")
+	}
+
+	// Replaying the rotated token ends every session in the family
+	if rec, e := refresh(first); rec.Code != http.StatusUnauthorized || e.Reason != "refresh_token_reused" {
+		t.Errorf("replay: got %d (%s), want 401 (refresh_token_reused)", rec.Code, e.Reason)
+	}
+	if rec, e := refresh(second); rec.Code != http.StatusUnauthorized || e.Reason != "invalid_refresh_token" {
+		t.Errorf("successor: got %d (%s), want 401 (invalid_refresh_token)", rec.Code, e.Reason)
+	}
+	for name, cookies := range map[string][]*http.Cookie{"first": first, "second": second} {
+		if rec, e := authed(noContent, cookies); rec.Code != http.StatusUnauthorized || e.Reason != "token_revoked" {
+			t.Errorf("%s access token: got %d (%s), want 401 (token_revoked)", name, rec.Code, e.Reason)
+		}
+	}
+}
+
+func TestExpiredTokensAreRejected(t *testing.T) {
+	db, _ := setupTestStores(t)
+	alice, _ := userStore.Create("alice", "correct horse", "user")
+	cookies := signIn(t, alice)
+
+	past := time.Now().Add(-time.Minute)
+	if err := db.Model(&RefreshToken{}).Where("user_id = ?", alice.ID).Update("expires_at", past).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rec, e := refresh(cookies); rec.Code != http.StatusUnauthorized || e.Reason != "invalid_refresh_token" {
+		t.Errorf("refresh: got %d (%s), want 401 (invalid_refresh_token)", rec.Code, e.Reason)
+	}
+
+	expired, err := keyring.Sign(&Token{
+		UserID: alice.ID,
+		Family: "family",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "jti",
+			IssuedAt:  jwt.NewNumericDate(past.Add(-accessTokenTTL)),
+			ExpiresAt: jwt.NewNumericDate(past),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredCookies := []*http.Cookie{{Name: "token", Value: expired}}
+	if rec, e := authed(noContent, expiredCookies); rec.Code != http.StatusUnauthorized || e.Reason != "token_expired" {
+		t.Errorf("access token: got %d (%s), want 401 (token_expired)", rec.Code, e.Reason)
+	}
+}
+
+func TestLogoutEndsSession(t *testing.T) {
+	setupTestStores(t)
+	alice, _ := userStore.Create("alice", "correct horse", "user")
+	cookies := signIn(t, alice)
+
+	rec, _ := authed(Logout, cookies)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout: got %d, want 204", rec.Code)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			t.Errorf("cookie %s was not cleared", c.Name)
+		}
+	}
+
+	if rec, e := authed(noContent, cookies); rec.Code != http.StatusUnauthorized || e.Reason != "token_revoked" {
+		t.Errorf("access token: got %d (%s), want 401 (token_revoked)", rec.Code, e.Reason)
+	}
+	if rec, e := refresh(cookies); rec.Code != http.StatusUnauthorized || e.Reason != "invalid_refresh_token" {
+		t.Errorf("refresh: got %d (%s), want 401 (invalid_refresh_token)", rec.Code, e.Reason)
+	}
+}
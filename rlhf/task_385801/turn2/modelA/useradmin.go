@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+
+	"audit"
+	"github.com/gorilla/mux"
+)
+
+var (
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{3,64}$`)
+	rolePattern     = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 1024
+
+	// adminRole is the role whose last enabled holder cannot be demoted,
+	// disabled or deleted, so someone is always left to manage users
+	adminRole = "admin"
+)
+
+// validationError is invalid input to the user API, naming the field
+type validationError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+func validateUsername(username string) *validationError {
+	if !usernamePattern.MatchString(username) {
+		return &validationError{"username", "must be 3 to 64 letters, digits or . _ @ -"}
+	}
+	return nil
+}
+
+func validateRole(role string) *validationError {
+	if !rolePattern.MatchString(role) {
+		return &validationError{"role", "must be a lowercase letter followed by up to 31 lowercase letters, digits, _ or -"}
+	}
+	return nil
+}
+
+func validatePassword(password string) *validationError {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return &validationError{"password", fmt.Sprintf("must be %d to %d characters", minPasswordLength, maxPasswordLength)}
+	}
+	return nil
+}
+
+// rejectInput refuses a request with invalid input
+func rejectInput(w http.ResponseWriter, r *http.Request, verr *validationError) {
+	audit.SetReason(r.Context(), "invalid_input")
+	writeJSON(w, http.StatusBadRequest, verr)
+}
+
+// userTarget names a user as the target of an audit entry
+func userTarget(id string) string {
+	return "user:" + id
+}
+
+// recordUserChange records how a request changed a user in its audit entry.
+// A nil before is a creation and a nil after a deletion.
+func recordUserChange(r *http.Request, id string, before, after *User) {
+	// A nil *User must diff as nothing rather than as JSON null
+	var b, a interface{}
+	if before != nil {
+		b = before
+	}
+	if after != nil {
+		a = after
+	}
+	changes, err := audit.Diff(b, a)
+	if err != nil {
+		log.Printf("Error recording changes to user %s: %v", id, err)
+		return
+	}
+	audit.RecordChanges(r.Context(), userTarget(id), changes)
+}
+
+// targetUser loads the user named by the {id} route variable, writing the
+// error response if there is none
+func targetUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, err := userStore.FindByID(mux.Vars(r)["id"])
+	if err == ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error looking up user: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+// isCaller reports whether user is the caller, whom admins may not lock out
+func isCaller(r *http.Request, user *User) bool {
+	principal, ok := audit.PrincipalFrom(r.Context())
+	return ok && principal.ID == user.ID
+}
+
+// isLastAdmin reports whether user is the only enabled admin
+func isLastAdmin(user *User) (bool, error) {
+	if user.Role != adminRole || user.Disabled {
+		return false, nil
+	}
+	n, err := userStore.CountEnabled(adminRole)
+	return n <= 1, err
+}
+
+// refuseLastAdmin writes the error response and returns true if user is the
+// only enabled admin
+func refuseLastAdmin(w http.ResponseWriter, r *http.Request, user *User) bool {
+	last, err := isLastAdmin(user)
+	if err != nil {
+		log.Printf("Error counting admins: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return true
+	}
+	if last {
+		audit.SetReason(r.Context(), "last_admin")
+		http.Error(w, "The last admin cannot be demoted, disabled or deleted", http.StatusConflict)
+	}
+	return last
+}
+
+// endSessions revokes the sessions and API keys of a user whose access was
+// withdrawn
+func endSessions(userID string) error {
+	if err := tokenStore.RevokeUser(userID); err != nil {
+		return err
+	}
+	return apiKeyStore.RevokeUser(userID)
+}
+
+// ListUsers lists every user
+func ListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := userStore.List()
+	if err != nil {
+		log.Printf("Error listing users: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if users == nil {
+		users = []User{}
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+// GetUser returns one user
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	if user, ok := targetUser(w, r); ok {
+		writeJSON(w, http.StatusOK, user)
+	}
+}
+
+// createUserRequest is the body of a request to create a user
+type createUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// CreateUser creates a user with a password
+func CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req createUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = "user"
+	}
+	for _, verr := range []*validationError{validateUsername(req.Username), validateRole(req.Role), validatePassword(req.Password)} {
+		if verr != nil {
+			rejectInput(w, r, verr)
+			return
+		}
+	}
+
+	user, err := userStore.Create(req.Username, req.Password, req.Role)
+	if err == ErrUserExists {
+		audit.SetReason(r.Context(), "username_taken")
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating user: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	recordUserChange(r, user.ID, nil, user)
+	log.Printf("Created user %s (%s, role %s)", user.ID, user.Username, user.Role)
+	writeJSON(w, http.StatusCreated, user)
+}
+
+// updateUserRequest is the body of a request to change a user. Fields left
+// out are unchanged.
+type updateUserRequest struct {
+	Username *string `json:"username"`
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// UpdateUser renames a user, assigns their role or disables or enables
+// their account. Disabling ends their sessions and revokes their API keys.
+func UpdateUser(w http.ResponseWriter, r *http.Request) {
+	before, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	var req updateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	after := *before
+	if req.Username != nil {
+		if verr := validateUsername(*req.Username); verr != nil {
+			rejectInput(w, r, verr)
+			return
+		}
+		after.Username = *req.Username
+	}
+	if req.Role != nil {
+		if verr := validateRole(*req.Role); verr != nil {
+			rejectInput(w, r, verr)
+			return
+		}
+		after.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		after.Disabled = *req.Disabled
+	}
+	if isCaller(r, before) && (after.Role != before.Role || after.Disabled) {
+		audit.SetReason(r.Context(), "cannot_modify_self")
+		http.Error(w, "Admins cannot change their own role or disable themselves", http.StatusConflict)
+		return
+	}
+	if (after.Role != adminRole || after.Disabled) && refuseLastAdmin(w, r, before) {
+		return
+	}
+	if after == *before {
+		writeJSON(w, http.StatusOK, before)
+		return
+	}
+
+	err := userStore.Update(&after)
+	if err == ErrUserExists {
+		audit.SetReason(r.Context(), "username_taken")
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
+	if err == nil && after.Disabled && !before.Disabled {
+		err = endSessions(after.ID)
+	}
+	if err != nil {
+		log.Printf("Error updating user %s: %v", before.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	recordUserChange(r, after.ID, before, &after)
+	log.Printf("Updated user %s", after.ID)
+	writeJSON(w, http.StatusOK, after)
+}
+
+// ResetPassword sets a user's password and ends their sessions
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if verr := validatePassword(req.Password); verr != nil {
+		rejectInput(w, r, verr)
+		return
+	}
+
+	err := userStore.SetPassword(user.Username, req.Password)
+	if err == nil {
+		err = tokenStore.RevokeUser(user.ID)
+	}
+	if err != nil {
+		log.Printf("Error resetting password of user %s: %v", user.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// The password itself is never logged, only that it changed
+	audit.RecordChanges(r.Context(), userTarget(user.ID), audit.Changes{{Field: "password"}})
+	log.Printf("Reset password of user %s", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUser deletes a user, ending their sessions and removing their API
+// keys and second factor
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	if isCaller(r, user) {
+		audit.SetReason(r.Context(), "cannot_modify_self")
+		http.Error(w, "Admins cannot delete themselves", http.StatusConflict)
+		return
+	}
+	if refuseLastAdmin(w, r, user) {
+		return
+	}
+
+	err := endSessions(user.ID)
+	if err == nil {
+		err = mfaStore.Disable(user.ID)
+	}
+	if err == nil {
+		err = userStore.Delete(user.ID)
+	}
+	if err != nil {
+		log.Printf("Error deleting user %s: %v", user.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	recordUserChange(r, user.ID, user, nil)
+	log.Printf("Deleted user %s (%s)", user.ID, user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"audit"
+	"github.com/gorilla/mux"
+)
+
+// automation is an admin caller with no user account, such as a client
+// certificate, so that no test user is protected as the caller.
+var automation = &User{ID: "automation", Username: "automation"}
+
+// asAdmin calls handler as caller for the user with id, returning the
+// response and the audit event the request built.
+func asAdmin(handler http.HandlerFunc, caller *User, id string, body interface{}) (*httptest.ResponseRecorder, *audit.Event) {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/", strings.NewReader(string(b)))
+	req.Header.Set("Content-Type", "application/json")
+	ctx, e := audit.Begin(req.Context())
+	ctx = audit.WithPrincipal(ctx, &audit.Principal{ID: caller.ID, Username: caller.Username, Roles: []string{adminRole}})
+	req = mux.SetURLVars(req.WithContext(ctx), map[string]string{"id": id})
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec, e
+}
+
+// changed returns the change to field in e, if any.
+func changed(e *audit.Event, field string) (audit.Change, bool) {
+	for _, c := range e.Changes {
+		if c.Field == field {
+			return c, true
+		}
+	}
+	return audit.Change{}, false
+}
+
+func TestCreateUser(t *testing.T) {
+	setupTestStores(t)
+
+	rec, e := asAdmin(CreateUser, automation, "", createUserRequest{Username: "bob", Password: "correct horse", Role: "auditor"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got %d, want 201", rec.Code)
+	}
+	bob, err := userStore.FindByUsername("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Target != userTarget(bob.ID) {
+		t.Errorf("got target %q, want %q", e.Target, userTarget(bob.ID))
+	}
+	if c, ok := changed(e, "role"); !ok || c.Before != nil || string(c.After) != `"auditor"` {
+		t.Errorf("got role change %+v, want nothing to auditor", c)
+	}
+	diff, _ := json.Marshal(e.Changes)
+	if strings.Contains(string(diff), bob.PasswordHash) || strings.Contains(strings.ToLower(string(diff)), "password") {
+		t.Errorf("diff %s records the password", diff)
+	}
+
+	tests := []struct {
+		name   string
+		req    createUserRequest
+		status int
+		reason string
+	}{
+		{"duplicate username", createUserRequest{Username: "bob", Password: "battery staple"}, http.StatusConflict, "username_taken"},
+		{"invalid username", createUserRequest{Username: "b b", Password: "battery staple"}, http.StatusBadRequest, "invalid_input"},
+		{"invalid role", createUserRequest{Username: "carol", Password: "battery staple", Role: "Admin"}, http.StatusBadRequest, "invalid_input"},
+		{"short password", createUserRequest{Username: "carol", Password: "short"}, http.StatusBadRequest, "invalid_input"},
+	}
+	for _, tt := range tests {
+		rec, e := asAdmin(CreateUser, automation, "", tt.req)
+		if rec.Code != tt.status || e.Reason != tt.reason {
+			t.Errorf("%s: got %d (%s), want %d (%s)", tt.name, rec.Code, e.Reason, tt.status, tt.reason)
+		}
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	setupTestStores(t)
+	alice, _ := userStore.Create("alice", "correct horse", "user")
+	if _, err := userStore.Create("bob", "correct horse", "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	rename, role := "alicia", "auditor"
+	rec, e := asAdmin(UpdateUser, automation, alice.ID, updateUserRequest{Username: &rename, Role: &role})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", rec.Code)
+	}
+	if c, ok := changed(e, "username"); !ok || string(c.Before) != `"alice"` || string(c.After) != `"alicia"` {
+		t.Errorf("got username change %+v, want alice to alicia", c)
+	}
+	if c, ok := changed(e, "role"); !ok || string(c.Before) != `"user"` || string(c.After) != `"auditor"` {
+		t.Errorf("got role change %+v, want user to auditor", c)
+	}
+	if len(e.Changes) != 2 {
+		t.Errorf("got changes %+v, want only username and role", e.Changes)
+	}
+
+	taken := "bob"
+	if rec, e := asAdmin(UpdateUser, automation, alice.ID, updateUserRequest{Username: &taken}); rec.Code != http.StatusConflict || e.Reason != "username_taken" {
+		t.Errorf("duplicate username: got %d (%s), want 409 (username_taken)", rec.Code, e.Reason)
+	}
+	if rec, _ := asAdmin(UpdateUser, automation, "missing", updateUserRequest{Role: &role}); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown user: got %d, want 404", rec.Code)
+	}
+
+	// Disabling ends the user's sessions
+	if _, err := tokenStore.Issue(alice.ID, "family", ""); err != nil {
+		t.Fatal(err)
+	}
+	disabled := true
+	if rec, _ := asAdmin(UpdateUser, automation, alice.ID, updateUserRequest{Disabled: &disabled}); rec.Code != http.StatusOK {
+		t.Fatalf("disable: got %d, want 200", rec.Code)
+	}
+	if revoked, err := tokenStore.IsRevoked("jti", "family"); err != nil || !revoked {
+		t.Errorf("got revoked %v (%v), want the session ended", revoked, err)
+	}
+}
+
+func TestLastAdminIsProtected(t *testing.T) {
+	setupTestStores(t)
+	root, _ := userStore.Create("root", "correct horse", adminRole)
+	disabled, demoted := true, "user"
+
+	if rec, e := asAdmin(UpdateUser, automation, root.ID, updateUserRequest{Role: &demoted}); rec.Code != http.StatusConflict || e.Reason != "last_admin" {
+		t.Errorf("demote: got %d (%s), want 409 (last_admin)", rec.Code, e.Reason)
+	}
+	if rec, e := asAdmin(UpdateUser, automation, root.ID, updateUserRequest{Disabled: &disabled}); rec.Code != http.StatusConflict || e.Reason != "last_admin" {
+		t.Errorf("disable: got %d (%s), want 409 (last_admin)", rec.Code, e.Reason)
+	}
+	if rec, e := asAdmin(DeleteUser, automation, root.ID, nil); rec.Code != http.StatusConflict || e.Reason != "last_admin" {
+		t.Errorf("delete: got %d (%s), want 409 (last_admin)", rec.Code, e.Reason)
+	}
+
+	// Admins may not lock themselves out either
+	if rec, e := asAdmin(DeleteUser, root, root.ID, nil); rec.Code != http.StatusConflict || e.Reason != "cannot_modify_self" {
+		t.Errorf("delete self: got %d (%s), want 409 (cannot_modify_self)", rec.Code, e.Reason)
+	}
+
+	// A disabled admin does not count
+	ops, _ := userStore.Create("ops", "correct horse", adminRole)
+	if rec, _ := asAdmin(UpdateUser, automation, ops.ID, updateUserRequest{Disabled: &disabled}); rec.Code != http.StatusOK {
+		t.Fatalf("disable the second admin: got %d, want 200", rec.Code)
+	}
+	if rec, _ := asAdmin(UpdateUser, automation, root.ID, updateUserRequest{Role: &demoted}); rec.Code != http.StatusConflict {
+		t.Errorf("demote with a disabled second admin: got %d, want 409", rec.Code)
+	}
+
+	enabled := false
+	if rec, _ := asAdmin(UpdateUser, automation, ops.ID, updateUserRequest{Disabled: &enabled}); rec.Code != http.StatusOK {
+		t.Fatalf("enable the second admin: got %d, want 200", rec.Code)
+	}
+	if rec, _ := asAdmin(UpdateUser, automation, root.ID, updateUserRequest{Role: &demoted}); rec.Code != http.StatusOK {
+		t.Errorf("demote with a second admin: got %d, want 200", rec.Code)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	setupTestStores(t)
+	alice, _ := userStore.Create("alice", "correct horse", "user")
+
+	if rec, e := asAdmin(ResetPassword, automation, alice.ID, map[string]string{"password": "short"}); rec.Code != http.StatusBadRequest || e.Reason != "invalid_input" {
+		t.Errorf("short password: got %d (%s), want 400 (invalid_input)", rec.Code, e.Reason)
+	}
+
+	rec, e := asAdmin(ResetPassword, automation, alice.ID, map[string]string{"password": "battery staple"})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got %d, want 204", rec.Code)
+	}
+	if _, err := userStore.Authenticate("alice", "correct horse"); err != ErrInvalidCredentials {
+		t.Errorf("old password: got %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := userStore.Authenticate("alice", "battery staple"); err != nil {
+		t.Errorf("new password: got %v", err)
+	}
+	if len(e.Changes) != 1 || e.Changes[0].Field != "password" || e.Changes[0].Before != nil || e.Changes[0].After != nil {
+		t.Errorf("got changes %+v, want password with no values", e.Changes)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	db, _ := setupTestStores(t)
+	alice, _, _ := enrollTestMFA(t, "alice", "correct horse")
+	link := &ExternalIdentity{Issuer: "https://idp.test", Subject: "alice", UserID: alice.ID}
+	if err := db.Create(link).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rec, e := asAdmin(DeleteUser, automation, alice.ID, nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got %d, want 204", rec.Code)
+	}
+	if _, err := userStore.FindByID(alice.ID); err != ErrUserNotFound {
+		t.Errorf("got %v looking up the user, want ErrUserNotFound", err)
+	}
+	var links int
+	if err := db.Model(&ExternalIdentity{}).Where("user_id = ?", alice.ID).Count(&links).Error; err != nil || links != 0 {
+		t.Errorf("got %d identity links (%v), want none", links, err)
+	}
+	if c, ok := changed(e, "username"); !ok || string(c.Before) != `"alice"` || c.After != nil {
+		t.Errorf("got username change %+v, want alice to nothing", c)
+	}
+	diff, _ := json.Marshal(e.Changes)
+	if strings.Contains(string(diff), alice.PasswordHash) {
+		t.Errorf("diff %s records the password hash", diff)
+	}
+
+	if rec, _ := asAdmin(DeleteUser, automation, alice.ID, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("deleted again: got %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// runUsers runs the users subcommand with password on stdin, discarding its
+// output.
+func runUsers(t *testing.T, password string, args ...string) int {
+	t.Helper()
+	in := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(in, []byte(password+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+
+	oldIn, oldOut, oldErr := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = stdin, null, null
+	defer func() { os.Stdin, os.Stdout, os.Stderr = oldIn, oldOut, oldErr }()
+	return RunUsers(args)
+}
+
+func TestRunUsers(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	tests := []struct {
+		name     string
+		password string
+		args     []string
+		code     int
+	}{
+		{"create", "correct horse", []string{"create", "-db", dbPath, "-username", "alice", "-role", "admin"}, 0},
+		{"create taken", "correct horse", []string{"create", "-db", dbPath, "-username", "alice"}, 1},
+		{"passwd", "battery staple", []string{"passwd", "-db", dbPath, "-username", "alice"}, 0},
+		{"passwd unknown", "battery staple", []string{"passwd", "-db", dbPath, "-username", "bob"}, 1},
+		{"short password", "short", []string{"create", "-db", dbPath, "-username", "bob"}, 1},
+		{"invalid username", "correct horse", []string{"create", "-db", dbPath, "-username", "b b"}, 2},
+		{"invalid role", "correct horse", []string{"create", "-db", dbPath, "-username", "bob", "-role", "Admin"}, 2},
+		{"no username", "correct horse", []string{"create", "-db", dbPath}, 2},
+		{"unknown command", "correct horse", []string{"delete", "-db", dbPath, "-username", "alice"}, 2},
+		{"no command", "correct horse", nil, 2},
+	}
+	for _, tt := range tests {
+		if code := runUsers(t, tt.password, tt.args...); code != tt.code {
+			t.Errorf("%s: got exit code %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	db, err := gorm.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := NewUserStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := store.List()
+	if err != nil || len(users) != 1 {
+		t.Fatalf("got users %v (%v), want only alice", users, err)
+	}
+	alice, err := store.Authenticate("alice", "battery staple")
+	if err != nil {
+		t.Fatalf("new password: got %v", err)
+	}
+	if alice.Role != "admin" {
+		t.Errorf("got role %s, want admin", alice.Role)
+	}
+}
@@ -3,11 +3,15 @@ module modal-b
 go 1.21.0
 
 require (
+	audit v0.0.0
 	github.com/gorilla/mux v1.8.1
 	github.com/jinzhu/gorm v1.9.16
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/mattn/go-sqlite3 v1.14.0 // indirect
 )
+
+replace audit => ../../audit
@@ -1,128 +1,143 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"audit"
+	"audit/access"
+	"audit/clientip"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/sqlite" // Replace with your preferred DB dialect
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
+// Role is a named set of permissions granted through the policy file
+type Role struct {
+	gorm.Model
+	Name string `json:"name" gorm:"unique_index"`
+}
+
 type User struct {
 	gorm.Model
 	Username string `json:"username"`
-	Password string `json:"password"`
+	Roles    []Role `json:"roles" gorm:"many2many:user_roles"`
 }
 
-type AuditLog struct {
-	Timestamp time.Time `json:"timestamp"`
-	Method    string    `json:"method"`
-	Path      string    `json:"path"`
-	RemoteIP  string    `json:"remote_ip"`
-	UserAgent string    `json:"user_agent"`
-	UserID    uint      `json:"user_id"`
-	Username  string    `json:"username"`
+// RoleNames returns the names of the user's roles
+func (u *User) RoleNames() []string {
+	names := make([]string, len(u.Roles))
+	for i, role := range u.Roles {
+		names[i] = role.Name
+	}
+	return names
 }
 
-// Sample in-memory authorization rules
-var authRules = map[string][]string{
-	"/admin": {"admin"},
-	"/data":  {"user", "admin"},
-}
+// Errors returned by authenticate for requests without valid credentials
+var (
+	ErrTokenRequired = errors.New("token required")
+	ErrInvalidToken  = errors.New("invalid token format")
+)
 
-func authenticate(r *http.Request) (uint, string, error) {
+func authenticate(users UserRepository, r *http.Request) (*User, error) {
 	token := r.Header.Get("Authorization")
 	if token == "" {
-		return 0, "", fmt.Errorf("token required")
+		return nil, ErrTokenRequired
 	}
 
 	// Simplified token validation for demonstration purposes
 	// In a real application, use a proper JWT library for validation
 	parts := strings.SplitN(token, " ", 2)
 	if len(parts) != 2 || parts[0] != "Bearer" {
-		return 0, "", fmt.Errorf("invalid token format")
+		return nil, ErrInvalidToken
 	}
 
 	// Extract username from the token (in a real app, this would be from the decoded JWT)
 	username := parts[1]
 
-	db, err := gorm.Open("sqlite3", ":memory:") // Replace with your database connection string
-	if err != nil {
-		return 0, "", err
-	}
-	defer db.Close()
+	return users.FindByUsername(username)
+}
 
-	var user User
-	if err := db.First(&user, "username = ?", username).Error; err != nil {
-		return 0, "", fmt.Errorf("user not found")
-	}
+// policy decides which roles may access which routes
+var policy *access.Engine
 
-	return user.ID, user.Username, nil
+func authorize(r *http.Request, principal *audit.Principal) access.Decision {
+	return policy.Decide(&access.Request{
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Principal: principal,
+		RemoteIP:  auditLogger.ClientIP(r),
+		Time:      time.Now(),
+	})
 }
 
-func authorize(path string, userID uint, username string) bool {
-	allowedRoles, ok := authRules[path]
-	if !ok {
-		return false // No rule defined for this path, deny by default
-	}
-
-	if username == "admin" {
-		return true // Admin has access to all
+// auditLogger records every request, including those LoggingMiddleware
+// refuses
+var auditLogger *audit.Logger
+
+// denialReason returns the audit reason code for an authenticate error
+func denialReason(err error) string {
+	switch err {
+	case ErrTokenRequired:
+		return "missing_token"
+	case ErrInvalidToken:
+		return "malformed_token"
+	case ErrUserNotFound:
+		return "unknown_user"
 	}
+	return "authentication_error"
+}
 
-	for _, role := range allowedRoles {
-		if role == "user" {
-			return true // User has access to specified paths
-		}
+// policyReason returns the audit reason code for a policy denial
+func policyReason(d access.Decision) string {
+	if d.Rule == "" {
+		return "no_matching_rule"
 	}
-
-	return false // User denied access
+	return "denied_by_rule:" + d.Rule
 }
 
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		userID, username, err := authenticate(r)
-		if err != nil {
+func LoggingMiddleware(users UserRepository, next http.Handler) http.Handler {
+	return auditLogger.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(users, r)
+		switch {
+		case err == ErrTokenRequired, err == ErrInvalidToken, err == ErrUserNotFound:
+			audit.SetOutcome(r.Context(), audit.OutcomeUnauthenticated, denialReason(err))
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
+		case err != nil:
+			log.Printf("Error authenticating request: %v", err)
+			audit.SetOutcome(r.Context(), audit.OutcomeError, denialReason(err))
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
 		}
 
-		if !authorize(r.URL.Path, userID, username) {
+		principal := &audit.Principal{
+			ID:         strconv.FormatUint(uint64(user.ID), 10),
+			Username:   user.Username,
+			Roles:      user.RoleNames(),
+			AuthMethod: audit.AuthBearer,
+		}
+		ctx := audit.WithPrincipal(r.Context(), principal)
+		decision := authorize(r, principal)
+		audit.SetRule(ctx, decision.Rule)
+		if !decision.Allowed {
+			audit.SetOutcome(ctx, audit.OutcomeForbidden, policyReason(decision))
 			http.Error(w, "forbidden", http.StatusForbidden)
 			return
 		}
 
 		// Handle the request
-		next.ServeHTTP(w, r)
-
-		logEntry := &AuditLog{
-			Timestamp: start,
-			Method:    r.Method,
-			Path:      r.URL.Path,
-			RemoteIP:  strings.SplitN(r.RemoteAddr, ":", 2)[0],
-			UserAgent: r.UserAgent(),
-			UserID:    userID,
-			Username:  username,
-		}
-
-		logAudit(logEntry)
-	})
-}
-
-func logAudit(logEntry *AuditLog) {
-	b, err := json.Marshal(logEntry)
-	if err != nil {
-		log.Printf("Error marshaling audit log: %v", err)
-		return
-	}
-	log.Println(string(b))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}))
 }
 
 func helloWorld(w http.ResponseWriter, r *http.Request) {
@@ -131,13 +146,81 @@ func helloWorld(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(audit.RunVerify(os.Args[2:]))
+	}
+
+	sinkKind := flag.String("audit-sink", "stdout", "Audit sink: stdout, file, sqlite or syslog")
+	sinkPath := flag.String("audit-path", "audit.log", "Audit file, SQLite database path or syslog URL such as tcp://host:601?format=cef&spool=audit.spool")
+	retention := audit.RetentionFlags(flag.CommandLine)
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose forwarding headers are trusted")
+	policyPath := flag.String("policy", "policy.yaml", "YAML access policy, reloaded when it changes")
+	dbPath := flag.String("db", "app.db", "SQLite database holding users and roles")
+	seedPath := flag.String("seed", "seed.yaml", "YAML fixture of users to create at startup; empty to skip")
+	flag.Parse()
+
+	db, err := gorm.Open("sqlite3", *dbPath)
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	users, err := NewUserRepository(db)
+	if err != nil {
+		log.Fatalf("Error migrating database: %v", err)
+	}
+	if *seedPath != "" {
+		if err := SeedUsers(db, *seedPath); err != nil {
+			log.Fatalf("Error seeding users: %v", err)
+		}
+	}
+
+	policy, err = access.NewEngine(*policyPath)
+	if err != nil {
+		log.Fatalf("Error loading policy: %v", err)
+	}
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	go policy.Watch(2*time.Second, stopWatch)
+
+	resolver, err := clientip.ParseList(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Error parsing trusted proxies: %v", err)
+	}
+
+	sink, cleanup, err := audit.OpenSink(*sinkKind, *sinkPath, retention())
+	if err != nil {
+		log.Fatalf("Error opening audit sink: %v", err)
+	}
+	auditLogger = audit.NewLogger(sink, resolver)
+
 	r := mux.NewRouter()
 	r.HandleFunc("/", helloWorld).Methods("GET")
 	r.HandleFunc("/admin", helloWorld).Methods("GET")
 	r.HandleFunc("/data", helloWorld).Methods("GET")
 
 	// Wrap the router with the logging middleware
-	loggedRouter := LoggingMiddleware(r)
+	loggedRouter := LoggingMiddleware(users, r)
+
+	srv := &http.Server{Addr: ":8080", Handler: loggedRouter}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 
-	log.Fatal(http.ListenAndServe(":8080", loggedRouter))
+	// Wait for a shutdown signal so buffered audit entries can be flushed
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		log.Printf("Error closing audit sink: %v", err)
+	}
+	cleanup()
 }
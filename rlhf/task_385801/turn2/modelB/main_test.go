@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"audit"
+	"audit/access"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*audit.Event
+}
+
+func (s *recordingSink) Write(e *audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestLoggingMiddlewareRecordsPrincipal(t *testing.T) {
+	db, users := newTestRepository(t)
+	if err := SeedUsers(db, "seed.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if policy, err = access.NewEngine("policy.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	sink := &recordingSink{}
+	auditLogger = audit.NewLogger(sink, nil)
+
+	var seen *audit.Principal
+	handler := LoggingMiddleware(users, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = audit.PrincipalFrom(r.Context())
+	}))
+	tests := []struct {
+		token   string
+		status  int
+		user    string
+		outcome string
+	}{
+		{"alice", http.StatusOK, "alice", audit.OutcomeAllowed},
+		{"", http.StatusUnauthorized, "", audit.OutcomeUnauthenticated},
+		{"mallory", http.StatusUnauthorized, "", audit.OutcomeUnauthenticated},
+	}
+	for _, tt := range tests {
+		sink.events, seen = nil, nil
+		req := httptest.NewRequest("GET", "/data", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status || len(sink.events) != 1 {
+			t.Fatalf("%q: got %d with %d events, want %d with 1", tt.token, rec.Code, len(sink.events), tt.status)
+		}
+		e := sink.events[0]
+		if e.Username != tt.user || e.Outcome != tt.outcome {
+			t.Errorf("%q: got user %q, outcome %q; want %q, %q", tt.token, e.Username, e.Outcome, tt.user, tt.outcome)
+		}
+		if tt.user == "" {
+			continue
+		}
+		if e.Principal != seen || e.Principal.AuthMethod != audit.AuthBearer || !e.Principal.HasRole("user") {
+			t.Errorf("%q: got principal %+v in the event and %+v in the handler", tt.token, e.Principal, seen)
+		}
+		if e.Rule != "data-read" {
+			t.Errorf("%q: got rule %q, want data-read", tt.token, e.Rule)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/jinzhu/gorm"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUserNotFound is returned when no user has the requested username.
+var ErrUserNotFound = errors.New("user not found")
+
+// UserRepository looks up users for authentication.
+type UserRepository interface {
+	FindByUsername(username string) (*User, error)
+}
+
+// gormUserRepository is a UserRepository in a SQL database.
+type gormUserRepository struct {
+	db *gorm.DB
+}
+
+// NewUserRepository returns a UserRepository using db, creating the user and
+// role tables if needed.
+func NewUserRepository(db *gorm.DB) (UserRepository, error) {
+	if err := db.AutoMigrate(&User{}, &Role{}).Error; err != nil {
+		return nil, err
+	}
+	return &gormUserRepository{db: db}, nil
+}
+
+func (repo *gormUserRepository) FindByUsername(username string) (*User, error) {
+	var user User
+	if err := repo.db.Preload("Roles").First(&user, "username = ?", username).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// seedFile is the fixture format for SeedUsers.
+type seedFile struct {
+	Users []struct {
+		Username string   `yaml:"username"`
+		Roles    []string `yaml:"roles"`
+	} `yaml:"users"`
+}
+
+// SeedUsers creates the users and roles listed in the YAML fixture at path.
+// Users that already exist have their roles replaced by those in the file,
+// so seeding can run on every start.
+func SeedUsers(db *gorm.DB, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var seed seedFile
+	if err := yaml.Unmarshal(data, &seed); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, s := range seed.Users {
+			if s.Username == "" {
+				return fmt.Errorf("%s: user without username", path)
+			}
+			roles := make([]Role, len(s.Roles))
+			for i, name := range s.Roles {
+				if err := tx.Where(Role{Name: name}).FirstOrCreate(&roles[i]).Error; err != nil {
+					return err
+				}
+			}
+
+			var user User
+			if err := tx.Where(User{Username: s.Username}).FirstOrCreate(&user).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&user).Association("Roles").Replace(roles).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
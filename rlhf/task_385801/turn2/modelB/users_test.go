@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// newTestRepository returns a repository on a fresh in-memory database.
+func newTestRepository(t *testing.T) (*gorm.DB, UserRepository) {
+	t.Helper()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection would get its own empty database
+	db.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	users, err := NewUserRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, users
+}
+
+// writeSeed writes a seed fixture and returns its path.
+func writeSeed(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "seed.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// rolesOf returns the sorted role names of username.
+func rolesOf(t *testing.T, users UserRepository, username string) []string {
+	t.Helper()
+	user, err := users.FindByUsername(username)
+	if err != nil {
+		t.Fatalf("%s: %v", username, err)
+	}
+	names := user.RoleNames()
+	sort.Strings(names)
+	return names
+}
+
+func TestFindByUsername(t *testing.T) {
+	db, users := newTestRepository(t)
+	if err := SeedUsers(db, writeSeed(t, "users:\n  - username: alice\n    roles: [user, auditor]\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := users.FindByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || len(user.Roles) != 2 {
+		t.Errorf("got %s with roles %v, want alice with 2 roles", user.Username, user.Roles)
+	}
+	for _, name := range []string{"bob", "Alice", ""} {
+		if _, err := users.FindByUsername(name); err != ErrUserNotFound {
+			t.Errorf("%q: got %v, want ErrUserNotFound", name, err)
+		}
+	}
+}
+
+func TestSeedUsers(t *testing.T) {
+	db, users := newTestRepository(t)
+	if err := SeedUsers(db, "seed.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if got := rolesOf(t, users, "admin"); !reflect.DeepEqual(got, []string{"admin"}) {
+		t.Errorf("admin: got roles %v, want [admin]", got)
+	}
+
+	// Seeding again replaces roles rather than adding users or roles
+	if err := SeedUsers(db, writeSeed(t, "users:\n  - username: alice\n    roles: [admin, user]\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := rolesOf(t, users, "alice"); !reflect.DeepEqual(got, []string{"admin", "user"}) {
+		t.Errorf("alice: got roles %v, want [admin user]", got)
+	}
+	var userCount, roleCount int
+	db.Model(&User{}).Count(&userCount)
+	db.Model(&Role{}).Count(&roleCount)
+	if userCount != 2 || roleCount != 2 {
+		t.Errorf("got %d users and %d roles, want 2 of each", userCount, roleCount)
+	}
+}
+
+func TestSeedUsersRejectsBadFixtures(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"invalid yaml", "users: [\n"},
+		{"missing username", "users:\n  - username: carol\n    roles: [user]\n  - roles: [admin]\n"},
+	}
+	for _, tt := range tests {
+		db, users := newTestRepository(t)
+		if err := SeedUsers(db, writeSeed(t, tt.data)); err == nil {
+			t.Errorf("%s: got no error", tt.name)
+		}
+		// A failed seed leaves nothing behind
+		if _, err := users.FindByUsername("carol"); err != ErrUserNotFound {
+			t.Errorf("%s: got %v for carol, want ErrUserNotFound", tt.name, err)
+		}
+	}
+
+	db, _ := newTestRepository(t)
+	if err := SeedUsers(db, filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file: got no error")
+	}
+}